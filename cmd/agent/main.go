@@ -1,11 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
+
 	"github.com/SamMeown/metrix/internal/agent"
 	"github.com/SamMeown/metrix/internal/agent/client"
 	"github.com/SamMeown/metrix/internal/agent/config"
 	"github.com/SamMeown/metrix/internal/agent/metrics"
+	"github.com/SamMeown/metrix/internal/crypto/envelope"
 	"github.com/SamMeown/metrix/internal/crypto/signer"
+	"github.com/SamMeown/metrix/internal/crypto/tlsconf"
 	"github.com/SamMeown/metrix/internal/storage"
 )
 
@@ -14,7 +18,26 @@ func main() {
 	mStorage := storage.NewMemStorage()
 	mCollector := metrics.NewCollector(mStorage)
 	mSigner := signer.New(agentConfig.SignKey)
-	mClient := client.NewMetricsClient(agentConfig.ServerBaseAddress, agentConfig.RateLimit, mSigner)
+
+	var tlsConfig *tls.Config
+	if agentConfig.UseTLS {
+		var err error
+		tlsConfig, err = tlsconf.Client(agentConfig.TLSCAFile, agentConfig.TLSCertFile, agentConfig.TLSKeyFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var encryptor *envelope.Encryptor
+	if agentConfig.CryptoKey != "" {
+		var err error
+		encryptor, err = envelope.LoadEncryptor(agentConfig.CryptoKey)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	mClient := client.NewMetricsClient(agentConfig, mSigner, tlsConfig, encryptor, metrics.Describe)
 
 	agent.Start(agentConfig, mCollector, mClient)
 }
@@ -3,28 +3,73 @@ package main
 import (
 	"context"
 	"database/sql"
+	"github.com/SamMeown/metrix/internal/crypto/envelope"
 	"github.com/SamMeown/metrix/internal/crypto/signer"
 	"github.com/SamMeown/metrix/internal/storage"
 	"github.com/SamMeown/metrix/internal/storage/pg"
 	"github.com/SamMeown/metrix/internal/storage/retryable"
-	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 
 	"github.com/SamMeown/metrix/internal/server"
+	"github.com/SamMeown/metrix/internal/server/auth"
 	"github.com/SamMeown/metrix/internal/server/config"
+	"github.com/SamMeown/metrix/internal/server/idempotency"
 	"github.com/SamMeown/metrix/internal/server/saver"
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT)
+	defer stop()
+
 	serverConfig := config.Parse()
-	contentSigner := signer.New(serverConfig.SignKey)
+
+	var keyring *signer.Keyring
+	if serverConfig.SignKeysFile != "" {
+		var err error
+		keyring, err = signer.LoadKeyring(serverConfig.SignKeysFile)
+		if err != nil {
+			panic(err)
+		}
+		if serverConfig.SignKeysReloadInterval > 0 {
+			go keyring.Watch(ctx, serverConfig.SignKeysFile, time.Duration(serverConfig.SignKeysReloadInterval)*time.Second)
+		}
+	} else if serverConfig.SignKey != "" {
+		var err error
+		keyring, err = signer.NewKeyring("", map[string]string{"": serverConfig.SignKey})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var decryptor *envelope.Decryptor
+	if serverConfig.CryptoKey != "" {
+		var err error
+		decryptor, err = envelope.LoadDecryptor(serverConfig.CryptoKey)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var authenticator *auth.Authenticator
+	if serverConfig.TokensFile != "" {
+		var err error
+		authenticator, err = auth.Load(serverConfig.TokensFile)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	var metricsStorage storage.MetricsStorage
 	var storageSaver *saver.MetricsStorageSaver
+	var idempotencyStore idempotency.Store
 	if len(serverConfig.DatabaseDSN) > 0 {
 		db, err := sql.Open("pgx", serverConfig.DatabaseDSN)
 		if err != nil {
@@ -39,6 +84,13 @@ func main() {
 		}
 
 		metricsStorage = retryable.NewStorage(pgStorage, pg.IsRetryableError)
+
+		pgIdempotencyStore := idempotency.NewPGStore(db, time.Duration(serverConfig.IdempotencyTTL)*time.Second)
+		err = pgIdempotencyStore.Bootstrap(ctx)
+		if err != nil {
+			panic(err)
+		}
+		idempotencyStore = pgIdempotencyStore
 	} else {
 		metricsStorage = storage.New()
 
@@ -47,19 +99,8 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+		defer storageSaver.Close()
 	}
 
-	go func() {
-		gracefulShutdown := make(chan os.Signal, 1)
-		signal.Notify(gracefulShutdown,
-			syscall.SIGHUP,
-			syscall.SIGINT,
-			syscall.SIGTERM,
-			syscall.SIGQUIT)
-
-		<-gracefulShutdown
-		server.Stop()
-	}()
-
-	server.Run(ctx, serverConfig, metricsStorage, storageSaver, contentSigner)
+	server.Run(ctx, serverConfig, metricsStorage, storageSaver, keyring, decryptor, authenticator, idempotencyStore)
 }
@@ -0,0 +1,1102 @@
+// Code generated by clientgen from internal/openapi/openapi.json. DO NOT EDIT.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/SamMeown/metrix/internal/models"
+)
+
+type Alert struct {
+	ActiveAt    *string `json:"activeAt,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Expr        string  `json:"expr"`
+	FiredAt     *string `json:"firedAt,omitempty"`
+	Metric      string  `json:"metric"`
+	ResolvedAt  *string `json:"resolvedAt,omitempty"`
+	Rule        string  `json:"rule"`
+	State       string  `json:"state"`
+	// Last evaluated value, absent if there is no data
+	Value *float64 `json:"value,omitempty"`
+}
+
+type AlertsList struct {
+	Alerts []Alert `json:"alerts"`
+}
+
+type BatchResponse struct {
+	Errors  []Error   `json:"errors,omitempty"`
+	Metrics []Metrics `json:"metrics,omitempty"`
+}
+
+type Error struct {
+	Code   string  `json:"code"`
+	Errors []Error `json:"errors,omitempty"`
+	// Offending metrics name
+	ID *string `json:"id,omitempty"`
+	// Offending metrics index in the batch
+	Index   *int   `json:"index,omitempty"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+type ExportRecord struct {
+	ID    string     `json:"id"`
+	Time  string     `json:"time"`
+	Type  string     `json:"type"`
+	Unit  *string    `json:"unit,omitempty"`
+	Value QueryValue `json:"value"`
+}
+
+type HistoryPoint struct {
+	// Unix time in milliseconds
+	T int64   `json:"t"`
+	V float64 `json:"v"`
+}
+
+type ImportResponse struct {
+	Imported int `json:"imported"`
+}
+
+type ListedMetrics struct {
+	// Counter value
+	Delta *int64 `json:"delta,omitempty"`
+	// Metrics name
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Time of the last update, absent if unknown
+	UpdatedAt *string `json:"updatedAt,omitempty"`
+	// Gauge value
+	Value *float64 `json:"value,omitempty"`
+}
+
+type MetadataList struct {
+	Metadata []MetricsMeta `json:"metadata"`
+}
+
+// Metrics type is either gauge (with value) or counter (with delta). Invalid metrics are reported by the handlers, per item for batches.
+type Metrics = models.Metrics
+
+type MetricsList struct {
+	Metrics []MetricsSeries `json:"metrics"`
+	// Seconds between history points, 0 if history is disabled
+	SampleInterval int `json:"sampleInterval"`
+}
+
+type MetricsMeta struct {
+	// Other types the metrics has been reported as
+	Conflicts []string `json:"conflicts,omitempty"`
+	// Whether the expected type is declared by an agent
+	Declared *bool   `json:"declared,omitempty"`
+	Help     *string `json:"help,omitempty"`
+	Name     string  `json:"name"`
+	// Expected type, declared by agents along with unit or help, or the type of the first report
+	Type string  `json:"type"`
+	Unit *string `json:"unit,omitempty"`
+}
+
+type MetricsPage struct {
+	Metrics []ListedMetrics `json:"metrics"`
+	// Cursor of the next page, absent on the last one
+	NextCursor *string `json:"nextCursor,omitempty"`
+	// Number of matching metrics on all pages, absent for tokens limited to some metrics
+	Total *int `json:"total,omitempty"`
+}
+
+type MetricsSeries struct {
+	// Type the metrics is expected to be, if it's reported with another one as well
+	ExpectedType *string        `json:"expectedType,omitempty"`
+	Help         *string        `json:"help,omitempty"`
+	History      []HistoryPoint `json:"history"`
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Unit         *string        `json:"unit,omitempty"`
+	// Current value, counters included
+	Value float64 `json:"value"`
+}
+
+type Query struct {
+	// Expression of up to 4096 bytes
+	Query string `json:"query"`
+}
+
+type QueryResult struct {
+	// A QueryValue for scalar, an array of QuerySample for vector or an array of QuerySeries for matrix
+	Result     any    `json:"result"`
+	ResultType string `json:"resultType"`
+}
+
+type QuerySample struct {
+	Labels map[string]string `json:"labels"`
+	Value  QueryValue        `json:"value"`
+}
+
+type QuerySeries struct {
+	Labels map[string]string `json:"labels"`
+	Points []map[string]any  `json:"points"`
+}
+
+// A number, or one of "NaN", "+Inf" and "-Inf" strings for values that are not finite
+type QueryValue = any
+
+type StreamUpdate struct {
+	// Increment applied to a counter
+	Delta *int64 `json:"delta,omitempty"`
+	ID    string `json:"id"`
+	Time  string `json:"time"`
+	Type  string `json:"type"`
+	// Value after the update, counters included
+	Value float64 `json:"value"`
+}
+
+// HTTPRequestDoer performs HTTP requests, e.g. *http.Client.
+type HTTPRequestDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// RequestEditorFn changes a request before it is sent.
+type RequestEditorFn func(ctx context.Context, req *http.Request) error
+
+type Client struct {
+	// Server is the base URL, e.g. https://localhost:8080
+	Server         string
+	Client         HTTPRequestDoer
+	RequestEditors []RequestEditorFn
+}
+
+func NewClient(server string, doer HTTPRequestDoer, editors ...RequestEditorFn) *Client {
+	return &Client{
+		Server:         strings.TrimSuffix(server, "/"),
+		Client:         doer,
+		RequestEditors: editors,
+	}
+}
+
+func (c *Client) do(ctx context.Context, req *http.Request, reqEditors []RequestEditorFn) (*http.Response, []byte, error) {
+	for _, editor := range append(c.RequestEditors, reqEditors...) {
+		if err := editor(ctx, req); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rsp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rsp, body, nil
+}
+
+func isJSON(rsp *http.Response) bool {
+	return strings.Contains(rsp.Header.Get("Content-Type"), "json")
+}
+
+type GetDashboardResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+}
+
+func (r *GetDashboardResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// GetDashboard calls GET /: Web dashboard.
+func (c *Client) GetDashboard(ctx context.Context, reqEditors ...RequestEditorFn) (*GetDashboardResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GetDashboardResponse{HTTPResponse: rsp, Body: rspBody}
+
+	return response, nil
+}
+
+type ListAlertsParams struct {
+	// Only list alerts in this state
+	State *string
+}
+
+type ListAlertsResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *AlertsList
+	JSONDefault  *ErrorResponse
+}
+
+func (r *ListAlertsResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// ListAlerts calls GET /alerts: List states of alert rules.
+func (c *Client) ListAlerts(ctx context.Context, params *ListAlertsParams, reqEditors ...RequestEditorFn) (*ListAlertsResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/alerts")
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		query := queryURL.Query()
+		if params.State != nil {
+			query.Set("state", fmt.Sprint(*params.State))
+		}
+		queryURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ListAlertsResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest AlertsList
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	case isJSON(rsp) && rsp.StatusCode != 200:
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type ListMetricsParams struct {
+	// Only list metrics of this type
+	Type *string
+	// Only list metrics with names containing this substring, case insensitive
+	Q *string
+}
+
+type ListMetricsResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *MetricsList
+	JSONDefault  *ErrorResponse
+}
+
+func (r *ListMetricsResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// ListMetrics calls GET /api/metrics: List metrics with their recent history.
+func (c *Client) ListMetrics(ctx context.Context, params *ListMetricsParams, reqEditors ...RequestEditorFn) (*ListMetricsResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/api/metrics")
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		query := queryURL.Query()
+		if params.Type != nil {
+			query.Set("type", fmt.Sprint(*params.Type))
+		}
+		if params.Q != nil {
+			query.Set("q", fmt.Sprint(*params.Q))
+		}
+		queryURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ListMetricsResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest MetricsList
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	case isJSON(rsp) && rsp.StatusCode != 200:
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type ExportMetricsParams struct {
+	Format *string
+	// Also export values recorded within this duration, e.g. 10m
+	History *string
+}
+
+type ExportMetricsResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSONDefault  *ErrorResponse
+}
+
+func (r *ExportMetricsResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// ExportMetrics calls GET /export: Export all metrics.
+func (c *Client) ExportMetrics(ctx context.Context, params *ExportMetricsParams, reqEditors ...RequestEditorFn) (*ExportMetricsResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/export")
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		query := queryURL.Query()
+		if params.Format != nil {
+			query.Set("format", fmt.Sprint(*params.Format))
+		}
+		if params.History != nil {
+			query.Set("history", fmt.Sprint(*params.History))
+		}
+		queryURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ExportMetricsResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case isJSON(rsp):
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type ImportMetricsParams struct {
+	// Whether imported counters are added to stored values or replace them
+	Counters *string
+}
+
+type ImportMetricsResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *ImportResponse
+	JSONDefault  *ErrorResponse
+}
+
+func (r *ImportMetricsResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// ImportMetrics calls POST /import: Import a metrics dump.
+func (c *Client) ImportMetrics(ctx context.Context, params *ImportMetricsParams, body io.Reader, reqEditors ...RequestEditorFn) (*ImportMetricsResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/import")
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		query := queryURL.Query()
+		if params.Counters != nil {
+			query.Set("counters", fmt.Sprint(*params.Counters))
+		}
+		queryURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", queryURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ImportMetricsResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest ImportResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	case isJSON(rsp) && rsp.StatusCode != 200:
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type ListMetadataParams struct {
+	// Only list metrics reported with more than one type
+	Conflicts *bool
+}
+
+type ListMetadataResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *MetadataList
+	JSONDefault  *ErrorResponse
+}
+
+func (r *ListMetadataResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// ListMetadata calls GET /metadata: List units, descriptions and expected types of metrics.
+func (c *Client) ListMetadata(ctx context.Context, params *ListMetadataParams, reqEditors ...RequestEditorFn) (*ListMetadataResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/metadata")
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		query := queryURL.Query()
+		if params.Conflicts != nil {
+			query.Set("conflicts", fmt.Sprint(*params.Conflicts))
+		}
+		queryURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ListMetadataResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest MetadataList
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	case isJSON(rsp) && rsp.StatusCode != 200:
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type GetPrometheusMetricsResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+}
+
+func (r *GetPrometheusMetricsResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// GetPrometheusMetrics calls GET /metrics: Get metrics in the Prometheus text format.
+func (c *Client) GetPrometheusMetrics(ctx context.Context, reqEditors ...RequestEditorFn) (*GetPrometheusMetricsResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GetPrometheusMetricsResponse{HTTPResponse: rsp, Body: rspBody}
+
+	return response, nil
+}
+
+type ListMetricsPageParams struct {
+	// Only list metrics of this type
+	Type *string
+	// Only list metrics with names starting with this prefix
+	Prefix *string
+	// Only list metrics with names matching this regular expression
+	Regex *string
+	// Maximum number of metrics on the page, 100 by default
+	Limit *int
+	// nextCursor of the previous page
+	Cursor *string
+}
+
+type ListMetricsPageResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *MetricsPage
+	JSONDefault  *ErrorResponse
+}
+
+func (r *ListMetricsPageResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// ListMetricsPage calls GET /metrics/list: List a page of metrics with their values.
+func (c *Client) ListMetricsPage(ctx context.Context, params *ListMetricsPageParams, reqEditors ...RequestEditorFn) (*ListMetricsPageResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/metrics/list")
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		query := queryURL.Query()
+		if params.Type != nil {
+			query.Set("type", fmt.Sprint(*params.Type))
+		}
+		if params.Prefix != nil {
+			query.Set("prefix", fmt.Sprint(*params.Prefix))
+		}
+		if params.Regex != nil {
+			query.Set("regex", fmt.Sprint(*params.Regex))
+		}
+		if params.Limit != nil {
+			query.Set("limit", fmt.Sprint(*params.Limit))
+		}
+		if params.Cursor != nil {
+			query.Set("cursor", fmt.Sprint(*params.Cursor))
+		}
+		queryURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ListMetricsPageResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest MetricsPage
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	case isJSON(rsp) && rsp.StatusCode != 200:
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type GetOpenAPIResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *map[string]any
+}
+
+func (r *GetOpenAPIResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// GetOpenAPI calls GET /openapi.json: This document.
+func (c *Client) GetOpenAPI(ctx context.Context, reqEditors ...RequestEditorFn) (*GetOpenAPIResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/openapi.json")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GetOpenAPIResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest map[string]any
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	}
+
+	return response, nil
+}
+
+type PingResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+}
+
+func (r *PingResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// Ping calls GET /ping: Check storage availability.
+func (c *Client) Ping(ctx context.Context, reqEditors ...RequestEditorFn) (*PingResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/ping")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &PingResponse{HTTPResponse: rsp, Body: rspBody}
+
+	return response, nil
+}
+
+type QueryResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *QueryResult
+	JSONDefault  *ErrorResponse
+}
+
+func (r *QueryResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// Query calls POST /query: Evaluate an expression over metrics.
+func (c *Client) Query(ctx context.Context, body Query, reqEditors ...RequestEditorFn) (*QueryResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/query")
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", queryURL.String(), bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &QueryResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest QueryResult
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	case isJSON(rsp) && rsp.StatusCode != 200:
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type GetStatsResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *map[string]int64
+}
+
+func (r *GetStatsResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// GetStats calls GET /stats: Counters of rejected requests and metrics.
+func (c *Client) GetStats(ctx context.Context, reqEditors ...RequestEditorFn) (*GetStatsResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/stats")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GetStatsResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest map[string]int64
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	}
+
+	return response, nil
+}
+
+type StreamUpdatesParams struct {
+	// Only stream metrics of this type
+	Type *string
+	// Only stream metrics with names matching this regular expression
+	Name *string
+}
+
+type StreamUpdatesResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSONDefault  *ErrorResponse
+}
+
+func (r *StreamUpdatesResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// StreamUpdates calls GET /stream: Stream applied metrics updates.
+func (c *Client) StreamUpdates(ctx context.Context, params *StreamUpdatesParams, reqEditors ...RequestEditorFn) (*StreamUpdatesResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/stream")
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		query := queryURL.Query()
+		if params.Type != nil {
+			query.Set("type", fmt.Sprint(*params.Type))
+		}
+		if params.Name != nil {
+			query.Set("name", fmt.Sprint(*params.Name))
+		}
+		queryURL.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &StreamUpdatesResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case isJSON(rsp):
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type UpdateMetricsResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *Metrics
+	JSONDefault  *ErrorResponse
+}
+
+func (r *UpdateMetricsResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// UpdateMetrics calls POST /update: Update a single metrics.
+func (c *Client) UpdateMetrics(ctx context.Context, body Metrics, reqEditors ...RequestEditorFn) (*UpdateMetricsResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/update")
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", queryURL.String(), bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &UpdateMetricsResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest Metrics
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	case isJSON(rsp) && rsp.StatusCode != 200:
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type UpdateMetricsPlainResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+}
+
+func (r *UpdateMetricsPlainResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// UpdateMetricsPlain calls POST /update/{type}/{name}/{value}: Update a single metrics given in the path.
+func (c *Client) UpdateMetricsPlain(ctx context.Context, typeParam string, name string, value string, reqEditors ...RequestEditorFn) (*UpdateMetricsPlainResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/update/" + url.PathEscape(typeParam) + "/" + url.PathEscape(name) + "/" + url.PathEscape(value))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &UpdateMetricsPlainResponse{HTTPResponse: rsp, Body: rspBody}
+
+	return response, nil
+}
+
+type UpdateMetricsBatchParams struct {
+	// Apply valid metrics and report invalid ones instead of rejecting the batch
+	Partial *bool
+}
+
+type UpdateMetricsBatchResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *BatchResponse
+	JSONDefault  *ErrorResponse
+}
+
+func (r *UpdateMetricsBatchResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// UpdateMetricsBatch calls POST /updates: Update a batch of metrics.
+func (c *Client) UpdateMetricsBatch(ctx context.Context, params *UpdateMetricsBatchParams, body []Metrics, reqEditors ...RequestEditorFn) (*UpdateMetricsBatchResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/updates")
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		query := queryURL.Query()
+		if params.Partial != nil {
+			query.Set("partial", fmt.Sprint(*params.Partial))
+		}
+		queryURL.RawQuery = query.Encode()
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", queryURL.String(), bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &UpdateMetricsBatchResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest BatchResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	case isJSON(rsp) && rsp.StatusCode != 200:
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type GetMetricsValueResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+	JSON200      *Metrics
+	JSONDefault  *ErrorResponse
+}
+
+func (r *GetMetricsValueResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// GetMetricsValue calls POST /value: Get metrics value.
+func (c *Client) GetMetricsValue(ctx context.Context, body Metrics, reqEditors ...RequestEditorFn) (*GetMetricsValueResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/value")
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", queryURL.String(), bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GetMetricsValueResponse{HTTPResponse: rsp, Body: rspBody}
+	switch {
+	case rsp.StatusCode == 200 && isJSON(rsp):
+		var dest Metrics
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON200 = &dest
+	case isJSON(rsp) && rsp.StatusCode != 200:
+		var dest ErrorResponse
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.JSONDefault = &dest
+	}
+
+	return response, nil
+}
+
+type GetMetricsValuePlainResponse struct {
+	HTTPResponse *http.Response
+	Body         []byte
+}
+
+func (r *GetMetricsValuePlainResponse) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// GetMetricsValuePlain calls GET /value/{type}/{name}: Get metrics value as plain text.
+func (c *Client) GetMetricsValuePlain(ctx context.Context, typeParam string, name string, reqEditors ...RequestEditorFn) (*GetMetricsValuePlainResponse, error) {
+	queryURL, err := url.Parse(c.Server + "/value/" + url.PathEscape(typeParam) + "/" + url.PathEscape(name))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", queryURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GetMetricsValuePlainResponse{HTTPResponse: rsp, Body: rspBody}
+
+	return response, nil
+}
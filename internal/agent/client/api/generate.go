@@ -0,0 +1,4 @@
+// Package api is the server API client generated from the OpenAPI document in internal/openapi.
+package api
+
+//go:generate go run github.com/SamMeown/metrix/internal/openapi/clientgen -package api -o client.gen.go
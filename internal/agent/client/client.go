@@ -3,10 +3,16 @@ package client
 import (
 	"bytes"
 	"compress/gzip"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/SamMeown/metrix/internal/agent/client/api"
+	"github.com/SamMeown/metrix/internal/agent/config"
 	"github.com/SamMeown/metrix/internal/backoff"
+	"github.com/SamMeown/metrix/internal/crypto/envelope"
 	"github.com/SamMeown/metrix/internal/crypto/signer"
 	"github.com/SamMeown/metrix/internal/logger"
 	"github.com/SamMeown/metrix/internal/models"
@@ -15,6 +21,13 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"time"
+)
+
+const (
+	agentIDHeader        = "X-Agent-ID"
+	realIPHeader         = "X-Real-IP"
+	idempotencyKeyHeader = "Idempotency-Key"
 )
 
 type gauge = float64
@@ -22,31 +35,78 @@ type counter = int64
 
 type MetricsClient struct {
 	http.Client
-	baseURL       string
+	api           *api.Client
+	agentID       string
+	token         string
+	realIP        string
 	contentSigner *signer.Signer
-	jobs          chan []byte
+	signKeyID     string
+	encryptor     *envelope.Encryptor
+	describe      func(name string) (unit, help string)
+	jobs          chan []models.Metrics
 }
 
-func NewMetricsClient(baseURL string, numWorkers int, contentSigner *signer.Signer) *MetricsClient {
+// NewMetricsClient creates a client reporting metrics batches to the server at conf.ServerBaseAddress.
+// If tlsConfig is not nil, the server is reached over HTTPS. If encryptor is not nil, request bodies are encrypted.
+// If describe is not nil, metrics are reported with the unit and help it returns.
+func NewMetricsClient(
+	conf config.Config,
+	contentSigner *signer.Signer,
+	tlsConfig *tls.Config,
+	encryptor *envelope.Encryptor,
+	describe func(name string) (unit, help string),
+) *MetricsClient {
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		scheme = "https"
+		transport.TLSClientConfig = tlsConfig
+	}
+
 	client := &MetricsClient{
-		baseURL:       fmt.Sprintf("http://%s/updates", baseURL),
+		Client:        http.Client{Transport: transport},
+		agentID:       conf.AgentID,
+		token:         conf.Token,
 		contentSigner: contentSigner,
-		jobs:          make(chan []byte, 256),
+		signKeyID:     conf.SignKeyID,
+		encryptor:     encryptor,
+		describe:      describe,
+		jobs:          make(chan []models.Metrics, 256),
+	}
+	client.api = api.NewClient(fmt.Sprintf("%s://%s", scheme, conf.ServerBaseAddress), &client.Client, client.prepareRequest)
+
+	if ip, err := outboundIP(conf.ServerBaseAddress); err != nil {
+		logger.Log.Errorf("Failed to get outbound address: %s", err)
+	} else {
+		client.realIP = ip.String()
 	}
 
-	client.startWorkers(numWorkers)
+	client.startWorkers(conf.RateLimit)
 
 	return client
 }
 
+// outboundIP returns the local address used to reach the server. Nothing is sent, as UDP dial doesn't need handshake.
+func outboundIP(address string) (net.IP, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
 func NewMetricsCustomClient(baseURL string, client http.Client) *MetricsClient {
-	return &MetricsClient{
-		Client:  client,
-		baseURL: fmt.Sprintf("http://%s/update", baseURL),
+	mClient := &MetricsClient{
+		Client: client,
 	}
+	mClient.api = api.NewClient(fmt.Sprintf("http://%s", baseURL), &mClient.Client)
+
+	return mClient
 }
 
-func NewRequest(method, url string, body io.Reader) (*http.Request, error) {
+func compress(body io.Reader) ([]byte, error) {
 	buf := bytes.Buffer{}
 	gz, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
 	if err != nil {
@@ -59,14 +119,7 @@ func NewRequest(method, url string, body io.Reader) (*http.Request, error) {
 	}
 	gz.Close()
 
-	req, err := http.NewRequest(method, url, &buf)
-	if err != nil {
-		return req, err
-	}
-
-	req.Header.Set("Content-Encoding", "gzip")
-
-	return req, nil
+	return buf.Bytes(), nil
 }
 
 func (client *MetricsClient) worker() {
@@ -81,8 +134,8 @@ func (client *MetricsClient) worker() {
 	}
 }
 
-func (client *MetricsClient) dispatchRequest(requestBody []byte) {
-	client.jobs <- requestBody
+func (client *MetricsClient) dispatchRequest(metrics []models.Metrics) {
+	client.jobs <- metrics
 }
 
 func (client *MetricsClient) startWorkers(num int) {
@@ -109,16 +162,15 @@ func (client *MetricsClient) ReportAllMetrics(metricsItems storage.MetricsStorag
 		}
 		metrics = append(metrics, reqMetrics)
 	}
+	if client.describe != nil {
+		for i := range metrics {
+			metrics[i].Unit, metrics[i].Help = client.describe(metrics[i].ID)
+		}
+	}
 
 	logger.Log.Debugf("Reporting metrics: %+v", metrics)
 
-	body, err := json.Marshal(metrics)
-	if err != nil {
-		logger.Log.Errorln(err)
-		return
-	}
-
-	client.dispatchRequest(body)
+	client.dispatchRequest(metrics)
 }
 
 func metricsToRequestMetrics(name string, value any) (models.Metrics, error) {
@@ -138,44 +190,111 @@ func metricsToRequestMetrics(name string, value any) (models.Metrics, error) {
 	return metrics, nil
 }
 
-func (client *MetricsClient) sendRequestWithRetry(requestBody []byte) (code int, body []byte, err error) {
+// retry calls send with backoff while it fails with network errors
+func retry(send func() error) error {
 	bOff := backoff.NewBackoff([]int{1, 3, 5}, nil)
-	err = bOff.Retry(func() (e error) {
-		code, body, e = client.sendRequest(requestBody)
+	return bOff.Retry(func() error {
+		err := send()
+		var netErr *net.OpError
+		if errors.As(err, &netErr) {
+			return backoff.NewRetryableError(err)
+		}
+		return err
+	})
+}
+
+// sendRequestWithRetry sends the batch with the same idempotency key on every attempt,
+// so that the server doesn't apply it twice if only the response was lost.
+func (client *MetricsClient) sendRequestWithRetry(metrics []models.Metrics) (code int, body []byte, err error) {
+	idempotencyKey, err := newNonce()
+	if err != nil {
 		return
+	}
+	withIdempotencyKey := func(ctx context.Context, req *http.Request) error {
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		return nil
+	}
+
+	err = retry(func() error {
+		response, err := client.api.UpdateMetricsBatch(context.Background(), nil, metrics, withIdempotencyKey)
+		if err != nil {
+			return err
+		}
+
+		code, body = response.StatusCode(), response.Body
+		return nil
 	})
 
 	return
 }
 
-func (client *MetricsClient) sendRequest(requestBody []byte) (code int, body []byte, err error) {
-	req, err := NewRequest(http.MethodPost, client.baseURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		panic(err)
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	return hex.EncodeToString(nonce), nil
+}
 
-	if client.contentSigner != nil {
-		signature := client.contentSigner.GetSignature(requestBody)
-		req.Header.Set("HashSHA256", signature)
+// prepareRequest compresses, encrypts and signs the JSON body of the request and sets agent headers.
+func (client *MetricsClient) prepareRequest(ctx context.Context, req *http.Request) error {
+	var requestBody []byte
+	if req.Body != nil {
+		var err error
+		requestBody, err = io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Body.Close()
 	}
 
-	response, err := client.Do(req)
+	payload, err := compress(bytes.NewReader(requestBody))
 	if err != nil {
-		var netErr *net.OpError
-		if errors.As(err, &netErr) {
-			err = backoff.NewRetryableError(err)
+		return err
+	}
+
+	if client.encryptor != nil {
+		payload, err = client.encryptor.Encrypt(payload)
+		if err != nil {
+			return err
 		}
-		return
+		req.Header.Set(envelope.Header, client.encryptor.Scheme())
 	}
 
-	code = response.StatusCode
+	req.Body = io.NopCloser(bytes.NewReader(payload))
+	req.ContentLength = int64(len(payload))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}
 
-	defer response.Body.Close()
-	body, err = io.ReadAll(response.Body)
+	req.Header.Set("Content-Encoding", "gzip")
+	if client.agentID != "" {
+		req.Header.Set(agentIDHeader, client.agentID)
+	}
+	if client.realIP != "" {
+		req.Header.Set(realIPHeader, client.realIP)
+	}
+	if client.token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.token)
+	}
 
-	return
+	if client.contentSigner != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce, err := newNonce()
+		if err != nil {
+			return err
+		}
+		signature := client.contentSigner.GetRequestSignature(req.Method, req.URL.EscapedPath(), timestamp, nonce, requestBody)
+		req.Header.Set(signer.HeaderSignature, signature)
+		req.Header.Set(signer.HeaderTimestamp, timestamp)
+		req.Header.Set(signer.HeaderNonce, nonce)
+		if client.signKeyID != "" {
+			req.Header.Set(signer.HeaderKeyID, client.signKeyID)
+		}
+	}
+
+	return nil
 }
 
 func (client *MetricsClient) ReportMetrics(name string, value any) error {
@@ -186,19 +305,15 @@ func (client *MetricsClient) ReportMetrics(name string, value any) error {
 
 	logger.Log.Debugf("Reporting metrics: %+v", metrics)
 
-	body, err := json.Marshal(metrics)
-	if err != nil {
-		return err
-	}
-
-	respCode, respBody, err := client.sendRequestWithRetry(body)
-	if err != nil {
-		return err
-	}
-
-	logger.Log.Debugf("Status code: %d\nReport response: %s\n", respCode, respBody)
+	return retry(func() error {
+		response, err := client.api.UpdateMetrics(context.Background(), metrics)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		logger.Log.Debugf("Status code: %d\nReport response: %s\n", response.StatusCode(), response.Body)
+		return nil
+	})
 }
 
 func (client *MetricsClient) ReportAllMetricsV1(metricsItems storage.MetricsStorageItems) {
@@ -230,25 +345,17 @@ func (client *MetricsClient) ReportMetricsV1(name string, value any) error {
 		panic("Wrong metrics value type")
 	}
 
-	url := fmt.Sprintf("%s/%s/%s/%s", client.baseURL, metricsType, name, valueString)
-
-	req, err := http.NewRequest(http.MethodPost, url, nil)
-	if err != nil {
-		panic(err)
+	withPlainText := func(ctx context.Context, req *http.Request) error {
+		req.Header.Set("Content-Type", "text/plain")
+		return nil
 	}
-	req.Header.Set("Content-Type", "text/plain")
 
-	response, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	logger.Log.Infof("Status code: %d\n", response.StatusCode)
-	defer response.Body.Close()
-	respBody, err := io.ReadAll(response.Body)
+	response, err := client.api.UpdateMetricsPlain(context.Background(), metricsType, name, valueString, withPlainText)
 	if err != nil {
 		return err
 	}
-	logger.Log.Debugln(string(respBody))
+	logger.Log.Infof("Status code: %d\n", response.StatusCode())
+	logger.Log.Debugln(string(response.Body))
 
 	return nil
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"flag"
+	"os"
 
 	"github.com/SamMeown/metrix/internal/utils/config_utils"
 )
@@ -11,7 +12,15 @@ type Config struct {
 	PollInterval      int
 	ReportInterval    int
 	SignKey           string
+	SignKeyID         string
+	CryptoKey         string
+	Token             string
 	RateLimit         int
+	AgentID           string
+	UseTLS            bool
+	TLSCAFile         string
+	TLSCertFile       string
+	TLSKeyFile        string
 }
 
 func Parse() Config {
@@ -21,7 +30,17 @@ func Parse() Config {
 	flag.IntVar(&config.PollInterval, "p", 2, "metrics poll interval")
 	flag.IntVar(&config.ReportInterval, "r", 10, "metrics report interval")
 	flag.StringVar(&config.SignKey, "k", "", "signature key")
+	flag.StringVar(&config.SignKeyID, "key-id", "", "signature key id known to the server")
+	flag.StringVar(&config.Token, "token", "", "API token to authenticate at the server with")
+	flag.StringVar(&config.CryptoKey, "crypto-key", "", "server public key file to encrypt requests with")
 	flag.IntVar(&config.RateLimit, "l", 4, "agent requests rate limit")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&config.AgentID, "id", hostname, "agent id reported to the server")
+
+	flag.BoolVar(&config.UseTLS, "tls", false, "connect to the server over HTTPS, implied by other tls options")
+	flag.StringVar(&config.TLSCAFile, "tls-ca", "", "CA file to verify server certificate with")
+	flag.StringVar(&config.TLSCertFile, "tls-cert", "", "agent TLS certificate file for mutual TLS")
+	flag.StringVar(&config.TLSKeyFile, "tls-key", "", "agent TLS private key file for mutual TLS")
 
 	flag.Parse()
 
@@ -41,9 +60,45 @@ func Parse() Config {
 		config.SignKey = signKey
 	}
 
+	if signKeyID, ok := configutils.LookupEnvString("KEY_ID"); ok {
+		config.SignKeyID = signKeyID
+	}
+
+	if token, ok := configutils.LookupEnvString("TOKEN"); ok {
+		config.Token = token
+	}
+
+	if cryptoKey, ok := configutils.LookupEnvString("CRYPTO_KEY"); ok {
+		config.CryptoKey = cryptoKey
+	}
+
 	if rateLimit, ok := configutils.LookupEnvInt("RATE_LIMIT"); ok {
 		config.RateLimit = rateLimit
 	}
 
+	if agentID, ok := configutils.LookupEnvString("AGENT_ID"); ok {
+		config.AgentID = agentID
+	}
+
+	if useTLS, ok := configutils.LookupEnvBool("TLS"); ok {
+		config.UseTLS = useTLS
+	}
+
+	if caFile, ok := configutils.LookupEnvString("TLS_CA_FILE"); ok {
+		config.TLSCAFile = caFile
+	}
+
+	if certFile, ok := configutils.LookupEnvString("TLS_CERT_FILE"); ok {
+		config.TLSCertFile = certFile
+	}
+
+	if keyFile, ok := configutils.LookupEnvString("TLS_KEY_FILE"); ok {
+		config.TLSKeyFile = keyFile
+	}
+
+	if config.TLSCAFile != "" || config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		config.UseTLS = true
+	}
+
 	return config
 }
@@ -46,6 +46,52 @@ var memStatsMetricsNames = []string{
 	"TotalAlloc",
 }
 
+type description struct {
+	unit string
+	help string
+}
+
+var descriptions = map[string]description{
+	"Alloc":           {"bytes", "Bytes of allocated heap objects"},
+	"BuckHashSys":     {"bytes", "Bytes of memory in profiling bucket hash tables"},
+	"Frees":           {"", "Cumulative count of heap objects freed"},
+	"GCCPUFraction":   {"ratio", "Fraction of available CPU time used by the GC since the program started"},
+	"GCSys":           {"bytes", "Bytes of memory in garbage collection metadata"},
+	"HeapAlloc":       {"bytes", "Bytes of allocated heap objects"},
+	"HeapIdle":        {"bytes", "Bytes in idle heap spans"},
+	"HeapInuse":       {"bytes", "Bytes in in-use heap spans"},
+	"HeapObjects":     {"", "Number of allocated heap objects"},
+	"HeapReleased":    {"bytes", "Bytes of physical memory returned to the OS"},
+	"HeapSys":         {"bytes", "Bytes of heap memory obtained from the OS"},
+	"LastGC":          {"nanoseconds", "Time the last garbage collection finished, since 1970"},
+	"Lookups":         {"", "Number of pointer lookups performed by the runtime"},
+	"MCacheInuse":     {"bytes", "Bytes of allocated mcache structures"},
+	"MCacheSys":       {"bytes", "Bytes of memory obtained from the OS for mcache structures"},
+	"MSpanInuse":      {"bytes", "Bytes of allocated mspan structures"},
+	"MSpanSys":        {"bytes", "Bytes of memory obtained from the OS for mspan structures"},
+	"Mallocs":         {"", "Cumulative count of heap objects allocated"},
+	"NextGC":          {"bytes", "Target heap size of the next GC cycle"},
+	"NumForcedGC":     {"", "Number of GC cycles forced by the application"},
+	"NumGC":           {"", "Number of completed GC cycles"},
+	"OtherSys":        {"bytes", "Bytes of memory in miscellaneous off-heap runtime allocations"},
+	"PauseTotalNs":    {"nanoseconds", "Cumulative time spent in GC stop-the-world pauses"},
+	"StackInuse":      {"bytes", "Bytes in stack spans"},
+	"StackSys":        {"bytes", "Bytes of stack memory obtained from the OS"},
+	"Sys":             {"bytes", "Total bytes of memory obtained from the OS"},
+	"TotalAlloc":      {"bytes", "Cumulative bytes allocated for heap objects"},
+	"RandomValue":     {"", "Random value"},
+	"PollCount":       {"", "Number of metrics polls"},
+	"TotalMemory":     {"bytes", "Total amount of RAM on the host"},
+	"FreeMemory":      {"bytes", "RAM available for programs on the host"},
+	"CPUutilization1": {"percent", "CPU utilization of the host"},
+}
+
+// Describe returns the unit and help text of a collected metrics, empty for unknown ones.
+func Describe(name string) (unit, help string) {
+	d := descriptions[name]
+	return d.unit, d.help
+}
+
 type Collector interface {
 	CollectMetrics()
 	GetMetrics() storage.MetricsStorageItems
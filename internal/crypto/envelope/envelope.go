@@ -0,0 +1,276 @@
+// Package envelope implements hybrid encryption of request bodies.
+//
+// Each payload is encrypted with a fresh AES-256-GCM key. The key is either wrapped
+// with the recipient's RSA public key (RSA-OAEP, SHA-256), or derived with HKDF-SHA256
+// from an ECDH agreement between an ephemeral key and the recipient's EC/X25519 key.
+//
+// Sealed payload layout: key material length (2 bytes, big endian) | key material | nonce | ciphertext,
+// where key material is the wrapped AES key for RSA and the ephemeral public key for ECDH.
+package envelope
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	SchemeRSA  = "RSA-OAEP-AES256-GCM"
+	SchemeECDH = "ECDH-HKDF-AES256-GCM"
+
+	// Header carries the scheme of an encrypted request body
+	Header = "X-Content-Encryption"
+)
+
+const keySize = 32
+
+var hkdfInfo = []byte("metrix envelope")
+
+var ErrMalformed = errors.New("malformed encrypted payload")
+
+type Encryptor struct {
+	rsaKey  *rsa.PublicKey
+	ecdhKey *ecdh.PublicKey
+}
+
+type Decryptor struct {
+	rsaKey  *rsa.PrivateKey
+	ecdhKey *ecdh.PrivateKey
+}
+
+// LoadEncryptor reads a PEM encoded RSA, EC or X25519 public key.
+func LoadEncryptor(path string) (*Encryptor, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key crypto.PublicKey
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEncryptor(key)
+}
+
+func NewEncryptor(key crypto.PublicKey) (*Encryptor, error) {
+	switch typedKey := key.(type) {
+	case *rsa.PublicKey:
+		return &Encryptor{rsaKey: typedKey}, nil
+	case *ecdsa.PublicKey:
+		ecdhKey, err := typedKey.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return &Encryptor{ecdhKey: ecdhKey}, nil
+	case *ecdh.PublicKey:
+		return &Encryptor{ecdhKey: typedKey}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// LoadDecryptor reads a PEM encoded RSA, EC or X25519 private key.
+func LoadDecryptor(path string) (*Decryptor, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key crypto.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDecryptor(key)
+}
+
+func NewDecryptor(key crypto.PrivateKey) (*Decryptor, error) {
+	switch typedKey := key.(type) {
+	case *rsa.PrivateKey:
+		return &Decryptor{rsaKey: typedKey}, nil
+	case *ecdsa.PrivateKey:
+		ecdhKey, err := typedKey.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return &Decryptor{ecdhKey: ecdhKey}, nil
+	case *ecdh.PrivateKey:
+		return &Decryptor{ecdhKey: typedKey}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	return block, nil
+}
+
+func (e *Encryptor) Scheme() string {
+	if e.rsaKey != nil {
+		return SchemeRSA
+	}
+
+	return SchemeECDH
+}
+
+func (e *Encryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	var key, keyMaterial []byte
+	if e.rsaKey != nil {
+		key = make([]byte, keySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, e.rsaKey, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		keyMaterial = wrapped
+	} else {
+		ephemeral, err := e.ecdhKey.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		shared, err := ephemeral.ECDH(e.ecdhKey)
+		if err != nil {
+			return nil, err
+		}
+
+		keyMaterial = ephemeral.PublicKey().Bytes()
+		key, err = deriveKey(shared, keyMaterial)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 2, 2+len(keyMaterial)+len(nonce)+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint16(sealed, uint16(len(keyMaterial)))
+	sealed = append(sealed, keyMaterial...)
+	sealed = append(sealed, nonce...)
+
+	return aead.Seal(sealed, nonce, plaintext, nil), nil
+}
+
+func (d *Decryptor) Scheme() string {
+	if d.rsaKey != nil {
+		return SchemeRSA
+	}
+
+	return SchemeECDH
+}
+
+func (d *Decryptor) Decrypt(sealed []byte) ([]byte, error) {
+	if len(sealed) < 2 {
+		return nil, ErrMalformed
+	}
+	keyMaterialLen := int(binary.BigEndian.Uint16(sealed))
+	sealed = sealed[2:]
+	if len(sealed) < keyMaterialLen {
+		return nil, ErrMalformed
+	}
+	keyMaterial, sealed := sealed[:keyMaterialLen], sealed[keyMaterialLen:]
+
+	var key []byte
+	var err error
+	if d.rsaKey != nil {
+		key, err = rsa.DecryptOAEP(sha256.New(), nil, d.rsaKey, keyMaterial, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ephemeral, err := d.ecdhKey.Curve().NewPublicKey(keyMaterial)
+		if err != nil {
+			return nil, err
+		}
+
+		shared, err := d.ecdhKey.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = deriveKey(shared, keyMaterial)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func deriveKey(shared, salt []byte) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, hkdfInfo), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,99 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeys(t *testing.T, private crypto.PrivateKey, public crypto.PublicKey) (privatePath, publicPath string) {
+	privateDer, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	publicDer, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	privatePath = filepath.Join(dir, "private.pem")
+	publicPath = filepath.Join(dir, "public.pem")
+	require.NoError(t, os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer}), 0600))
+	require.NoError(t, os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}), 0600))
+
+	return
+}
+
+func TestRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		private    crypto.PrivateKey
+		public     crypto.PublicKey
+		wantScheme string
+	}{
+		{"test rsa", rsaKey, &rsaKey.PublicKey, SchemeRSA},
+		{"test ecdsa p256", ecKey, &ecKey.PublicKey, SchemeECDH},
+		{"test x25519", x25519Key, x25519Key.PublicKey(), SchemeECDH},
+	}
+
+	plaintext := []byte(`[{"id":"a","type":"gauge","value":1}]`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			privatePath, publicPath := writeKeys(t, tt.private, tt.public)
+
+			encryptor, err := LoadEncryptor(publicPath)
+			require.NoError(t, err)
+			decryptor, err := LoadDecryptor(privatePath)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantScheme, encryptor.Scheme())
+			assert.Equal(t, tt.wantScheme, decryptor.Scheme())
+
+			sealed, err := encryptor.Encrypt(plaintext)
+			require.NoError(t, err)
+			assert.NotContains(t, string(sealed), `"gauge"`)
+
+			opened, err := decryptor.Decrypt(sealed)
+			require.NoError(t, err)
+			assert.Equal(t, plaintext, opened)
+
+			sealed[len(sealed)-1] ^= 0xff
+			_, err = decryptor.Decrypt(sealed)
+			assert.Error(t, err)
+
+			_, err = decryptor.Decrypt(sealed[:1])
+			assert.ErrorIs(t, err, ErrMalformed)
+		})
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	encryptor, err := NewEncryptor(key.PublicKey())
+	require.NoError(t, err)
+	decryptor, err := NewDecryptor(otherKey)
+	require.NoError(t, err)
+
+	sealed, err := encryptor.Encrypt([]byte("secret"))
+	require.NoError(t, err)
+	_, err = decryptor.Decrypt(sealed)
+	assert.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/logger"
+)
+
+const HeaderKeyID = "X-Sign-Key-ID"
+
+// Keyring holds signing keys by id. Requests may be signed with any of them,
+// responses are signed with the primary one.
+type Keyring struct {
+	m       sync.RWMutex
+	primary string
+	signers map[string]*Signer
+}
+
+// keyringFile is the format of the keys file, e.g.
+//
+//	{"primary": "2023-09", "keys": {"2023-08": "old secret", "2023-09": "new secret"}}
+type keyringFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+func NewKeyring(primaryID string, keys map[string]string) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.set(primaryID, keys); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.Reload(path); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Reload replaces keys with the ones from the keys file. On error the current keys are kept.
+func (k *Keyring) Reload(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	return k.set(file.Primary, file.Keys)
+}
+
+func (k *Keyring) set(primaryID string, keys map[string]string) error {
+	if _, ok := keys[primaryID]; !ok {
+		return fmt.Errorf("primary key %q is not found", primaryID)
+	}
+
+	signers := make(map[string]*Signer, len(keys))
+	for id, key := range keys {
+		s := New(key)
+		if s == nil {
+			return fmt.Errorf("key %q is empty", id)
+		}
+		signers[id] = s
+	}
+
+	k.m.Lock()
+	defer k.m.Unlock()
+	k.primary = primaryID
+	k.signers = signers
+
+	return nil
+}
+
+// Signer returns signer for the key id, the primary one for an empty id, or nil if the key is unknown.
+func (k *Keyring) Signer(id string) *Signer {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	if id == "" {
+		id = k.primary
+	}
+
+	return k.signers[id]
+}
+
+func (k *Keyring) Primary() (string, *Signer) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	return k.primary, k.signers[k.primary]
+}
+
+// Watch reloads keys whenever the keys file modification time changes, until ctx is done.
+func (k *Keyring) Watch(ctx context.Context, path string, interval time.Duration) {
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			//continue
+		case <-ctx.Done():
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			logger.Log.Errorf("Failed to stat keys file: %s", err)
+			continue
+		}
+		if info.ModTime().Equal(lastModified) {
+			continue
+		}
+
+		if err := k.Reload(path); err != nil {
+			logger.Log.Errorf("Failed to reload keys: %s", err)
+			continue
+		}
+		lastModified = info.ModTime()
+		logger.Log.Infof("Signing keys are reloaded")
+	}
+}
@@ -0,0 +1,41 @@
+package signer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"k1","keys":{"k1":"one"}}`), 0600))
+
+	keyring, err := LoadKeyring(path)
+	require.NoError(t, err)
+
+	id, primary := keyring.Primary()
+	assert.Equal(t, "k1", id)
+	assert.Equal(t, New("one").GetSignature([]byte("a")), primary.GetSignature([]byte("a")))
+	assert.Same(t, primary, keyring.Signer(""))
+	assert.Nil(t, keyring.Signer("k2"))
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"k2","keys":{"k1":"one","k2":"two"}}`), 0600))
+	require.NoError(t, keyring.Reload(path))
+
+	id, primary = keyring.Primary()
+	assert.Equal(t, "k2", id)
+	assert.Equal(t, New("two").GetSignature([]byte("a")), primary.GetSignature([]byte("a")))
+	assert.NotNil(t, keyring.Signer("k1"))
+
+	// Broken files don't affect current keys
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"k3","keys":{"k1":"one"}}`), 0600))
+	assert.Error(t, keyring.Reload(path))
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"k1","keys":{"k1":""}}`), 0600))
+	assert.Error(t, keyring.Reload(path))
+
+	id, _ = keyring.Primary()
+	assert.Equal(t, "k2", id)
+}
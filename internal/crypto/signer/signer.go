@@ -6,6 +6,12 @@ import (
 	"encoding/hex"
 )
 
+const (
+	HeaderSignature = "HashSHA256"
+	HeaderTimestamp = "X-Sign-Timestamp"
+	HeaderNonce     = "X-Sign-Nonce"
+)
+
 type Signer struct {
 	key []byte
 }
@@ -36,3 +42,22 @@ func (s *Signer) ValidateSignature(sign string, content []byte) bool {
 	contentSignature := s.GetSignature(content)
 	return s.EqualSignatures(contentSignature, sign)
 }
+
+// GetRequestSignature signs the canonical request: method, path, timestamp, nonce and body,
+// so that a captured request can't be replayed to another endpoint or with a fresh timestamp or nonce.
+func (s *Signer) GetRequestSignature(method, path, timestamp, nonce string, content []byte) string {
+	h := hmac.New(sha256.New, s.key)
+	for _, part := range []string{method, path, timestamp, nonce} {
+		h.Write([]byte(part))
+		h.Write([]byte{'\n'})
+	}
+	h.Write(content)
+	signature := h.Sum(nil)
+
+	return hex.EncodeToString(signature)
+}
+
+func (s *Signer) ValidateRequestSignature(sign, method, path, timestamp, nonce string, content []byte) bool {
+	contentSignature := s.GetRequestSignature(method, path, timestamp, nonce, content)
+	return s.EqualSignatures(contentSignature, sign)
+}
@@ -0,0 +1,163 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+func newTestCert(t *testing.T, name string, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return tc
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, name, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestLeaf(t *testing.T, name string, ca *testCert, usage x509.ExtKeyUsage) *testCert {
+	return newTestCert(t, name, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}, ca)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	otherCA := newTestCA(t, "other-ca")
+	serverCert := newTestLeaf(t, "server", ca, x509.ExtKeyUsageServerAuth)
+	agentCert := newTestLeaf(t, "agent", ca, x509.ExtKeyUsageClientAuth)
+	strangerCert := newTestLeaf(t, "stranger", otherCA, x509.ExtKeyUsageClientAuth)
+
+	serverConf, err := Server(ca.certFile)
+	require.NoError(t, err)
+	keyPair, err := tls.LoadX509KeyPair(serverCert.certFile, serverCert.keyFile)
+	require.NoError(t, err)
+	serverConf.Certificates = []tls.Certificate{keyPair}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = serverConf
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		caFile   string
+		certFile string
+		keyFile  string
+		wantErr  bool
+	}{
+		{
+			name:     "test trusted agent certificate",
+			caFile:   ca.certFile,
+			certFile: agentCert.certFile,
+			keyFile:  agentCert.keyFile,
+		},
+		{
+			name:    "test no agent certificate",
+			caFile:  ca.certFile,
+			wantErr: true,
+		},
+		{
+			name:     "test agent certificate signed by unknown CA",
+			caFile:   ca.certFile,
+			certFile: strangerCert.certFile,
+			keyFile:  strangerCert.keyFile,
+			wantErr:  true,
+		},
+		{
+			name:     "test untrusted server certificate",
+			caFile:   otherCA.certFile,
+			certFile: agentCert.certFile,
+			keyFile:  agentCert.keyFile,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConf, err := Client(tt.caFile, tt.certFile, tt.keyFile)
+			require.NoError(t, err)
+
+			client := http.Client{Transport: &http.Transport{TLSClientConfig: clientConf}}
+			resp, err := client.Get(server.URL)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := Server(filepath.Join(t.TempDir(), "missing.crt"))
+	assert.Error(t, err)
+
+	notPEM := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0600))
+	_, err = Client(notPEM, "", "")
+	assert.Error(t, err)
+}
@@ -1,8 +1,11 @@
 package models
 
+// Metrics is a metrics update or value. Agents may describe the metrics with optional Unit and Help.
 type Metrics struct {
 	ID    string   `json:"id"`
 	MType string   `json:"type"`
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
+	Unit  string   `json:"unit,omitempty"`
+	Help  string   `json:"help,omitempty"`
 }
@@ -0,0 +1,553 @@
+// Command clientgen generates a typed Go HTTP client from the server OpenAPI document.
+//
+//	go run github.com/SamMeown/metrix/internal/openapi/clientgen -package api -o client.gen.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/SamMeown/metrix/internal/openapi"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+type field struct {
+	Name     string
+	Type     string
+	JSONName string
+	Optional bool
+	Doc      string
+}
+
+type typeDef struct {
+	Name   string
+	Doc    string
+	Alias  string
+	Fields []field
+}
+
+type pathParam struct {
+	Name   string
+	GoName string
+}
+
+type queryParam struct {
+	Name   string
+	GoName string
+	Type   string
+	Doc    string
+}
+
+type response struct {
+	Code  string
+	Field string
+	Type  string
+}
+
+type operation struct {
+	Name        string
+	Method      string
+	Path        string
+	Summary     string
+	PathParams  []pathParam
+	QueryParams []queryParam
+	BodyType    string
+	// RawBodyType is the content type of a body passed as is
+	RawBodyType string
+	Responses   []response
+	Default     *response
+}
+
+type generator struct {
+	doc     *openapi.Document
+	imports map[string]struct{}
+}
+
+func exported(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if r == '_' || r == '-' || r == '.' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+
+	s := b.String()
+	for _, initialism := range []string{"Id", "Url", "Http", "Json", "Api"} {
+		if strings.HasSuffix(s, initialism) {
+			s = strings.TrimSuffix(s, initialism) + strings.ToUpper(initialism)
+		}
+	}
+
+	return s
+}
+
+func unexported(name string) string {
+	s := exported(name)
+	s = strings.ToLower(s[:1]) + s[1:]
+	if token.IsKeyword(s) {
+		s += "Param"
+	}
+
+	return s
+}
+
+func (g *generator) goType(schema *openapi.Schema, optional bool) (string, error) {
+	if schema == nil {
+		return "any", nil
+	}
+
+	if name, ok := openapi.SchemaRef(schema); ok {
+		resolved, err := g.doc.ResolveSchema(schema)
+		if err != nil {
+			return "", err
+		}
+		if optional && resolved.Type == "object" {
+			return "*" + exported(name), nil
+		}
+		return exported(name), nil
+	}
+
+	var t string
+	switch schema.Type {
+	case "string":
+		t = "string"
+	case "integer":
+		t = "int"
+		if schema.Format == "int64" {
+			t = "int64"
+		}
+	case "number":
+		t = "float64"
+	case "boolean":
+		t = "bool"
+	case "array":
+		item, err := g.goType(schema.Items, false)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + item, nil
+	case "object":
+		if schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil {
+			value, err := g.goType(schema.AdditionalProperties.Schema, false)
+			if err != nil {
+				return "", err
+			}
+			return "map[string]" + value, nil
+		}
+		return "map[string]any", nil
+	default:
+		return "any", nil
+	}
+
+	if optional {
+		return "*" + t, nil
+	}
+	return t, nil
+}
+
+func (g *generator) typeDefs() ([]typeDef, error) {
+	names := maps.Keys(g.doc.Components.Schemas)
+	slices.Sort(names)
+
+	var defs []typeDef
+	for _, name := range names {
+		schema := g.doc.Components.Schemas[name]
+		def := typeDef{Name: exported(name), Doc: schema.Description}
+
+		if schema.GoType != "" {
+			if schema.GoTypeImport != "" {
+				g.imports[schema.GoTypeImport] = struct{}{}
+			}
+			def.Alias = schema.GoType
+			defs = append(defs, def)
+			continue
+		}
+
+		if schema.Type != "object" || len(schema.Properties) == 0 {
+			t, err := g.goType(schema, false)
+			if err != nil {
+				return nil, err
+			}
+			def.Alias = t
+			defs = append(defs, def)
+			continue
+		}
+
+		properties := maps.Keys(schema.Properties)
+		slices.Sort(properties)
+		for _, property := range properties {
+			propertySchema := schema.Properties[property]
+			optional := !slices.Contains(schema.Required, property)
+			t, err := g.goType(propertySchema, optional)
+			if err != nil {
+				return nil, err
+			}
+			def.Fields = append(def.Fields, field{
+				Name:     exported(property),
+				Type:     t,
+				JSONName: property,
+				Optional: optional,
+				Doc:      propertySchema.Description,
+			})
+		}
+		defs = append(defs, def)
+	}
+
+	return defs, nil
+}
+
+func (g *generator) operations() ([]operation, error) {
+	paths := maps.Keys(g.doc.Paths)
+	slices.Sort(paths)
+
+	var ops []operation
+	for _, path := range paths {
+		methods := maps.Keys(g.doc.Paths[path])
+		slices.Sort(methods)
+		for _, method := range methods {
+			spec := g.doc.Paths[path][method]
+			op := operation{
+				Name:    exported(spec.OperationID),
+				Method:  strings.ToUpper(method),
+				Path:    path,
+				Summary: spec.Summary,
+			}
+
+			for _, param := range spec.Parameters {
+				param, err := g.doc.ResolveParameter(param)
+				if err != nil {
+					return nil, err
+				}
+				switch param.In {
+				case "path":
+					op.PathParams = append(op.PathParams, pathParam{Name: param.Name, GoName: unexported(param.Name)})
+				case "query":
+					t, err := g.goType(param.Schema, true)
+					if err != nil {
+						return nil, err
+					}
+					op.QueryParams = append(op.QueryParams, queryParam{
+						Name:   param.Name,
+						GoName: exported(param.Name),
+						Type:   t,
+						Doc:    param.Description,
+					})
+				default:
+					return nil, fmt.Errorf("%s %s: unsupported parameter location %q", method, path, param.In)
+				}
+			}
+
+			if spec.RequestBody != nil {
+				if schema := openapi.JSONSchema(spec.RequestBody.Content); schema != nil {
+					t, err := g.goType(schema, false)
+					if err != nil {
+						return nil, err
+					}
+					op.BodyType = t
+				} else if len(spec.RequestBody.Content) == 1 {
+					op.RawBodyType = maps.Keys(spec.RequestBody.Content)[0]
+				}
+			}
+
+			codes := maps.Keys(spec.Responses)
+			sort.Strings(codes)
+			for _, code := range codes {
+				resp, err := g.doc.ResolveResponse(spec.Responses[code])
+				if err != nil {
+					return nil, err
+				}
+				schema := openapi.JSONSchema(resp.Content)
+				if schema == nil {
+					continue
+				}
+				t, err := g.goType(schema, false)
+				if err != nil {
+					return nil, err
+				}
+				r := response{Code: code, Field: "JSON" + exported(code), Type: t}
+				if code == "default" {
+					op.Default = &r
+				} else {
+					op.Responses = append(op.Responses, r)
+				}
+			}
+
+			ops = append(ops, op)
+		}
+	}
+
+	return ops, nil
+}
+
+var funcs = template.FuncMap{
+	"comment": func(s string) string {
+		return strings.ReplaceAll(strings.TrimSpace(s), "\n", "\n// ")
+	},
+	"pathExpr": func(op operation) string {
+		expr := fmt.Sprintf("%q", op.Path)
+		for _, param := range op.PathParams {
+			expr = strings.Replace(expr, "{"+param.Name+"}", `" + url.PathEscape(`+param.GoName+`) + "`, 1)
+		}
+		return strings.TrimSuffix(strings.TrimPrefix(expr, `"" + `), ` + ""`)
+	},
+}
+
+var clientTemplate = template.Must(template.New("client").Funcs(funcs).Parse(`// Code generated by clientgen from internal/openapi/openapi.json. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- if .UsesBytes}}
+	"bytes"
+{{- end}}
+	"context"
+{{- if .UsesJSON}}
+	"encoding/json"
+{{- end}}
+{{- if .UsesFmt}}
+	"fmt"
+{{- end}}
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+{{range .Imports}}
+	"{{.}}"
+{{- end}}
+)
+
+{{range .Types}}
+{{- if .Doc}}// {{comment .Doc}}
+{{end -}}
+{{if .Alias}}type {{.Name}} = {{.Alias}}
+{{else}}type {{.Name}} struct {
+{{- range .Fields}}
+	{{if .Doc}}// {{comment .Doc}}
+	{{end}}{{.Name}} {{.Type}} ` + "`" + `json:"{{.JSONName}}{{if .Optional}},omitempty{{end}}"` + "`" + `
+{{- end}}
+}
+{{end}}
+{{end}}
+
+// HTTPRequestDoer performs HTTP requests, e.g. *http.Client.
+type HTTPRequestDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// RequestEditorFn changes a request before it is sent.
+type RequestEditorFn func(ctx context.Context, req *http.Request) error
+
+type Client struct {
+	// Server is the base URL, e.g. https://localhost:8080
+	Server         string
+	Client         HTTPRequestDoer
+	RequestEditors []RequestEditorFn
+}
+
+func NewClient(server string, doer HTTPRequestDoer, editors ...RequestEditorFn) *Client {
+	return &Client{
+		Server:         strings.TrimSuffix(server, "/"),
+		Client:         doer,
+		RequestEditors: editors,
+	}
+}
+
+func (c *Client) do(ctx context.Context, req *http.Request, reqEditors []RequestEditorFn) (*http.Response, []byte, error) {
+	for _, editor := range append(c.RequestEditors, reqEditors...) {
+		if err := editor(ctx, req); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rsp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rsp, body, nil
+}
+
+func isJSON(rsp *http.Response) bool {
+	return strings.Contains(rsp.Header.Get("Content-Type"), "json")
+}
+{{range .Operations}}{{$op := .}}
+{{- if .QueryParams}}
+type {{.Name}}Params struct {
+{{- range .QueryParams}}
+	{{if .Doc}}// {{comment .Doc}}
+	{{end}}{{.GoName}} {{.Type}}
+{{- end}}
+}
+{{end}}
+type {{.Name}}Response struct {
+	HTTPResponse *http.Response
+	Body         []byte
+{{- range .Responses}}
+	{{.Field}} *{{.Type}}
+{{- end}}
+{{- if .Default}}
+	{{.Default.Field}} *{{.Default.Type}}
+{{- end}}
+}
+
+func (r *{{.Name}}Response) StatusCode() int {
+	return r.HTTPResponse.StatusCode
+}
+
+// {{.Name}} calls {{.Method}} {{.Path}}{{if .Summary}}: {{comment .Summary}}{{end}}.
+func (c *Client) {{.Name}}(ctx context.Context,
+{{- range .PathParams}} {{.GoName}} string,{{end}}
+{{- if .QueryParams}} params *{{.Name}}Params,{{end}}
+{{- if .BodyType}} body {{.BodyType}},{{end}}
+{{- if .RawBodyType}} body io.Reader,{{end}} reqEditors ...RequestEditorFn) (*{{.Name}}Response, error) {
+	queryURL, err := url.Parse(c.Server + {{pathExpr .}})
+	if err != nil {
+		return nil, err
+	}
+{{- if .QueryParams}}
+	if params != nil {
+		query := queryURL.Query()
+{{- range .QueryParams}}
+		if params.{{.GoName}} != nil {
+			query.Set("{{.Name}}", fmt.Sprint(*params.{{.GoName}}))
+		}
+{{- end}}
+		queryURL.RawQuery = query.Encode()
+	}
+{{- end}}
+
+{{- if .BodyType}}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "{{.Method}}", queryURL.String(), bytes.NewReader(buf))
+{{- else if .RawBodyType}}
+
+	req, err := http.NewRequestWithContext(ctx, "{{.Method}}", queryURL.String(), body)
+{{- else}}
+
+	req, err := http.NewRequestWithContext(ctx, "{{.Method}}", queryURL.String(), nil)
+{{- end}}
+	if err != nil {
+		return nil, err
+	}
+{{- if .BodyType}}
+	req.Header.Set("Content-Type", "application/json")
+{{- else if .RawBodyType}}
+	req.Header.Set("Content-Type", "{{.RawBodyType}}")
+{{- end}}
+
+	rsp, rspBody, err := c.do(ctx, req, reqEditors)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &{{.Name}}Response{HTTPResponse: rsp, Body: rspBody}
+{{- if or .Responses .Default}}
+	switch {
+{{- range .Responses}}
+	case rsp.StatusCode == {{.Code}} && isJSON(rsp):
+		var dest {{.Type}}
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.{{.Field}} = &dest
+{{- end}}
+{{- if .Default}}
+	case isJSON(rsp){{range .Responses}} && rsp.StatusCode != {{.Code}}{{end}}:
+		var dest {{.Default.Type}}
+		if err := json.Unmarshal(rspBody, &dest); err != nil {
+			return nil, err
+		}
+		response.{{.Default.Field}} = &dest
+{{- end}}
+	}
+{{- end}}
+
+	return response, nil
+}
+{{end}}`))
+
+func main() {
+	pkg := flag.String("package", "api", "package name of the generated code")
+	out := flag.String("o", "client.gen.go", "output file")
+	flag.Parse()
+
+	doc, err := openapi.Load()
+	if err != nil {
+		fail(err)
+	}
+
+	g := &generator{doc: doc, imports: make(map[string]struct{})}
+	types, err := g.typeDefs()
+	if err != nil {
+		fail(err)
+	}
+	ops, err := g.operations()
+	if err != nil {
+		fail(err)
+	}
+
+	imports := maps.Keys(g.imports)
+	slices.Sort(imports)
+
+	var usesBytes, usesJSON, usesFmt bool
+	for _, op := range ops {
+		usesBytes = usesBytes || op.BodyType != ""
+		usesJSON = usesJSON || op.BodyType != "" || len(op.Responses) > 0 || op.Default != nil
+		usesFmt = usesFmt || len(op.QueryParams) > 0
+	}
+
+	var buf bytes.Buffer
+	err = clientTemplate.Execute(&buf, map[string]any{
+		"Package":    *pkg,
+		"Imports":    imports,
+		"Types":      types,
+		"Operations": ops,
+		"UsesBytes":  usesBytes,
+		"UsesJSON":   usesJSON,
+		"UsesFmt":    usesFmt,
+	})
+	if err != nil {
+		fail(err)
+	}
+
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		fail(fmt.Errorf("%w\n%s", err, buf.Bytes()))
+	}
+
+	if err := os.WriteFile(*out, source, 0o644); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "clientgen:", err)
+	os.Exit(1)
+}
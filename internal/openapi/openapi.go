@@ -0,0 +1,190 @@
+// Package openapi holds the OpenAPI document of the server API. The document is maintained by hand,
+// the server serves it and validates request bodies against it, and the agent client is generated from it.
+// Only the parts of OpenAPI 3.0 used by the document are supported.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+// Spec returns the OpenAPI document as is.
+func Spec() []byte {
+	return spec
+}
+
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+}
+
+type Components struct {
+	Schemas    map[string]*Schema    `json:"schemas"`
+	Parameters map[string]*Parameter `json:"parameters"`
+	Responses  map[string]*Response  `json:"responses"`
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary"`
+	Description string               `json:"description"`
+	Parameters  []*Parameter         `json:"parameters"`
+	RequestBody *RequestBody         `json:"requestBody"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Ref         string  `json:"$ref"`
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref         string               `json:"$ref"`
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref                  string                `json:"$ref"`
+	Type                 string                `json:"type"`
+	Format               string                `json:"format"`
+	Description          string                `json:"description"`
+	Enum                 []any                 `json:"enum"`
+	Required             []string              `json:"required"`
+	Properties           map[string]*Schema    `json:"properties"`
+	AdditionalProperties *AdditionalProperties `json:"additionalProperties"`
+	Items                *Schema               `json:"items"`
+	MinLength            *int                  `json:"minLength"`
+	MaxLength            *int                  `json:"maxLength"`
+	MinItems             *int                  `json:"minItems"`
+	MaxItems             *int                  `json:"maxItems"`
+
+	// GoType names an existing Go type to use for the schema in generated code
+	GoType       string `json:"x-go-type"`
+	GoTypeImport string `json:"x-go-type-import"`
+}
+
+// AdditionalProperties is either a boolean or a schema of additional properties.
+type AdditionalProperties struct {
+	Allowed bool
+	Schema  *Schema
+}
+
+func (a *AdditionalProperties) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &a.Allowed); err == nil {
+		return nil
+	}
+
+	a.Allowed = true
+	return json.Unmarshal(data, &a.Schema)
+}
+
+// Load parses the embedded document.
+func Load() (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+func refName(ref, section string) (string, error) {
+	name, ok := strings.CutPrefix(ref, "#/components/"+section+"/")
+	if !ok {
+		return "", fmt.Errorf("unsupported reference %q", ref)
+	}
+
+	return name, nil
+}
+
+// SchemaRef returns the component name of the schema if it is a reference.
+func SchemaRef(schema *Schema) (string, bool) {
+	if schema == nil || schema.Ref == "" {
+		return "", false
+	}
+
+	name, err := refName(schema.Ref, "schemas")
+	return name, err == nil
+}
+
+func (d *Document) ResolveSchema(schema *Schema) (*Schema, error) {
+	for schema != nil && schema.Ref != "" {
+		name, err := refName(schema.Ref, "schemas")
+		if err != nil {
+			return nil, err
+		}
+
+		resolved, ok := d.Components.Schemas[name]
+		if !ok {
+			return nil, fmt.Errorf("schema %q not found", name)
+		}
+		schema = resolved
+	}
+
+	return schema, nil
+}
+
+func (d *Document) ResolveParameter(param *Parameter) (*Parameter, error) {
+	if param.Ref == "" {
+		return param, nil
+	}
+
+	name, err := refName(param.Ref, "parameters")
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, ok := d.Components.Parameters[name]
+	if !ok {
+		return nil, fmt.Errorf("parameter %q not found", name)
+	}
+
+	return resolved, nil
+}
+
+func (d *Document) ResolveResponse(response *Response) (*Response, error) {
+	if response.Ref == "" {
+		return response, nil
+	}
+
+	name, err := refName(response.Ref, "responses")
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, ok := d.Components.Responses[name]
+	if !ok {
+		return nil, fmt.Errorf("response %q not found", name)
+	}
+
+	return resolved, nil
+}
+
+// JSONSchema returns the schema of JSON content, or nil if there is none.
+func JSONSchema(content map[string]MediaType) *Schema {
+	if media, ok := content["application/json"]; ok {
+		return media.Schema
+	}
+
+	return nil
+}
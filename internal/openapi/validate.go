@@ -0,0 +1,200 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// ValidationError tells where the body doesn't match the schema. Path is a JSON pointer, e.g. "/3/value".
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+
+	return e.Path + ": " + e.Message
+}
+
+// Validator checks JSON request bodies against the document.
+type Validator struct {
+	doc    *Document
+	bodies map[string]*RequestBody
+}
+
+func NewValidator(doc *Document) *Validator {
+	bodies := make(map[string]*RequestBody)
+	for path, operations := range doc.Paths {
+		for method, operation := range operations {
+			if operation.RequestBody != nil && JSONSchema(operation.RequestBody.Content) != nil {
+				bodies[strings.ToUpper(method)+" "+path] = operation.RequestBody
+			}
+		}
+	}
+
+	return &Validator{doc: doc, bodies: bodies}
+}
+
+// Validates reports whether the operation has a JSON body to validate.
+func (v *Validator) Validates(method, path string) bool {
+	_, ok := v.bodies[method+" "+path]
+	return ok
+}
+
+// ValidateRequest validates body of the request to the operation at path (as written in the document).
+// It returns an error if body is not JSON at all, and nothing for operations without JSON bodies.
+// Null property values are treated as absent, the same way encoding/json does.
+func (v *Validator) ValidateRequest(method, path string, body []byte) ([]ValidationError, error) {
+	requestBody, ok := v.bodies[method+" "+path]
+	if !ok {
+		return nil, nil
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		if requestBody.Required {
+			return []ValidationError{{Message: "request body is required"}}, nil
+		}
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+
+	var errs []ValidationError
+	v.validate(value, JSONSchema(requestBody.Content), "", &errs)
+	return errs, nil
+}
+
+func (v *Validator) validate(value any, schema *Schema, path string, errs *[]ValidationError) {
+	schema, err := v.doc.ResolveSchema(schema)
+	if err != nil {
+		*errs = append(*errs, ValidationError{Path: path, Message: err.Error()})
+		return
+	}
+	if schema == nil {
+		return
+	}
+
+	fail := func(format string, args ...any) {
+		*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			fail("expected object")
+			return
+		}
+		v.validateObject(object, schema, path, errs)
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			fail("expected array")
+			return
+		}
+		if schema.MinItems != nil && len(array) < *schema.MinItems {
+			fail("expected at least %d items", *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(array) > *schema.MaxItems {
+			fail("expected at most %d items", *schema.MaxItems)
+		}
+		for i, item := range array {
+			v.validate(item, schema.Items, path+"/"+strconv.Itoa(i), errs)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			fail("expected string")
+			return
+		}
+		if schema.MinLength != nil && len([]rune(s)) < *schema.MinLength {
+			fail("expected at least %d characters", *schema.MinLength)
+		}
+		if schema.MaxLength != nil && len([]rune(s)) > *schema.MaxLength {
+			fail("expected at most %d characters", *schema.MaxLength)
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			fail("expected number")
+			return
+		}
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			fail("expected integer")
+			return
+		}
+		if _, err := n.Int64(); err != nil {
+			fail("expected 64-bit integer")
+			return
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("expected boolean")
+			return
+		}
+	}
+
+	if len(schema.Enum) > 0 && !slices.ContainsFunc(schema.Enum, func(e any) bool { return enumEqual(e, value) }) {
+		fail("expected one of %v", schema.Enum)
+	}
+}
+
+func (v *Validator) validateObject(object map[string]any, schema *Schema, path string, errs *[]ValidationError) {
+	for _, name := range schema.Required {
+		if object[name] == nil {
+			*errs = append(*errs, ValidationError{Path: path + "/" + name, Message: "required property is missing"})
+		}
+	}
+
+	names := maps.Keys(object)
+	slices.Sort(names)
+	for _, name := range names {
+		value := object[name]
+		if value == nil {
+			continue
+		}
+
+		propertyPath := path + "/" + name
+		if propertySchema, ok := schema.Properties[name]; ok {
+			v.validate(value, propertySchema, propertyPath, errs)
+			continue
+		}
+
+		if schema.AdditionalProperties != nil {
+			if !schema.AdditionalProperties.Allowed {
+				*errs = append(*errs, ValidationError{Path: propertyPath, Message: "unknown property"})
+			} else if schema.AdditionalProperties.Schema != nil {
+				v.validate(value, schema.AdditionalProperties.Schema, propertyPath, errs)
+			}
+		}
+	}
+}
+
+// enumEqual compares enum value from the document with a decoded body value
+func enumEqual(enumValue any, value any) bool {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		return err == nil && reflect.DeepEqual(enumValue, f)
+	}
+
+	return reflect.DeepEqual(enumValue, value)
+}
@@ -0,0 +1,178 @@
+package openapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDocument(t *testing.T) {
+	doc, err := Load()
+	require.NoError(t, err)
+
+	// Every reference in the document must resolve
+	var check func(schema *Schema)
+	check = func(schema *Schema) {
+		if schema == nil {
+			return
+		}
+		if schema.Ref != "" {
+			_, err := doc.ResolveSchema(schema)
+			require.NoError(t, err)
+			return
+		}
+		for _, property := range schema.Properties {
+			check(property)
+		}
+		check(schema.Items)
+	}
+
+	for path, operations := range doc.Paths {
+		for method, operation := range operations {
+			assert.NotEmpty(t, operation.OperationID, "%s %s", method, path)
+			for _, param := range operation.Parameters {
+				param, err := doc.ResolveParameter(param)
+				require.NoError(t, err)
+				check(param.Schema)
+			}
+			if operation.RequestBody != nil {
+				check(JSONSchema(operation.RequestBody.Content))
+			}
+			for _, response := range operation.Responses {
+				response, err := doc.ResolveResponse(response)
+				require.NoError(t, err)
+				check(JSONSchema(response.Content))
+			}
+		}
+	}
+	for _, schema := range doc.Components.Schemas {
+		check(schema)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	doc, err := Load()
+	require.NoError(t, err)
+	validator := NewValidator(doc)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantErrs []ValidationError
+		wantErr  bool
+	}{
+		{
+			name:   "valid metrics",
+			method: "POST",
+			path:   "/update",
+			body:   `{"id":"a","type":"gauge","value":1.5}`,
+		},
+		{
+			name:   "nulls are absent values",
+			method: "POST",
+			path:   "/update",
+			body:   `{"id":"a","type":"gauge","value":null}`,
+		},
+		{
+			name:     "wrong property types",
+			method:   "POST",
+			path:     "/update",
+			body:     `{"id":1,"type":"counter","delta":1.5}`,
+			wantErrs: []ValidationError{{"/delta", "expected 64-bit integer"}, {"/id", "expected string"}},
+		},
+		{
+			name:     "not an object",
+			method:   "POST",
+			path:     "/value",
+			body:     `[]`,
+			wantErrs: []ValidationError{{"", "expected object"}},
+		},
+		{
+			name:   "batch item errors",
+			method: "POST",
+			path:   "/updates",
+			body:   `[{"id":"a","type":"gauge","value":1},{"id":"b","type":"gauge","value":"1"},"c"]`,
+			wantErrs: []ValidationError{
+				{"/1/value", "expected number"},
+				{"/2", "expected object"},
+			},
+		},
+		{
+			name:     "missing body",
+			method:   "POST",
+			path:     "/updates",
+			body:     ``,
+			wantErrs: []ValidationError{{"", "request body is required"}},
+		},
+		{
+			name:    "malformed json",
+			method:  "POST",
+			path:    "/updates",
+			body:    `[{"id":`,
+			wantErr: true,
+		},
+		{
+			name:   "operation without body",
+			method: "GET",
+			path:   "/ping",
+			body:   `whatever`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs, err := validator.ValidateRequest(tt.method, tt.path, []byte(tt.body))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantErrs, errs)
+		})
+	}
+}
+
+func TestValidateKeywords(t *testing.T) {
+	one, two := 1, 2
+	doc := &Document{
+		Components: Components{
+			Schemas: map[string]*Schema{
+				"Item": {
+					Type:                 "object",
+					Required:             []string{"kind"},
+					AdditionalProperties: &AdditionalProperties{Allowed: false},
+					Properties: map[string]*Schema{
+						"kind": {Type: "string", Enum: []any{"a", "b"}},
+						"name": {Type: "string", MinLength: &one, MaxLength: &two},
+						"on":   {Type: "boolean"},
+					},
+				},
+			},
+		},
+	}
+	doc.Paths = map[string]map[string]*Operation{
+		"/items": {"post": {RequestBody: &RequestBody{Content: map[string]MediaType{
+			"application/json": {Schema: &Schema{Type: "array", MaxItems: &two, Items: &Schema{Ref: "#/components/schemas/Item"}}},
+		}}}},
+	}
+	validator := NewValidator(doc)
+
+	errs, err := validator.ValidateRequest("POST", "/items", []byte(`[
+		{"kind":"a","name":"ok","on":true},
+		{"kind":"c","name":"long","extra":1,"on":"yes"},
+		{"name":""}
+	]`))
+	require.NoError(t, err)
+	assert.Equal(t, []ValidationError{
+		{"", "expected at most 2 items"},
+		{"/1/extra", "unknown property"},
+		{"/1/kind", "expected one of [a b]"},
+		{"/1/name", "expected at most 2 characters"},
+		{"/1/on", "expected boolean"},
+		{"/2/kind", "required property is missing"},
+		{"/2/name", "expected at least 1 characters"},
+	}, errs)
+}
@@ -0,0 +1,245 @@
+// Package alerting evaluates threshold rules against metrics and tracks alert states.
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/server/history"
+	"github.com/SamMeown/metrix/internal/storage"
+)
+
+type State string
+
+const (
+	StateInactive State = "inactive"
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+// Alert is the state of a rule. A rule becomes pending when its condition is met,
+// firing when it's met for the rule period and resolved when it's not met anymore after firing.
+type Alert struct {
+	Rule        string     `json:"rule"`
+	Expr        string     `json:"expr"`
+	Metric      string     `json:"metric"`
+	Description string     `json:"description,omitempty"`
+	State       State      `json:"state"`
+	Value       *float64   `json:"value,omitempty"`
+	ActiveAt    *time.Time `json:"activeAt,omitempty"`
+	FiredAt     *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time `json:"resolvedAt,omitempty"`
+}
+
+type Engine struct {
+	rules     []Rule
+	mStorage  storage.MetricsStorageGetter
+	recorder  *history.Recorder
+	statePath string
+	now       func() time.Time
+
+	m         sync.Mutex
+	alerts    map[string]*Alert
+	listeners []func(Alert)
+}
+
+// NewEngine creates engine evaluating rules. The rate of metrics is taken from recorder.
+// If statePath is not empty, alert states are saved to it on every change.
+func NewEngine(rules []Rule, mStorage storage.MetricsStorageGetter, recorder *history.Recorder, statePath string) *Engine {
+	e := &Engine{
+		rules:     rules,
+		mStorage:  mStorage,
+		recorder:  recorder,
+		statePath: statePath,
+		now:       time.Now,
+		alerts:    make(map[string]*Alert, len(rules)),
+	}
+	for _, rule := range rules {
+		e.alerts[rule.Name] = &Alert{
+			Rule:        rule.Name,
+			Expr:        rule.Expr,
+			Metric:      rule.Metric(),
+			Description: rule.Description,
+			State:       StateInactive,
+		}
+	}
+
+	return e
+}
+
+// OnChange registers fn to be called with every alert changing its state. It's not safe to call during evaluation.
+func (e *Engine) OnChange(fn func(Alert)) {
+	e.listeners = append(e.listeners, fn)
+}
+
+// LoadState restores alert states saved before. States of changed rules are not restored.
+func (e *Engine) LoadState() error {
+	if e.statePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(e.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []Alert
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	for _, alert := range saved {
+		current, ok := e.alerts[alert.Rule]
+		if !ok || current.Expr != alert.Expr {
+			continue
+		}
+		alert.Description = current.Description
+		*current = alert
+	}
+
+	return nil
+}
+
+// saveState writes alert states to a temporary file first, so that a crash doesn't leave it truncated.
+func (e *Engine) saveState(alerts []Alert) error {
+	data, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(e.statePath), filepath.Base(e.statePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), e.statePath)
+}
+
+// Eval evaluates all rules once and updates alert states.
+func (e *Engine) Eval(ctx context.Context) error {
+	now := e.now()
+
+	type result struct {
+		value float64
+		ok    bool
+	}
+	results := make([]result, len(e.rules))
+	var errs []error
+	for i, rule := range e.rules {
+		value, ok, err := rule.value(ctx, e.mStorage, e.recorder, now)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		results[i] = result{value, ok}
+	}
+
+	e.m.Lock()
+	var changed []Alert
+	for i, rule := range e.rules {
+		alert := e.alerts[rule.Name]
+		res := results[i]
+		if res.ok {
+			value := res.value
+			alert.Value = &value
+		} else {
+			alert.Value = nil
+		}
+
+		previous := alert.State
+		if res.ok && rule.compare(res.value) {
+			if alert.State == StateInactive || alert.State == StateResolved {
+				alert.State = StatePending
+				alert.ActiveAt = &now
+				alert.FiredAt = nil
+				alert.ResolvedAt = nil
+			}
+			if alert.State == StatePending && now.Sub(*alert.ActiveAt) >= rule.forPeriod {
+				alert.State = StateFiring
+				alert.FiredAt = &now
+			}
+		} else {
+			switch alert.State {
+			case StatePending:
+				alert.State = StateInactive
+				alert.ActiveAt = nil
+			case StateFiring:
+				alert.State = StateResolved
+				alert.ResolvedAt = &now
+			}
+		}
+
+		if alert.State != previous {
+			changed = append(changed, *alert)
+			logger.Log.Infof("Alert %s is %s", rule.Name, alert.State)
+		}
+	}
+	e.m.Unlock()
+
+	if len(changed) > 0 && e.statePath != "" {
+		if err := e.saveState(e.Alerts()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, alert := range changed {
+		for _, fn := range e.listeners {
+			fn(alert)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Alerts returns states of all rules in the rules order.
+func (e *Engine) Alerts() []Alert {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	rv := make([]Alert, 0, len(e.rules))
+	for _, rule := range e.rules {
+		rv = append(rv, *e.alerts[rule.Name])
+	}
+
+	return rv
+}
+
+// Run evaluates rules every interval until ctx is done.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := e.Eval(ctx); err != nil {
+			logger.Log.Errorf("Failed to evaluate alert rules: %s", err)
+		}
+	}
+}
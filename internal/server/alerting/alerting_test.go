@@ -0,0 +1,138 @@
+package alerting
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/server/history"
+	"github.com/SamMeown/metrix/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    Rule
+		wantErr bool
+	}{
+		{
+			name: "test threshold with period",
+			expr: "HeapAlloc > 1e9 for 2m",
+			want: Rule{metric: "HeapAlloc", op: ">", threshold: 1e9, forPeriod: 2 * time.Minute},
+		},
+		{
+			name: "test rate",
+			expr: "rate(PollCount) == 0 for 5m",
+			want: Rule{metric: "PollCount", rate: true, window: time.Minute, op: "==", threshold: 0, forPeriod: 5 * time.Minute},
+		},
+		{
+			name: "test rate with window and no spaces",
+			expr: "rate(PollCount[30s])<=-1.5",
+			want: Rule{metric: "PollCount", rate: true, window: 30 * time.Second, op: "<=", threshold: -1.5},
+		},
+		{name: "test no threshold", expr: "HeapAlloc >", wantErr: true},
+		{name: "test bad threshold", expr: "HeapAlloc > high", wantErr: true},
+		{name: "test bad period", expr: "HeapAlloc > 1 for ever", wantErr: true},
+		{name: "test unknown function", expr: "avg(HeapAlloc) > 1", wantErr: true},
+		{name: "test bad window", expr: "rate(PollCount[0s]) > 1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseRule("rule", tt.expr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			tt.want.Name = "rule"
+			tt.want.Expr = tt.expr
+			assert.Equal(t, tt.want, rule)
+		})
+	}
+}
+
+func TestEngine(t *testing.T) {
+	ctx := context.Background()
+	statePath := filepath.Join(t.TempDir(), "alerts.json")
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(rulesPath, []byte(`{"rules": [
+		{"name": "HighHeap", "expr": "HeapAlloc > 100 for 2m", "description": "Heap is too big"},
+		{"name": "NoPolls", "expr": "rate(PollCount) == 0 for 1m"}
+	]}`), 0600))
+
+	rules, err := Load(rulesPath)
+	require.NoError(t, err)
+
+	mStorage := storage.New()
+	recorder := history.NewRecorder(10)
+	engine := NewEngine(rules, mStorage, recorder, statePath)
+	now := time.Unix(1000, 0)
+	engine.now = func() time.Time { return now }
+	var changes []string
+	engine.OnChange(func(alert Alert) {
+		changes = append(changes, alert.Rule+" "+string(alert.State))
+	})
+
+	step := func(heap float64, polls int64) map[string]State {
+		require.NoError(t, mStorage.SetGauge(ctx, "HeapAlloc", heap))
+		require.NoError(t, mStorage.SetCounter(ctx, "PollCount", polls))
+		items, err := mStorage.GetAll(ctx)
+		require.NoError(t, err)
+		recorder.Record(now, items)
+
+		require.NoError(t, engine.Eval(ctx))
+		now = now.Add(time.Minute)
+
+		states := make(map[string]State)
+		for _, alert := range engine.Alerts() {
+			states[alert.Rule] = alert.State
+		}
+		return states
+	}
+
+	assert.Equal(t, map[string]State{"HighHeap": StatePending, "NoPolls": StateInactive}, step(200, 1),
+		"no rate without history")
+	assert.Equal(t, map[string]State{"HighHeap": StateInactive, "NoPolls": StatePending}, step(50, 0),
+		"pending alert is cancelled")
+	assert.Equal(t, map[string]State{"HighHeap": StatePending, "NoPolls": StateFiring}, step(200, 0))
+	assert.Equal(t, map[string]State{"HighHeap": StatePending, "NoPolls": StateFiring}, step(200, 0))
+	assert.Equal(t, map[string]State{"HighHeap": StateFiring, "NoPolls": StateResolved}, step(200, 3))
+
+	assert.Equal(t, []string{
+		"HighHeap pending",
+		"HighHeap inactive",
+		"NoPolls pending",
+		"HighHeap pending",
+		"NoPolls firing",
+		"HighHeap firing",
+		"NoPolls resolved",
+	}, changes)
+
+	alert := engine.Alerts()[0]
+	assert.Equal(t, "Heap is too big", alert.Description)
+	assert.Equal(t, "HeapAlloc", alert.Metric)
+	require.NotNil(t, alert.Value)
+	assert.Equal(t, 200.0, *alert.Value)
+	require.NotNil(t, alert.FiredAt)
+	assert.Equal(t, time.Unix(1000, 0).Add(4*time.Minute), *alert.FiredAt)
+
+	t.Run("test state is restored", func(t *testing.T) {
+		rules[1], err = ParseRule("NoPolls", "rate(PollCount) == 0 for 2m")
+		require.NoError(t, err)
+
+		restored := NewEngine(rules, mStorage, recorder, statePath)
+		require.NoError(t, restored.LoadState())
+
+		alerts := restored.Alerts()
+		assert.Equal(t, engine.Alerts()[0].State, alerts[0].State)
+		assert.Equal(t, engine.Alerts()[0].FiredAt.Unix(), alerts[0].FiredAt.Unix())
+		assert.Equal(t, StateInactive, alerts[1].State, "changed rules are not restored")
+	})
+}
@@ -0,0 +1,194 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/server/history"
+	"github.com/SamMeown/metrix/internal/storage"
+)
+
+const defaultRateWindow = time.Minute
+
+// ruleExpr is a condition of form `<operand> <op> <threshold> [for <duration>]`,
+// where operand is a metrics name or rate(<name>[<window>]), e.g.
+//
+//	HeapAlloc > 1e9 for 2m
+//	rate(PollCount) == 0 for 5m
+//	rate(PollCount[30s]) < 1
+var ruleExpr = regexp.MustCompile(
+	`^\s*(?:rate\(\s*([^\s()\[\]]+)\s*(?:\[\s*([^\s\]]+)\s*\])?\s*\)|([^\s()\[\]<>=!]+))` +
+		`\s*(>=|<=|==|!=|>|<)\s*(\S+)` +
+		`(?:\s+for\s+(\S+))?\s*$`,
+)
+
+// Rule is an entry of the rules file, e.g.
+//
+//	{"rules": [{"name": "HighHeap", "expr": "HeapAlloc > 1e9 for 2m", "description": "Heap is over 1GB"}]}
+type Rule struct {
+	Name        string `json:"name"`
+	Expr        string `json:"expr"`
+	Description string `json:"description,omitempty"`
+
+	metric    string
+	rate      bool
+	window    time.Duration
+	op        string
+	threshold float64
+	forPeriod time.Duration
+}
+
+type rulesFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// ParseRule parses rule expression.
+func ParseRule(name, expr string) (Rule, error) {
+	rule := Rule{Name: name, Expr: expr}
+	if name == "" {
+		return rule, fmt.Errorf("rule %q has no name", expr)
+	}
+
+	match := ruleExpr.FindStringSubmatch(expr)
+	if match == nil {
+		return rule, fmt.Errorf("rule %s: bad expression %q", name, expr)
+	}
+
+	if match[1] != "" {
+		rule.metric = match[1]
+		rule.rate = true
+		rule.window = defaultRateWindow
+		if match[2] != "" {
+			window, err := time.ParseDuration(match[2])
+			if err != nil || window <= 0 {
+				return rule, fmt.Errorf("rule %s: bad rate window %q", name, match[2])
+			}
+			rule.window = window
+		}
+	} else {
+		rule.metric = match[3]
+	}
+
+	rule.op = match[4]
+
+	threshold, err := strconv.ParseFloat(match[5], 64)
+	if err != nil {
+		return rule, fmt.Errorf("rule %s: bad threshold %q", name, match[5])
+	}
+	rule.threshold = threshold
+
+	if match[6] != "" {
+		rule.forPeriod, err = time.ParseDuration(match[6])
+		if err != nil || rule.forPeriod < 0 {
+			return rule, fmt.Errorf("rule %s: bad duration %q", name, match[6])
+		}
+	}
+
+	return rule, nil
+}
+
+// Load reads rules from the rules file.
+func Load(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file rulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]struct{}, len(file.Rules))
+	rules := make([]Rule, 0, len(file.Rules))
+	for _, r := range file.Rules {
+		if _, ok := names[r.Name]; ok {
+			return nil, fmt.Errorf("duplicate rule %s", r.Name)
+		}
+		names[r.Name] = struct{}{}
+
+		rule, err := ParseRule(r.Name, r.Expr)
+		if err != nil {
+			return nil, err
+		}
+		rule.Description = r.Description
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Metric returns the name of the metrics the rule checks.
+func (r Rule) Metric() string {
+	return r.metric
+}
+
+// UsesHistory tells if the rule needs metrics history to be evaluated.
+func (r Rule) UsesHistory() bool {
+	return r.rate
+}
+
+func (r Rule) compare(value float64) bool {
+	switch r.op {
+	case ">":
+		return value > r.threshold
+	case ">=":
+		return value >= r.threshold
+	case "<":
+		return value < r.threshold
+	case "<=":
+		return value <= r.threshold
+	case "==":
+		return value == r.threshold
+	default:
+		return value != r.threshold
+	}
+}
+
+// value returns the current value of the rule operand. It is not ok if there is no data for it.
+func (r Rule) value(ctx context.Context, mStorage storage.MetricsStorageGetter, recorder *history.Recorder, now time.Time) (float64, bool, error) {
+	if r.rate {
+		return r.rateValue(recorder, now)
+	}
+
+	gauge, err := mStorage.GetGauge(ctx, r.metric)
+	if err != nil {
+		return 0, false, err
+	}
+	if gauge != nil {
+		return *gauge, true, nil
+	}
+
+	counter, err := mStorage.GetCounter(ctx, r.metric)
+	if err != nil {
+		return 0, false, err
+	}
+	if counter != nil {
+		return float64(*counter), true, nil
+	}
+
+	return 0, false, nil
+}
+
+// rateValue returns per second increase of the metrics within the rate window.
+func (r Rule) rateValue(recorder *history.Recorder, now time.Time) (float64, bool, error) {
+	if recorder == nil {
+		return 0, false, nil
+	}
+
+	from := now.Add(-r.window)
+	points := recorder.Range(history.Key{MType: storage.MetricsTypeCounter, Name: r.metric}, from, now)
+	counter := true
+	if len(points) == 0 {
+		points = recorder.Range(history.Key{MType: storage.MetricsTypeGauge, Name: r.metric}, from, now)
+		counter = false
+	}
+
+	value, ok := history.Rate(points, counter)
+	return value, ok, nil
+}
@@ -0,0 +1,82 @@
+// Package apierror defines the error envelope returned by JSON routes:
+//
+//	{"error": {"code": "missing_value", "message": "No metrics value", "id": "Alloc", "index": 3}}
+//
+// Batch errors list the offending items in "errors".
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/SamMeown/metrix/internal/logger"
+)
+
+const (
+	CodeBadRequest       = "bad_request"
+	CodeInvalidJSON      = "invalid_json"
+	CodeSchemaViolation  = "schema_violation"
+	CodeInvalidBatch     = "invalid_batch"
+	CodeMissingName      = "missing_name"
+	CodeMissingValue     = "missing_value"
+	CodeInvalidType      = "invalid_type"
+	CodeInvalidName      = "invalid_name"
+	CodeSeriesLimit      = "series_limit"
+	CodeNotFound         = "not_found"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeInvalidSignature = "invalid_signature"
+	CodeRateLimited      = "rate_limited"
+	CodeBodyTooLarge     = "body_too_large"
+	CodeInvalidQuery     = "invalid_query"
+
+	CodeIdempotencyKeyInvalid = "idempotency_key_invalid"
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+	CodeInternal              = "internal_error"
+)
+
+type Error struct {
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	ID      string  `json:"id,omitempty"`
+	Index   *int    `json:"index,omitempty"`
+	Errors  []Error `json:"errors,omitempty"`
+}
+
+func (e Error) Error() string {
+	return e.Message
+}
+
+type envelope struct {
+	Error Error `json:"error"`
+}
+
+// Write responds with status and the error envelope.
+func Write(res http.ResponseWriter, status int, apiErr Error) {
+	res.Header().Del("Content-Length")
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(status)
+
+	if err := json.NewEncoder(res).Encode(envelope{Error: apiErr}); err != nil {
+		logger.Log.Errorf("Failed to write error response: %s", err)
+	}
+}
+
+// WantsJSON reports whether the client sent or accepts JSON.
+func WantsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Content-Type"), "application/json") ||
+		strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// Respond writes the error envelope to JSON clients and a plain text error to the rest.
+// Middlewares use it as they sit in front of both JSON and plain text routes.
+func Respond(res http.ResponseWriter, req *http.Request, status int, code string, message string) {
+	if WantsJSON(req) {
+		Write(res, status, Error{Code: code, Message: message})
+		return
+	}
+
+	http.Error(res, message, status)
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	// ScopeAdmin grants every other scope as well
+	ScopeAdmin Scope = "admin"
+)
+
+// Token is an entry of the tokens file, e.g.
+//
+//	{"tokens": [{"name": "agent", "token": "...", "scopes": ["write"], "prefixes": ["Heap", "Gc"]}]}
+//
+// Empty prefixes allow access to all metrics.
+type Token struct {
+	Name     string   `json:"name"`
+	Token    string   `json:"token"`
+	Scopes   []Scope  `json:"scopes"`
+	Prefixes []string `json:"prefixes"`
+}
+
+type tokensFile struct {
+	Tokens []Token `json:"tokens"`
+}
+
+type Principal struct {
+	Name     string
+	scopes   map[Scope]struct{}
+	prefixes []string
+}
+
+func (p *Principal) HasScope(scope Scope) bool {
+	if _, ok := p.scopes[ScopeAdmin]; ok {
+		return true
+	}
+
+	_, ok := p.scopes[scope]
+	return ok
+}
+
+func (p *Principal) AllowsMetric(name string) bool {
+	if len(p.prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticator keeps principals by token hash, so that lookups don't leak token contents through timing.
+type Authenticator struct {
+	principals map[[sha256.Size]byte]*Principal
+}
+
+func New(tokens []Token) (*Authenticator, error) {
+	a := &Authenticator{
+		principals: make(map[[sha256.Size]byte]*Principal, len(tokens)),
+	}
+
+	for _, token := range tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %q is empty", token.Name)
+		}
+
+		principal := &Principal{
+			Name:     token.Name,
+			scopes:   make(map[Scope]struct{}, len(token.Scopes)),
+			prefixes: token.Prefixes,
+		}
+		for _, scope := range token.Scopes {
+			switch scope {
+			case ScopeRead, ScopeWrite, ScopeAdmin:
+				principal.scopes[scope] = struct{}{}
+			default:
+				return nil, fmt.Errorf("token %q has unknown scope %q", token.Name, scope)
+			}
+		}
+
+		hash := sha256.Sum256([]byte(token.Token))
+		if _, ok := a.principals[hash]; ok {
+			return nil, fmt.Errorf("token %q is duplicated", token.Name)
+		}
+		a.principals[hash] = principal
+	}
+
+	return a, nil
+}
+
+func Load(path string) (*Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tokensFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	return New(file.Tokens)
+}
+
+// Authenticate returns principal for the bearer token in the Authorization header value, or nil.
+func (a *Authenticator) Authenticate(authorization string) *Principal {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || token == "" {
+		return nil
+	}
+
+	return a.principals[sha256.Sum256([]byte(token))]
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns request principal, or nil if authentication is disabled.
+func FromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// AllowsMetric reports whether the request principal may access the metrics.
+// It allows everything if authentication is disabled.
+func AllowsMetric(ctx context.Context, name string) bool {
+	principal := FromContext(ctx)
+	return principal == nil || principal.AllowsMetric(name)
+}
+
+// AllowsAllMetrics reports whether the request principal may access any metrics.
+func AllowsAllMetrics(ctx context.Context) bool {
+	principal := FromContext(ctx)
+	return principal == nil || len(principal.prefixes) == 0
+}
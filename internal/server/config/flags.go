@@ -2,6 +2,9 @@ package config
 
 import (
 	"flag"
+	"fmt"
+	"net"
+	"regexp"
 
 	"github.com/SamMeown/metrix/internal/utils/config_utils"
 )
@@ -13,6 +16,64 @@ type Config struct {
 	StoragePath   string
 	Restore       bool
 	SignKey       string
+	CryptoKey     string
+	// CryptoRequired rejects requests with cleartext bodies when CryptoKey is set
+	CryptoRequired bool
+	TokensFile     string
+
+	TrustedSubnets []*net.IPNet
+	TrustedProxies []*net.IPNet
+
+	SignPolicy             string
+	SignKeysFile           string
+	SignKeysReloadInterval int
+
+	SignMaxSkew        int
+	SignNonceCacheSize int
+	SignAcceptLegacy   bool
+
+	ShutdownTimeout int
+
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	MetricNamePattern   string
+	MetricNameMaxLength int
+	MaxSeries           int
+	MaxAgentSeries      int
+	AgentSeriesTTL      int
+
+	RateLimit    float64
+	RateBurst    int
+	RateLimitKey string
+	MaxBodySize  int
+	// MaxImportSize replaces MaxBodySize for /import, which takes whole storage dumps
+	MaxImportSize int
+
+	IdempotencyTTL       int
+	IdempotencyCacheSize int
+
+	HistoryInterval int
+	HistorySize     int
+
+	AlertRulesFile    string
+	AlertEvalInterval int
+	AlertStateFile    string
+
+	NotifyReceiversFile string
+
+	DerivedRulesFile string
+	DerivedInterval  int
+
+	MetadataFile string
+}
+
+func parseCIDRs(dst *[]*net.IPNet) func(string) error {
+	return func(value string) (err error) {
+		*dst, err = configutils.ParseCIDRList(value)
+		return
+	}
 }
 
 func Parse() (config Config) {
@@ -22,6 +83,43 @@ func Parse() (config Config) {
 	flag.StringVar(&config.StoragePath, "f", "/tmp/metrics-db.json", "storage dump file path")
 	flag.BoolVar(&config.Restore, "r", true, "should restore from saved dump on start")
 	flag.StringVar(&config.SignKey, "k", "", "signature key")
+	flag.StringVar(&config.SignPolicy, "sign-policy", "permissive", "request signature policy: off, permissive (let unsigned requests through) or enforce")
+	flag.StringVar(&config.SignKeysFile, "keys-file", "", "signature keys file, replaces signature key")
+	flag.IntVar(&config.SignKeysReloadInterval, "keys-reload-interval", 30, "interval in seconds to check signature keys file for changes, 0 to load it once")
+	flag.IntVar(&config.SignMaxSkew, "sign-max-skew", 300, "max clock skew in seconds for signed requests, 0 disables replay protection")
+	flag.IntVar(&config.SignNonceCacheSize, "sign-nonce-cache", 100000, "max number of remembered signed request nonces, more requests within the skew window are rejected")
+	flag.BoolVar(&config.SignAcceptLegacy, "sign-accept-legacy", false, "accept replayable signatures without timestamp and nonce, only while migrating agents")
+	flag.Func("t", "comma separated CIDRs agents may send updates from", parseCIDRs(&config.TrustedSubnets))
+	flag.Func("trusted-proxies", "comma separated CIDRs of proxies whose X-Real-IP header is trusted", parseCIDRs(&config.TrustedProxies))
+	flag.StringVar(&config.TokensFile, "tokens-file", "", "API tokens file, enables token authentication")
+	flag.StringVar(&config.CryptoKey, "crypto-key", "", "private key file to decrypt agent requests with")
+	flag.BoolVar(&config.CryptoRequired, "crypto-required", false, "reject requests with unencrypted bodies, requires crypto-key")
+	flag.IntVar(&config.ShutdownTimeout, "shutdown-timeout", 10, "time in seconds to wait for in-flight requests on shutdown")
+	flag.StringVar(&config.TLSCertFile, "tls-cert", "", "TLS certificate file, enables HTTPS")
+	flag.StringVar(&config.TLSKeyFile, "tls-key", "", "TLS private key file")
+	flag.StringVar(&config.TLSClientCAFile, "tls-client-ca", "", "CA file to verify agent certificates with, enables mutual TLS")
+	flag.StringVar(&config.MetricNamePattern, "name-pattern", "", "regexp metrics names must match")
+	flag.IntVar(&config.MetricNameMaxLength, "name-max-length", 255, "max metrics name length in bytes, 0 for no limit")
+	flag.IntVar(&config.MaxSeries, "max-series", 0, "max number of distinct metrics series, 0 for no limit")
+	flag.IntVar(&config.MaxAgentSeries, "max-agent-series", 0, "max number of distinct metrics series per agent, 0 for no limit")
+	flag.IntVar(&config.AgentSeriesTTL, "agent-series-ttl", 3600, "time in seconds after which series of an idle agent stop counting against its limit, 0 to keep them")
+	flag.Float64Var(&config.RateLimit, "rate-limit", 0, "max requests per second per client, 0 for no limit")
+	flag.IntVar(&config.RateBurst, "rate-burst", 50, "max burst of requests per client")
+	flag.StringVar(&config.RateLimitKey, "rate-limit-key", "ip", "what identifies a client for rate limiting: ip, agent or token. "+
+		"agent uses the X-Agent-ID header clients set themselves, so clients can get around the limit by changing it")
+	flag.IntVar(&config.MaxBodySize, "max-body-size", 8<<20, "max request body size in bytes after decompression, 0 for no limit")
+	flag.IntVar(&config.MaxImportSize, "max-import-size", 1<<30, "max /import body size in bytes after decompression, 0 for no limit")
+	flag.IntVar(&config.IdempotencyTTL, "idempotency-ttl", 86400, "time in seconds to remember idempotency keys of batch updates")
+	flag.IntVar(&config.IdempotencyCacheSize, "idempotency-cache", 100000, "max number of idempotency keys remembered in memory")
+	flag.IntVar(&config.HistoryInterval, "history-interval", 10, "time interval in seconds to sample metrics history, 0 to disable")
+	flag.IntVar(&config.HistorySize, "history-size", 120, "number of history points kept for every metrics")
+	flag.StringVar(&config.AlertRulesFile, "alert-rules", "", "alert rules file, enables alerting")
+	flag.IntVar(&config.AlertEvalInterval, "alert-interval", 15, "time interval in seconds to evaluate alert rules")
+	flag.StringVar(&config.AlertStateFile, "alert-state", "", "alert states file, defaults to the storage dump path with .alerts suffix")
+	flag.StringVar(&config.DerivedRulesFile, "derived-rules", "", "recording rules file of metrics derived from other metrics")
+	flag.IntVar(&config.DerivedInterval, "derived-interval", 10, "time interval in seconds to compute derived metrics")
+	flag.StringVar(&config.NotifyReceiversFile, "notify-receivers", "", "webhook receivers file to notify of alert state changes")
+	flag.StringVar(&config.MetadataFile, "metadata", "", "metrics metadata file, defaults to the storage dump path with .meta suffix")
 	flag.Parse()
 
 	if envAddress, ok := configutils.LookupEnvString("ADDRESS"); ok {
@@ -48,5 +146,189 @@ func Parse() (config Config) {
 		config.SignKey = envKey
 	}
 
+	if envSignPolicy, ok := configutils.LookupEnvString("SIGN_POLICY"); ok {
+		config.SignPolicy = envSignPolicy
+	}
+
+	if envKeysFile, ok := configutils.LookupEnvString("KEYS_FILE"); ok {
+		config.SignKeysFile = envKeysFile
+	}
+
+	if envKeysReloadInterval, ok := configutils.LookupEnvInt("KEYS_RELOAD_INTERVAL"); ok {
+		config.SignKeysReloadInterval = envKeysReloadInterval
+	}
+
+	if envSignMaxSkew, ok := configutils.LookupEnvInt("SIGN_MAX_SKEW"); ok {
+		config.SignMaxSkew = envSignMaxSkew
+	}
+
+	if envSignNonceCacheSize, ok := configutils.LookupEnvInt("SIGN_NONCE_CACHE_SIZE"); ok {
+		config.SignNonceCacheSize = envSignNonceCacheSize
+	}
+
+	if envSignAcceptLegacy, ok := configutils.LookupEnvBool("SIGN_ACCEPT_LEGACY"); ok {
+		config.SignAcceptLegacy = envSignAcceptLegacy
+	}
+
+	if envTrustedSubnets, ok := configutils.LookupEnvString("TRUSTED_SUBNET"); ok {
+		if err := parseCIDRs(&config.TrustedSubnets)(envTrustedSubnets); err != nil {
+			panic(err)
+		}
+	}
+
+	if envTrustedProxies, ok := configutils.LookupEnvString("TRUSTED_PROXIES"); ok {
+		if err := parseCIDRs(&config.TrustedProxies)(envTrustedProxies); err != nil {
+			panic(err)
+		}
+	}
+
+	if envTokensFile, ok := configutils.LookupEnvString("TOKENS_FILE"); ok {
+		config.TokensFile = envTokensFile
+	}
+
+	if envCryptoKey, ok := configutils.LookupEnvString("CRYPTO_KEY"); ok {
+		config.CryptoKey = envCryptoKey
+	}
+
+	if envCryptoRequired, ok := configutils.LookupEnvBool("CRYPTO_REQUIRED"); ok {
+		config.CryptoRequired = envCryptoRequired
+	}
+
+	if envShutdownTimeout, ok := configutils.LookupEnvInt("SHUTDOWN_TIMEOUT"); ok {
+		config.ShutdownTimeout = envShutdownTimeout
+	}
+
+	if envTLSCertFile, ok := configutils.LookupEnvString("TLS_CERT_FILE"); ok {
+		config.TLSCertFile = envTLSCertFile
+	}
+
+	if envTLSKeyFile, ok := configutils.LookupEnvString("TLS_KEY_FILE"); ok {
+		config.TLSKeyFile = envTLSKeyFile
+	}
+
+	if envTLSClientCAFile, ok := configutils.LookupEnvString("TLS_CLIENT_CA_FILE"); ok {
+		config.TLSClientCAFile = envTLSClientCAFile
+	}
+
+	if envNamePattern, ok := configutils.LookupEnvString("METRIC_NAME_PATTERN"); ok {
+		config.MetricNamePattern = envNamePattern
+	}
+
+	if envNameMaxLength, ok := configutils.LookupEnvInt("METRIC_NAME_MAX_LENGTH"); ok {
+		config.MetricNameMaxLength = envNameMaxLength
+	}
+
+	if envMaxSeries, ok := configutils.LookupEnvInt("MAX_SERIES"); ok {
+		config.MaxSeries = envMaxSeries
+	}
+
+	if envMaxAgentSeries, ok := configutils.LookupEnvInt("MAX_AGENT_SERIES"); ok {
+		config.MaxAgentSeries = envMaxAgentSeries
+	}
+
+	if envAgentSeriesTTL, ok := configutils.LookupEnvInt("AGENT_SERIES_TTL"); ok {
+		config.AgentSeriesTTL = envAgentSeriesTTL
+	}
+
+	if envRateLimit, ok := configutils.LookupEnvFloat("REQUEST_RATE_LIMIT"); ok {
+		config.RateLimit = envRateLimit
+	}
+
+	if envRateBurst, ok := configutils.LookupEnvInt("REQUEST_RATE_BURST"); ok {
+		config.RateBurst = envRateBurst
+	}
+
+	if envRateLimitKey, ok := configutils.LookupEnvString("REQUEST_RATE_LIMIT_KEY"); ok {
+		config.RateLimitKey = envRateLimitKey
+	}
+
+	if envMaxBodySize, ok := configutils.LookupEnvInt("MAX_BODY_SIZE"); ok {
+		config.MaxBodySize = envMaxBodySize
+	}
+
+	if envMaxImportSize, ok := configutils.LookupEnvInt("MAX_IMPORT_SIZE"); ok {
+		config.MaxImportSize = envMaxImportSize
+	}
+
+	if envIdempotencyTTL, ok := configutils.LookupEnvInt("IDEMPOTENCY_TTL"); ok {
+		config.IdempotencyTTL = envIdempotencyTTL
+	}
+
+	if envIdempotencyCacheSize, ok := configutils.LookupEnvInt("IDEMPOTENCY_CACHE_SIZE"); ok {
+		config.IdempotencyCacheSize = envIdempotencyCacheSize
+	}
+
+	if envHistoryInterval, ok := configutils.LookupEnvInt("HISTORY_INTERVAL"); ok {
+		config.HistoryInterval = envHistoryInterval
+	}
+
+	if envHistorySize, ok := configutils.LookupEnvInt("HISTORY_SIZE"); ok {
+		config.HistorySize = envHistorySize
+	}
+
+	if envAlertRulesFile, ok := configutils.LookupEnvString("ALERT_RULES_FILE"); ok {
+		config.AlertRulesFile = envAlertRulesFile
+	}
+
+	if envAlertEvalInterval, ok := configutils.LookupEnvInt("ALERT_EVAL_INTERVAL"); ok {
+		config.AlertEvalInterval = envAlertEvalInterval
+	}
+
+	if envAlertStateFile, ok := configutils.LookupEnvString("ALERT_STATE_FILE"); ok {
+		config.AlertStateFile = envAlertStateFile
+	}
+
+	if envNotifyReceiversFile, ok := configutils.LookupEnvString("NOTIFY_RECEIVERS_FILE"); ok {
+		config.NotifyReceiversFile = envNotifyReceiversFile
+	}
+
+	if envDerivedRulesFile, ok := configutils.LookupEnvString("DERIVED_RULES_FILE"); ok {
+		config.DerivedRulesFile = envDerivedRulesFile
+	}
+
+	if envDerivedInterval, ok := configutils.LookupEnvInt("DERIVED_INTERVAL"); ok {
+		config.DerivedInterval = envDerivedInterval
+	}
+
+	if envMetadataFile, ok := configutils.LookupEnvString("METADATA_FILE"); ok {
+		config.MetadataFile = envMetadataFile
+	}
+
+	if config.AlertStateFile == "" && config.StoragePath != "" {
+		config.AlertStateFile = config.StoragePath + ".alerts"
+	}
+
+	if config.MetadataFile == "" && config.StoragePath != "" {
+		config.MetadataFile = config.StoragePath + ".meta"
+	}
+
+	if _, err := regexp.Compile(config.MetricNamePattern); err != nil {
+		panic(err)
+	}
+
+	switch config.SignPolicy {
+	case "off", "permissive", "enforce":
+	default:
+		panic(fmt.Sprintf("unknown sign policy %q", config.SignPolicy))
+	}
+
+	// Otherwise the server would silently serve plain HTTP
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		panic("tls-cert and tls-key must be set together")
+	}
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		panic("tls-client-ca needs tls-cert and tls-key to be set")
+	}
+
+	if config.CryptoRequired && config.CryptoKey == "" {
+		panic("crypto-required needs crypto-key to be set")
+	}
+
+	switch config.RateLimitKey {
+	case "ip", "agent", "token":
+	default:
+		panic(fmt.Sprintf("unknown rate limit key %q", config.RateLimitKey))
+	}
+
 	return
 }
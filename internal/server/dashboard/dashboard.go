@@ -0,0 +1,38 @@
+// Package dashboard serves the web UI. It is a static page reading metrics from the JSON API.
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/SamMeown/metrix/internal/logger"
+)
+
+//go:embed static
+var static embed.FS
+
+// Assets serves the dashboard scripts and styles. Mount it with the prefix stripped.
+func Assets() http.Handler {
+	assets, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	return http.FileServer(http.FS(assets))
+}
+
+// Index serves the dashboard page.
+func Index(res http.ResponseWriter, req *http.Request) {
+	page, err := static.ReadFile("static/index.html")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(http.StatusOK)
+	if _, err := res.Write(page); err != nil {
+		logger.Log.Errorf("Failed to write response body")
+	}
+}
@@ -0,0 +1,200 @@
+"use strict";
+
+(function () {
+  const tokenKey = "metrix.token";
+
+  const state = {
+    metrics: [],
+    sortKey: "id",
+    sortDir: 1,
+    timer: null,
+  };
+
+  const el = {
+    filter: document.getElementById("filter"),
+    type: document.getElementById("type"),
+    autorefresh: document.getElementById("autorefresh"),
+    interval: document.getElementById("interval"),
+    refresh: document.getElementById("refresh"),
+    status: document.getElementById("status"),
+    body: document.getElementById("metrics"),
+    headers: document.querySelectorAll("th[data-sort]"),
+  };
+
+  function setStatus(text, isError) {
+    el.status.textContent = text;
+    el.status.classList.toggle("error", Boolean(isError));
+  }
+
+  async function fetchMetrics() {
+    const headers = { Accept: "application/json" };
+    const token = localStorage.getItem(tokenKey);
+    if (token) {
+      headers.Authorization = "Bearer " + token;
+    }
+
+    const response = await fetch("/api/metrics", { headers: headers });
+    if (response.status === 401 || response.status === 403) {
+      const entered = window.prompt("API token with read scope:", token || "");
+      if (entered) {
+        localStorage.setItem(tokenKey, entered);
+        return fetchMetrics();
+      }
+    }
+    if (!response.ok) {
+      let message = response.status + " " + response.statusText;
+      try {
+        message = (await response.json()).error.message;
+      } catch (e) {
+        // not a JSON error
+      }
+      throw new Error(message);
+    }
+
+    return (await response.json()).metrics;
+  }
+
+  async function refresh() {
+    try {
+      state.metrics = await fetchMetrics();
+      setStatus("Updated at " + new Date().toLocaleTimeString());
+      render();
+    } catch (e) {
+      setStatus("Failed to load metrics: " + e.message, true);
+    }
+  }
+
+  function compare(a, b) {
+    const x = a[state.sortKey];
+    const y = b[state.sortKey];
+    if (typeof x === "number" && typeof y === "number") {
+      return (x - y) * state.sortDir;
+    }
+    return String(x).localeCompare(String(y)) * state.sortDir || a.id.localeCompare(b.id);
+  }
+
+  function formatValue(metrics) {
+    if (metrics.type === "counter") {
+      return metrics.value.toLocaleString();
+    }
+    return String(metrics.value);
+  }
+
+  function sparkline(points) {
+    const svgNS = "http://www.w3.org/2000/svg";
+    const width = 160;
+    const height = 28;
+    const svg = document.createElementNS(svgNS, "svg");
+    svg.setAttribute("class", "sparkline");
+    svg.setAttribute("viewBox", "0 0 " + width + " " + height);
+    if (!points || points.length < 2) {
+      return svg;
+    }
+
+    const values = points.map(function (p) { return p.v; });
+    const min = Math.min.apply(null, values);
+    const max = Math.max.apply(null, values);
+    const span = max - min || 1;
+    const coords = values.map(function (v, i) {
+      const x = (i / (values.length - 1)) * width;
+      const y = height - 2 - ((v - min) / span) * (height - 4);
+      return x.toFixed(1) + "," + y.toFixed(1);
+    });
+
+    const line = document.createElementNS(svgNS, "polyline");
+    line.setAttribute("points", coords.join(" "));
+    svg.appendChild(line);
+
+    const title = document.createElementNS(svgNS, "title");
+    title.textContent = "min " + min + ", max " + max + " over " + points.length + " samples";
+    svg.appendChild(title);
+
+    return svg;
+  }
+
+  function render() {
+    const filter = el.filter.value.trim().toLowerCase();
+    const type = el.type.value;
+
+    const rows = state.metrics
+      .filter(function (m) {
+        return (!type || m.type === type) && (!filter || m.id.toLowerCase().includes(filter));
+      })
+      .sort(compare)
+      .map(function (m) {
+        const row = document.createElement("tr");
+
+        const name = document.createElement("td");
+        name.textContent = m.id;
+        if (m.help) {
+          name.title = m.help;
+          name.className = "described";
+        }
+        row.appendChild(name);
+
+        const mtype = document.createElement("td");
+        mtype.className = "type";
+        mtype.textContent = m.type;
+        if (m.expectedType) {
+          const conflict = document.createElement("span");
+          conflict.className = "conflict";
+          conflict.textContent = "expected " + m.expectedType;
+          conflict.title = m.id + " is reported both as " + m.type + " and " + m.expectedType;
+          mtype.appendChild(conflict);
+        }
+        row.appendChild(mtype);
+
+        const value = document.createElement("td");
+        value.className = "number";
+        value.textContent = formatValue(m);
+        if (m.unit) {
+          const unit = document.createElement("span");
+          unit.className = "unit";
+          unit.textContent = m.unit;
+          value.appendChild(unit);
+        }
+        row.appendChild(value);
+
+        const history = document.createElement("td");
+        history.appendChild(sparkline(m.history));
+        row.appendChild(history);
+
+        return row;
+      });
+
+    el.body.replaceChildren.apply(el.body, rows);
+
+    el.headers.forEach(function (th) {
+      th.classList.toggle("asc", th.dataset.sort === state.sortKey && state.sortDir > 0);
+      th.classList.toggle("desc", th.dataset.sort === state.sortKey && state.sortDir < 0);
+    });
+  }
+
+  function schedule() {
+    clearInterval(state.timer);
+    state.timer = null;
+    if (el.autorefresh.checked) {
+      state.timer = setInterval(refresh, Number(el.interval.value) * 1000);
+    }
+  }
+
+  el.headers.forEach(function (th) {
+    th.addEventListener("click", function () {
+      if (state.sortKey === th.dataset.sort) {
+        state.sortDir = -state.sortDir;
+      } else {
+        state.sortKey = th.dataset.sort;
+        state.sortDir = 1;
+      }
+      render();
+    });
+  });
+  el.filter.addEventListener("input", render);
+  el.type.addEventListener("change", render);
+  el.autorefresh.addEventListener("change", schedule);
+  el.interval.addEventListener("change", schedule);
+  el.refresh.addEventListener("click", refresh);
+
+  refresh();
+  schedule();
+})();
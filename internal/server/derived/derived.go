@@ -0,0 +1,151 @@
+// Package derived computes gauges from other metrics with recording rules.
+package derived
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/server/expr"
+	"github.com/SamMeown/metrix/internal/storage"
+)
+
+// Rule is an entry of the rules file, e.g.
+//
+//	{"rules": [{"name": "HeapUtil", "expr": "HeapInuse / HeapSys"}]}
+//
+// The expression must give a single value, which is stored as a gauge with the rule name.
+// Rules see results of the rules above them.
+type Rule struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+
+	node expr.Node
+}
+
+type rulesFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+func ParseRule(name, expression string) (Rule, error) {
+	if name == "" {
+		return Rule{}, fmt.Errorf("rule %q has no name", expression)
+	}
+
+	node, err := expr.Parse(expression)
+	if err != nil {
+		return Rule{}, fmt.Errorf("rule %s: %w", name, err)
+	}
+
+	return Rule{Name: name, Expr: expression, node: node}, nil
+}
+
+func Load(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file rulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]struct{}, len(file.Rules))
+	rules := make([]Rule, 0, len(file.Rules))
+	for _, r := range file.Rules {
+		if _, ok := names[r.Name]; ok {
+			return nil, fmt.Errorf("duplicate rule %s", r.Name)
+		}
+		names[r.Name] = struct{}{}
+
+		rule, err := ParseRule(r.Name, r.Expr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+type Recorder struct {
+	rules    []Rule
+	mStorage storage.MetricsStorage
+}
+
+func NewRecorder(rules []Rule, mStorage storage.MetricsStorage) *Recorder {
+	return &Recorder{
+		rules:    rules,
+		mStorage: mStorage,
+	}
+}
+
+// Eval evaluates all rules once and stores the results. Rules without data are skipped.
+func (r *Recorder) Eval(ctx context.Context) error {
+	items, err := r.mStorage.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	if items.Gauges == nil {
+		items.Gauges = make(map[string]float64)
+	}
+
+	results := storage.MetricsStorageItems{
+		Gauges:   make(map[string]float64, len(r.rules)),
+		Counters: make(map[string]int64),
+	}
+	evaluator := &expr.Evaluator{Items: items}
+	var errs []error
+	for _, rule := range r.rules {
+		value, err := evaluator.Eval(rule.node)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.Name, err))
+			continue
+		}
+
+		single, ok, err := expr.Single(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.Name, err))
+			continue
+		}
+		if !ok || math.IsNaN(single) || math.IsInf(single, 0) {
+			logger.Log.Debugf("Rule %s has no value", rule.Name)
+			continue
+		}
+
+		results.Gauges[rule.Name] = single
+		items.Gauges[rule.Name] = single
+	}
+
+	if len(results.Gauges) > 0 {
+		if err := r.mStorage.SetMany(ctx, results); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Run evaluates rules every interval until ctx is done.
+func (r *Recorder) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.Eval(ctx); err != nil {
+			logger.Log.Errorf("Failed to evaluate derived metrics: %s", err)
+		}
+	}
+}
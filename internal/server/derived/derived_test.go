@@ -0,0 +1,75 @@
+package derived
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SamMeown/metrix/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(rulesPath, []byte(`{"rules": [
+		{"name": "HeapUtil", "expr": "HeapInuse / HeapSys"},
+		{"name": "HeapUtilPercent", "expr": "HeapUtil * 100"},
+		{"name": "FreeMemoryRatio", "expr": "FreeMemory / TotalMemory"},
+		{"name": "TotalAlloc", "expr": "sum({name=~\"^Alloc\\\\.\"})"},
+		{"name": "Broken", "expr": "{name=~\"^Alloc\\\\.\"} * 2"},
+		{"name": "Missing", "expr": "NoSuchMetrics + 1"}
+	]}`), 0600))
+
+	rules, err := Load(rulesPath)
+	require.NoError(t, err)
+
+	mStorage := storage.New()
+	require.NoError(t, mStorage.SetMany(ctx, storage.MetricsStorageItems{
+		Gauges: map[string]float64{
+			"HeapInuse":   50,
+			"HeapSys":     200,
+			"FreeMemory":  1,
+			"TotalMemory": 0,
+			"Alloc.a":     1,
+			"Alloc.b":     2,
+		},
+		Counters: map[string]int64{},
+	}))
+
+	err = NewRecorder(rules, mStorage).Eval(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rule Broken")
+
+	items, err := mStorage.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0.25, items.Gauges["HeapUtil"])
+	assert.Equal(t, 25.0, items.Gauges["HeapUtilPercent"], "results of rules above are used")
+	assert.Equal(t, 3.0, items.Gauges["TotalAlloc"])
+	assert.NotContains(t, items.Gauges, "FreeMemoryRatio", "infinity is not stored")
+	assert.NotContains(t, items.Gauges, "Broken")
+	assert.NotContains(t, items.Gauges, "Missing")
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{"test bad expression", `{"rules": [{"name": "a", "expr": "b +"}]}`},
+		{"test no name", `{"rules": [{"expr": "b"}]}`},
+		{"test duplicate", `{"rules": [{"name": "a", "expr": "b"}, {"name": "a", "expr": "c"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rulesPath := filepath.Join(t.TempDir(), "rules.json")
+			require.NoError(t, os.WriteFile(rulesPath, []byte(tt.rules), 0600))
+
+			_, err := Load(rulesPath)
+			assert.Error(t, err)
+		})
+	}
+}
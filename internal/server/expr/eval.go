@@ -0,0 +1,454 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/server/history"
+	"github.com/SamMeown/metrix/internal/storage"
+	"golang.org/x/exp/maps"
+)
+
+// Value is a result of evaluation, either Scalar, Vector or Matrix.
+type Value interface {
+	Type() string
+}
+
+type Scalar float64
+
+// Sample is a value of a series. Selected samples are labeled with metrics name and type,
+// arithmetic on two vectors drops these labels as results are not stored series anymore.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type Vector []Sample
+
+// Series is recent history of a series.
+type Series struct {
+	Labels map[string]string
+	Points []history.Point
+}
+
+type Matrix []Series
+
+func (Scalar) Type() string { return "scalar" }
+func (Vector) Type() string { return "vector" }
+func (Matrix) Type() string { return "matrix" }
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// signature identifies labels of a sample except name and type
+func signature(labels map[string]string) string {
+	keys := maps.Keys(labels)
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		if key == LabelName || key == LabelType {
+			continue
+		}
+		b.WriteString(strconv.Quote(key))
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[key]))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+func dropSeriesLabels(labels map[string]string) map[string]string {
+	rv := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if key != LabelName && key != LabelType {
+			rv[key] = value
+		}
+	}
+	return rv
+}
+
+type function struct {
+	aggregation bool
+	// rangeArg functions take a matrix selector
+	rangeArg bool
+	args     int
+	eval     func(e *Evaluator, call *Call) (Value, error)
+}
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"sum":           {aggregation: true, args: 1, eval: aggregate(sumOf)},
+		"avg":           {aggregation: true, args: 1, eval: aggregate(avgOf)},
+		"min":           {aggregation: true, args: 1, eval: aggregate(func(values []float64) float64 { return extremum(values, math.Min) })},
+		"max":           {aggregation: true, args: 1, eval: aggregate(func(values []float64) float64 { return extremum(values, math.Max) })},
+		"count":         {aggregation: true, args: 1, eval: aggregate(func(values []float64) float64 { return float64(len(values)) })},
+		"abs":           {args: 1, eval: mapSamples(math.Abs)},
+		"rate":          {rangeArg: true, args: 1, eval: overTime(history.Rate)},
+		"increase":      {rangeArg: true, args: 1, eval: overTime(history.Increase)},
+		"avg_over_time": {rangeArg: true, args: 1, eval: overTime(valuesOf(avgOf))},
+		"min_over_time": {rangeArg: true, args: 1, eval: overTime(valuesOf(func(values []float64) float64 { return extremum(values, math.Min) }))},
+		"max_over_time": {rangeArg: true, args: 1, eval: overTime(valuesOf(func(values []float64) float64 { return extremum(values, math.Max) }))},
+	}
+}
+
+func checkCall(call *Call) error {
+	f := functions[call.Func]
+	if len(call.Args) != f.args {
+		return fmt.Errorf("%s expects %d arguments, got %d", call.Func, f.args, len(call.Args))
+	}
+	if call.Grouping != nil && !f.aggregation {
+		return fmt.Errorf("%s is not an aggregation to group by", call.Func)
+	}
+	if _, ok := call.Args[0].(*MatrixSelector); ok != f.rangeArg {
+		if f.rangeArg {
+			return fmt.Errorf("%s expects a range selector like %s[5m]", call.Func, call.Args[0])
+		}
+		return fmt.Errorf("range selector is allowed in range functions only, not in %s", call.Func)
+	}
+	return nil
+}
+
+func sumOf(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func avgOf(values []float64) float64 {
+	return sumOf(values) / float64(len(values))
+}
+
+func extremum(values []float64, pick func(a, b float64) float64) float64 {
+	rv := values[0]
+	for _, v := range values[1:] {
+		rv = pick(rv, v)
+	}
+	return rv
+}
+
+func (e *Evaluator) evalVector(node Node, context string) (Vector, error) {
+	value, err := e.eval(node)
+	if err != nil {
+		return nil, err
+	}
+	vector, ok := value.(Vector)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a vector, got %s", context, value.Type())
+	}
+	return vector, nil
+}
+
+// aggregate reduces samples having the same grouping labels to one. Aggregating nothing gives nothing.
+func aggregate(reduce func(values []float64) float64) func(e *Evaluator, call *Call) (Value, error) {
+	return func(e *Evaluator, call *Call) (Value, error) {
+		vector, err := e.evalVector(call.Args[0], call.Func)
+		if err != nil {
+			return nil, err
+		}
+
+		type group struct {
+			labels map[string]string
+			values []float64
+		}
+		groups := make(map[string]*group)
+		var order []string
+		for _, s := range vector {
+			labels := make(map[string]string, len(call.Grouping))
+			for _, label := range call.Grouping {
+				if value, ok := s.Labels[label]; ok {
+					labels[label] = value
+				}
+			}
+
+			key := signature(labels) + "," + strconv.Quote(labels[LabelName]) + "," + strconv.Quote(labels[LabelType])
+			g, ok := groups[key]
+			if !ok {
+				g = &group{labels: labels}
+				groups[key] = g
+				order = append(order, key)
+			}
+			g.values = append(g.values, s.Value)
+		}
+
+		rv := make(Vector, 0, len(groups))
+		for _, key := range order {
+			g := groups[key]
+			rv = append(rv, Sample{Labels: g.labels, Value: reduce(g.values)})
+		}
+		sortVector(rv)
+		return rv, nil
+	}
+}
+
+func valuesOf(reduce func(values []float64) float64) func(points []history.Point, counter bool) (float64, bool) {
+	return func(points []history.Point, counter bool) (float64, bool) {
+		if len(points) == 0 {
+			return 0, false
+		}
+
+		values := make([]float64, len(points))
+		for i, p := range points {
+			values[i] = p.Value
+		}
+		return reduce(values), true
+	}
+}
+
+// overTime reduces history of every series to a value. Series without enough history are skipped.
+func overTime(reduce func(points []history.Point, counter bool) (float64, bool)) func(e *Evaluator, call *Call) (Value, error) {
+	return func(e *Evaluator, call *Call) (Value, error) {
+		matrix := e.selectHistory(call.Args[0].(*MatrixSelector))
+
+		rv := Vector{}
+		for _, series := range matrix {
+			value, ok := reduce(series.Points, series.Labels[LabelType] == storage.MetricsTypeCounter)
+			if ok {
+				rv = append(rv, Sample{Labels: series.Labels, Value: value})
+			}
+		}
+		return rv, nil
+	}
+}
+
+func mapSamples(fn func(float64) float64) func(e *Evaluator, call *Call) (Value, error) {
+	return func(e *Evaluator, call *Call) (Value, error) {
+		value, err := e.eval(call.Args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := value.(type) {
+		case Scalar:
+			return Scalar(fn(float64(v))), nil
+		default:
+			vector := v.(Vector)
+			rv := make(Vector, len(vector))
+			for i, s := range vector {
+				rv[i] = Sample{Labels: s.Labels, Value: fn(s.Value)}
+			}
+			return rv, nil
+		}
+	}
+}
+
+// Evaluator evaluates expressions against a snapshot of stored metrics.
+// Range selectors read history recorded up to Now. If Allow is set, only series it allows are selected.
+type Evaluator struct {
+	Items   storage.MetricsStorageItems
+	History *history.Recorder
+	Now     time.Time
+	Allow   func(name string) bool
+
+	depth int
+}
+
+func (e *Evaluator) Eval(node Node) (Value, error) {
+	return e.eval(node)
+}
+
+func (e *Evaluator) eval(node Node) (Value, error) {
+	// A tree parsed from an expression within MaxLength is never deeper
+	e.depth++
+	defer func() { e.depth-- }()
+	if e.depth > MaxLength {
+		return nil, fmt.Errorf("expression is too deep")
+	}
+
+	switch n := node.(type) {
+	case *NumberLiteral:
+		return Scalar(n.Value), nil
+	case *ParenExpr:
+		return e.eval(n.Expr)
+	case *UnaryExpr:
+		return e.eval(&BinaryExpr{Op: "*", LHS: &NumberLiteral{Value: -1}, RHS: n.Operand})
+	case *Selector:
+		return e.selectSeries(n), nil
+	case *MatrixSelector:
+		return e.selectHistory(n), nil
+	case *Call:
+		return functions[n.Func].eval(e, n)
+	case *BinaryExpr:
+		lhs, err := e.eval(n.LHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := e.eval(n.RHS)
+		if err != nil {
+			return nil, err
+		}
+		return binary(n.Op, lhs, rhs)
+	default:
+		return nil, fmt.Errorf("unexpected expression %s", node)
+	}
+}
+
+func (e *Evaluator) selectSeries(selector *Selector) Vector {
+	rv := Vector{}
+	add := func(name, mType string, value float64) {
+		if e.Allow != nil && !e.Allow(name) {
+			return
+		}
+		labels := map[string]string{LabelName: name, LabelType: mType}
+		for _, m := range selector.Matchers {
+			if !m.Matches(labels[m.Label]) {
+				return
+			}
+		}
+		rv = append(rv, Sample{Labels: labels, Value: value})
+	}
+	for name, value := range e.Items.Gauges {
+		add(name, storage.MetricsTypeGauge, value)
+	}
+	for name, value := range e.Items.Counters {
+		add(name, storage.MetricsTypeCounter, float64(value))
+	}
+
+	sortVector(rv)
+	return rv
+}
+
+// selectHistory returns history of the selected series within the range. Series without history are skipped.
+func (e *Evaluator) selectHistory(selector *MatrixSelector) Matrix {
+	rv := Matrix{}
+	if e.History == nil {
+		return rv
+	}
+
+	for _, s := range e.selectSeries(selector.Selector) {
+		key := history.Key{MType: s.Labels[LabelType], Name: s.Labels[LabelName]}
+		points := e.History.Range(key, e.Now.Add(-selector.Range), e.Now)
+		if len(points) > 0 {
+			rv = append(rv, Series{Labels: s.Labels, Points: points})
+		}
+	}
+	return rv
+}
+
+func sortVector(v Vector) {
+	sort.Slice(v, func(i, j int) bool {
+		a, b := v[i].Labels, v[j].Labels
+		if a[LabelName] != b[LabelName] {
+			return a[LabelName] < b[LabelName]
+		}
+		if a[LabelType] != b[LabelType] {
+			return a[LabelType] < b[LabelType]
+		}
+		return signature(a) < signature(b)
+	})
+}
+
+func apply(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	default:
+		return a / b
+	}
+}
+
+// binary applies op to scalars, to every sample of a vector and a scalar,
+// or to samples of two vectors having the same labels apart from name and type.
+func binary(op string, lhs, rhs Value) (Value, error) {
+	for _, v := range []Value{lhs, rhs} {
+		if _, ok := v.(Matrix); ok {
+			return nil, fmt.Errorf("range selector can't be an operand of %q", op)
+		}
+	}
+
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			return Scalar(apply(op, float64(l), float64(r))), nil
+		default:
+			vector := r.(Vector)
+			rv := make(Vector, len(vector))
+			for i, s := range vector {
+				rv[i] = Sample{Labels: s.Labels, Value: apply(op, float64(l), s.Value)}
+			}
+			return rv, nil
+		}
+	default:
+		lv := l.(Vector)
+		if r, ok := rhs.(Scalar); ok {
+			rv := make(Vector, len(lv))
+			for i, s := range lv {
+				rv[i] = Sample{Labels: s.Labels, Value: apply(op, s.Value, float64(r))}
+			}
+			return rv, nil
+		}
+
+		rv := rhs.(Vector)
+		bySignature := make(map[string]Sample, len(rv))
+		for _, s := range rv {
+			sig := signature(s.Labels)
+			if _, ok := bySignature[sig]; ok {
+				return nil, errMatching(op, rv)
+			}
+			bySignature[sig] = s
+		}
+
+		result := Vector{}
+		seen := make(map[string]struct{}, len(lv))
+		for _, s := range lv {
+			sig := signature(s.Labels)
+			if _, ok := seen[sig]; ok {
+				return nil, errMatching(op, lv)
+			}
+			seen[sig] = struct{}{}
+
+			match, ok := bySignature[sig]
+			if !ok {
+				continue
+			}
+			result = append(result, Sample{Labels: dropSeriesLabels(s.Labels), Value: apply(op, s.Value, match.Value)})
+		}
+		return result, nil
+	}
+}
+
+func errMatching(op string, v Vector) error {
+	names := make([]string, 0, len(v))
+	for _, s := range v {
+		names = append(names, s.Labels[LabelName])
+	}
+	return fmt.Errorf("can't match %d series (%s) on one side of %q, aggregate them first", len(v), strings.Join(names, ", "), op)
+}
+
+// ErrNotSingle is returned by Single for vectors of more than one sample.
+var ErrNotSingle = errors.New("expression has more than one value")
+
+// Single returns the only value of the result. It's not ok if there is no value.
+func Single(value Value) (float64, bool, error) {
+	switch v := value.(type) {
+	case Scalar:
+		return float64(v), true, nil
+	case Matrix:
+		return 0, false, fmt.Errorf("expression is a range selector, reduce it with a range function")
+	default:
+		vector := v.(Vector)
+		switch len(vector) {
+		case 0:
+			return 0, false, nil
+		case 1:
+			return vector[0].Value, true, nil
+		default:
+			return 0, false, ErrNotSingle
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/server/history"
+	"github.com/SamMeown/metrix/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{name: "test precedence", input: "1 + 2 * 3 - 4 / 2", want: "1 + 2 * 3 - 4 / 2"},
+		{name: "test parens and unary minus", input: "-(HeapInuse+1)*-2", want: `-({name="HeapInuse"} + 1) * -2`},
+		{name: "test selector with matchers", input: `PollCount{type="counter"}`, want: `{name="PollCount", type="counter"}`},
+		{name: "test regexp selector", input: "sum({name=~`^Alloc\\.`, type!=\"counter\"})", want: `sum({name=~"^Alloc\\.", type!="counter"})`},
+		{name: "test numbers", input: "1e3 + .5 + 0.25", want: "1000 + 0.5 + 0.25"},
+		{name: "test dotted names", input: "agent.HeapSys / 2", want: `{name="agent.HeapSys"} / 2`},
+		{name: "test unknown function", input: "median(HeapSys)", wantErr: `unknown function "median" at 0`},
+		{name: "test wrong number of arguments", input: "sum(a, b)", wantErr: "sum expects 1 arguments, got 2 at 0"},
+		{name: "test unknown label", input: `{agent="a"}`, wantErr: `unknown label "agent" at 1`},
+		{name: "test bad regexp", input: `{name=~"("}`, wantErr: "bad regexp at 7"},
+		{name: "test empty selector", input: `{}`, wantErr: "empty selector"},
+		{name: "test unclosed paren", input: "(1 + 2", wantErr: `expected ")", got end of expression at 6`},
+		{name: "test trailing tokens", input: "1 2", wantErr: `unexpected "2" at 2`},
+		{name: "test unexpected character", input: "1 % 2", wantErr: `unexpected '%' at 2`},
+		{name: "test unterminated string", input: `{name="a}`, wantErr: "unterminated string at 6"},
+		{name: "test grouping", input: `sum by (type) ({name=~"^Alloc"})`, want: `sum by (type) ({name=~"^Alloc"})`},
+		{name: "test trailing grouping", input: "max(HeapSys) by (name, type)", want: `max by (name, type) ({name="HeapSys"})`},
+		{name: "test range function", input: "rate(PollCount[1m30s]) * 60", want: `rate({name="PollCount"}[1m30s]) * 60`},
+		{name: "test range selector", input: `{type="counter"}[5m]`, want: `{type="counter"}[5m0s]`},
+		{name: "test bad duration", input: "rate(PollCount[5])", wantErr: `bad duration "5" at 15`},
+		{name: "test range function without range", input: "rate(PollCount)", wantErr: "rate expects a range selector"},
+		{name: "test range in instant function", input: "abs(PollCount[5m])", wantErr: "range selector is allowed in range functions only"},
+		{name: "test grouping non aggregation", input: "abs by (name) (HeapSys)", wantErr: "abs is not an aggregation"},
+		{name: "test selector named by", input: "by + 1", want: `{name="by"} + 1`},
+		{name: "test too long", input: strings.Repeat("1+", MaxLength/2) + "1", wantErr: "expression is longer than 4096 bytes"},
+		{name: "test too deep", input: strings.Repeat("(", MaxDepth) + "1" + strings.Repeat(")", MaxDepth), wantErr: "expression is nested deeper than 64 at 64"},
+		{name: "test deepest", input: strings.Repeat("-", MaxDepth-1) + "1", want: strings.Repeat("-", MaxDepth-1) + "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := Parse(tt.input)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, node.String())
+		})
+	}
+}
+
+func TestEval(t *testing.T) {
+	evaluator := &Evaluator{Items: storage.MetricsStorageItems{
+		Gauges: map[string]float64{
+			"HeapInuse": 50,
+			"HeapSys":   200,
+			"Alloc.a":   1,
+			"Alloc.b":   2,
+			"Alloc.c":   6,
+		},
+		Counters: map[string]int64{
+			"PollCount": 10,
+			"Alloc.c":   100,
+		},
+	}}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    Value
+		wantErr string
+	}{
+		{name: "test arithmetic", input: "1 + 2 * 3 - -4 / 2", want: Scalar(9)},
+		{name: "test ratio", input: "HeapInuse / HeapSys", want: Vector{{Labels: map[string]string{}, Value: 0.25}}},
+		{name: "test vector and scalar", input: "HeapSys * 2 + 1", want: Vector{{Labels: map[string]string{"name": "HeapSys", "type": "gauge"}, Value: 401}}},
+		{
+			name:  "test selector",
+			input: `{name=~"^Alloc\\."}`,
+			want: Vector{
+				{Labels: map[string]string{"name": "Alloc.a", "type": "gauge"}, Value: 1},
+				{Labels: map[string]string{"name": "Alloc.b", "type": "gauge"}, Value: 2},
+				{Labels: map[string]string{"name": "Alloc.c", "type": "counter"}, Value: 100},
+				{Labels: map[string]string{"name": "Alloc.c", "type": "gauge"}, Value: 6},
+			},
+		},
+		{name: "test sum", input: `sum({name=~"^Alloc\\.", type="gauge"})`, want: Vector{{Labels: map[string]string{}, Value: 9}}},
+		{name: "test avg", input: `avg({name=~"^Alloc\\.", type="gauge"})`, want: Vector{{Labels: map[string]string{}, Value: 3}}},
+		{name: "test min max", input: `max({name=~"^Alloc"}) - min({name=~"^Alloc"})`, want: Vector{{Labels: map[string]string{}, Value: 99}}},
+		{name: "test count", input: `count({type="counter"})`, want: Vector{{Labels: map[string]string{}, Value: 2}}},
+		{name: "test abs", input: "abs(-HeapSys)", want: Vector{{Labels: map[string]string{"name": "HeapSys", "type": "gauge"}, Value: 200}}},
+		{
+			name:  "test sum by type",
+			input: `sum by (type) ({name=~"^Alloc"})`,
+			want: Vector{
+				{Labels: map[string]string{"type": "counter"}, Value: 100},
+				{Labels: map[string]string{"type": "gauge"}, Value: 9},
+			},
+		},
+		{
+			name:  "test count by name",
+			input: `count({name=~"^Alloc"}) by (name)`,
+			want: Vector{
+				{Labels: map[string]string{"name": "Alloc.a"}, Value: 1},
+				{Labels: map[string]string{"name": "Alloc.b"}, Value: 1},
+				{Labels: map[string]string{"name": "Alloc.c"}, Value: 2},
+			},
+		},
+		{name: "test counter", input: "PollCount", want: Vector{{Labels: map[string]string{"name": "PollCount", "type": "counter"}, Value: 10}}},
+		{name: "test no series", input: "Missing / HeapSys", want: Vector{}},
+		{name: "test aggregate nothing", input: "sum(Missing)", want: Vector{}},
+		{name: "test ambiguous matching", input: `{name=~"^Alloc"} / HeapSys`, wantErr: `can't match 4 series`},
+		{name: "test aggregating scalar", input: "sum(1)", wantErr: "sum expects a vector, got scalar"},
+		{name: "test range without history", input: "rate(PollCount[1m])", want: Vector{}},
+		{name: "test range selector operand", input: "HeapSys[1m] * 2", wantErr: `range selector can't be an operand of "*"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := Parse(tt.input)
+			require.NoError(t, err)
+
+			value, err := evaluator.Eval(node)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, value)
+		})
+	}
+}
+
+func TestEvalHistory(t *testing.T) {
+	now := time.Now()
+	recorder := history.NewRecorder(10)
+	record := func(ago time.Duration, pollCount int64, heapInuse float64) {
+		recorder.Record(now.Add(-ago), storage.MetricsStorageItems{
+			Gauges:   map[string]float64{"HeapInuse": heapInuse},
+			Counters: map[string]int64{"PollCount": pollCount},
+		})
+	}
+	record(2*time.Minute, 100, 10)
+	record(time.Minute, 160, 30)
+	record(30*time.Second, 10, 50)
+	record(0, 40, 20)
+
+	evaluator := &Evaluator{
+		Items: storage.MetricsStorageItems{
+			Gauges:   map[string]float64{"HeapInuse": 20, "HeapSys": 100},
+			Counters: map[string]int64{"PollCount": 40},
+		},
+		History: recorder,
+		Now:     now,
+	}
+
+	pollCount := map[string]string{"name": "PollCount", "type": "counter"}
+	heapInuse := map[string]string{"name": "HeapInuse", "type": "gauge"}
+	tests := []struct {
+		name    string
+		input   string
+		want    Value
+		wantErr string
+	}{
+		{name: "test increase with reset", input: "increase(PollCount[1m])", want: Vector{{Labels: pollCount, Value: 40}}},
+		{name: "test rate", input: "rate(PollCount[1m]) * 60", want: Vector{{Labels: pollCount, Value: 40}}},
+		{name: "test avg over time", input: "avg_over_time(HeapInuse[5m])", want: Vector{{Labels: heapInuse, Value: 27.5}}},
+		{name: "test min over time", input: "min_over_time(HeapInuse[5m])", want: Vector{{Labels: heapInuse, Value: 10}}},
+		{name: "test max over time", input: "max_over_time(HeapInuse[1m])", want: Vector{{Labels: heapInuse, Value: 50}}},
+		{name: "test no history", input: "avg_over_time(HeapSys[5m])", want: Vector{}},
+		{
+			name:  "test matrix",
+			input: "HeapInuse[45s]",
+			want: Matrix{{Labels: heapInuse, Points: []history.Point{
+				{Time: now.Add(-30 * time.Second), Value: 50},
+				{Time: now, Value: 20},
+			}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := Parse(tt.input)
+			require.NoError(t, err)
+
+			value, err := evaluator.Eval(node)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, value)
+		})
+	}
+}
+
+func TestSingle(t *testing.T) {
+	value, ok, err := Single(Scalar(1))
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, value)
+
+	_, ok, err = Single(Vector{})
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	_, _, err = Single(Vector{{Value: 1}, {Value: 2}})
+	assert.ErrorIs(t, err, ErrNotSingle)
+}
@@ -0,0 +1,115 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenIdent
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	pos   int
+	value float64
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r) || r == '.' || r == ':'
+}
+
+// ops are operators and punctuation, longer ones first
+var ops = []string{"=~", "!~", "!=", "+", "-", "*", "/", "(", ")", "{", "}", "[", "]", ",", "="}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	for pos := 0; pos < len(runes); {
+		r := runes[pos]
+		switch {
+		case unicode.IsSpace(r):
+			pos++
+		case unicode.IsDigit(r) || (r == '.' && pos+1 < len(runes) && unicode.IsDigit(runes[pos+1])):
+			start := pos
+			for pos < len(runes) && (unicode.IsDigit(runes[pos]) || unicode.IsLetter(runes[pos]) || runes[pos] == '.' ||
+				((runes[pos] == '+' || runes[pos] == '-') && (runes[pos-1] == 'e' || runes[pos-1] == 'E'))) {
+				pos++
+			}
+			text := string(runes[start:pos])
+			t := token{kind: tokenNumber, text: text, pos: start}
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				// Durations like 5m are numbers followed by units, they are parsed where expected
+				t.kind = tokenIdent
+			}
+			t.value = value
+			tokens = append(tokens, t)
+		case isIdentStart(r):
+			start := pos
+			for pos < len(runes) && isIdentPart(runes[pos]) {
+				pos++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:pos]), pos: start})
+		case r == '"' || r == '`':
+			start := pos
+			pos++
+			for pos < len(runes) && runes[pos] != r {
+				if runes[pos] == '\\' && r == '"' {
+					pos++
+				}
+				pos++
+			}
+			if pos >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			pos++
+			text, err := strconv.Unquote(string(runes[start:pos]))
+			if err != nil {
+				return nil, fmt.Errorf("bad string at %d: %w", start, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, pos: start})
+		default:
+			// Operators are two characters at most
+			end := pos + 2
+			if end > len(runes) {
+				end = len(runes)
+			}
+			next := string(runes[pos:end])
+			found := false
+			for _, op := range ops {
+				if strings.HasPrefix(next, op) {
+					tokens = append(tokens, token{kind: tokenOp, text: op, pos: pos})
+					pos += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected %q at %d", r, pos)
+			}
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
@@ -0,0 +1,457 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Node is a parsed expression.
+type Node interface {
+	String() string
+}
+
+type NumberLiteral struct {
+	Value float64
+}
+
+type MatchOp string
+
+const (
+	MatchEqual    MatchOp = "="
+	MatchNotEqual MatchOp = "!="
+	MatchRegexp   MatchOp = "=~"
+	MatchNotRegex MatchOp = "!~"
+)
+
+// Matcher selects series by a label value.
+type Matcher struct {
+	Label string
+	Op    MatchOp
+	Value string
+	re    *regexp.Regexp
+}
+
+// Selector selects stored series, e.g. HeapAlloc, {name=~"^Heap"} or PollCount{type="counter"}.
+type Selector struct {
+	Matchers []Matcher
+}
+
+// MatrixSelector selects recent history of series, e.g. PollCount[5m].
+type MatrixSelector struct {
+	Selector *Selector
+	Range    time.Duration
+}
+
+type Call struct {
+	Func string
+	Args []Node
+	// Grouping lists labels aggregations are grouped by
+	Grouping []string
+}
+
+type BinaryExpr struct {
+	Op  string
+	LHS Node
+	RHS Node
+}
+
+type UnaryExpr struct {
+	Op      string
+	Operand Node
+}
+
+type ParenExpr struct {
+	Expr Node
+}
+
+func (n *NumberLiteral) String() string {
+	return formatNumber(n.Value)
+}
+
+func (m Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Label, m.Op, m.Value)
+}
+
+func (m Matcher) Matches(value string) bool {
+	switch m.Op {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+func (n *Selector) String() string {
+	matchers := make([]string, len(n.Matchers))
+	for i, m := range n.Matchers {
+		matchers[i] = m.String()
+	}
+	return "{" + strings.Join(matchers, ", ") + "}"
+}
+
+func (n *MatrixSelector) String() string {
+	return n.Selector.String() + "[" + n.Range.String() + "]"
+}
+
+func (n *Call) String() string {
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = arg.String()
+	}
+
+	grouping := ""
+	if len(n.Grouping) > 0 {
+		grouping = " by (" + strings.Join(n.Grouping, ", ") + ") "
+	}
+	return n.Func + grouping + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (n *BinaryExpr) String() string {
+	return n.LHS.String() + " " + n.Op + " " + n.RHS.String()
+}
+
+func (n *UnaryExpr) String() string {
+	return n.Op + n.Operand.String()
+}
+
+func (n *ParenExpr) String() string {
+	return "(" + n.Expr.String() + ")"
+}
+
+// Limits keeping parsing and evaluation of untrusted expressions cheap.
+const (
+	// MaxLength is the maximum length of an expression in bytes
+	MaxLength = 4096
+	// MaxDepth is the maximum nesting of parentheses, calls and unary operators
+	MaxDepth = 64
+)
+
+// Labels series are selected by.
+const (
+	LabelName = "name"
+	LabelType = "type"
+)
+
+// Parse parses an expression. The grammar is
+//
+//	expr     = term {("+" | "-") term}
+//	term     = unary {("*" | "/") unary}
+//	unary    = "-" unary | primary
+//	primary  = number | "(" expr ")" | call | selector ["[" duration "]"]
+//	call     = ident [grouping] "(" [expr {"," expr}] ")" [grouping]
+//	grouping = "by" "(" [ident {"," ident}] ")"
+//	selector = ident [matchers] | matchers
+//	matchers = "{" matcher {"," matcher} "}"
+//	matcher  = ident ("=" | "!=" | "=~" | "!~") string
+//
+// where a selector ident is the metrics name, and matcher labels are name and type.
+// Grouping is allowed for aggregations only, a selector with duration is a range function argument.
+func Parse(input string) (Node, error) {
+	if len(input) > MaxLength {
+		return nil, fmt.Errorf("expression is longer than %d bytes", MaxLength)
+	}
+
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.unexpected(t)
+	}
+
+	return node, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != tokenOp {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) isBy() bool {
+	t := p.peek()
+	return t.kind == tokenIdent && t.text == "by"
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		return fmt.Errorf("expected %q, got %s at %d", op, p.peek(), p.peek().pos)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) unexpected(t token) error {
+	return fmt.Errorf("unexpected %s at %d", t, t.pos)
+}
+
+func (p *parser) parseExpr() (Node, error) {
+	lhs, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("+", "-") {
+		op := p.next().text
+		rhs, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+
+	return lhs, nil
+}
+
+func (p *parser) parseTerm() (Node, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("*", "/") {
+		op := p.next().text
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op, LHS: lhs, RHS: rhs}
+	}
+
+	return lhs, nil
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	// Every nested expression is parsed through here
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > MaxDepth {
+		return nil, fmt.Errorf("expression is nested deeper than %d at %d", MaxDepth, p.peek().pos)
+	}
+
+	if p.isOp("-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: "-", Operand: operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenNumber:
+		p.next()
+		return &NumberLiteral{Value: t.value}, nil
+	case p.isOp("("):
+		p.next()
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: node}, nil
+	case p.isOp("{"):
+		matchers, err := p.parseMatchers()
+		if err != nil {
+			return nil, err
+		}
+		return p.parseRange(&Selector{Matchers: matchers})
+	case t.kind == tokenIdent:
+		p.next()
+		if _, ok := functions[t.text]; ok && (p.isOp("(") || p.isBy()) {
+			return p.parseCall(t)
+		}
+		if p.isOp("(") {
+			return nil, fmt.Errorf("unknown function %q at %d", t.text, t.pos)
+		}
+
+		selector := &Selector{Matchers: []Matcher{{Label: LabelName, Op: MatchEqual, Value: t.text}}}
+		if p.isOp("{") {
+			matchers, err := p.parseMatchers()
+			if err != nil {
+				return nil, err
+			}
+			selector.Matchers = append(selector.Matchers, matchers...)
+		}
+		return p.parseRange(selector)
+	default:
+		return nil, p.unexpected(t)
+	}
+}
+
+func (p *parser) parseRange(selector *Selector) (Node, error) {
+	if !p.isOp("[") {
+		return selector, nil
+	}
+	p.next()
+
+	t := p.next()
+	duration, err := time.ParseDuration(t.text)
+	if t.kind != tokenIdent || err != nil || duration <= 0 {
+		return nil, fmt.Errorf("bad duration %s at %d", t, t.pos)
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	return &MatrixSelector{Selector: selector, Range: duration}, nil
+}
+
+func (p *parser) parseGrouping() ([]string, error) {
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+	for !p.isOp(")") {
+		if len(labels) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		label := p.next()
+		if label.kind != tokenIdent {
+			return nil, p.unexpected(label)
+		}
+		labels = append(labels, label.text)
+	}
+	p.next()
+
+	return labels, nil
+}
+
+func (p *parser) parseCall(name token) (Node, error) {
+	call := &Call{Func: name.text}
+
+	if p.isBy() {
+		var err error
+		if call.Grouping, err = p.parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.isOp(")") {
+		if len(call.Args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+	}
+	p.next()
+
+	if call.Grouping == nil && p.isBy() {
+		var err error
+		if call.Grouping, err = p.parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkCall(call); err != nil {
+		return nil, fmt.Errorf("%w at %d", err, name.pos)
+	}
+
+	return call, nil
+}
+
+func (p *parser) parseMatchers() ([]Matcher, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var matchers []Matcher
+	for !p.isOp("}") {
+		if len(matchers) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		label := p.next()
+		if label.kind != tokenIdent {
+			return nil, p.unexpected(label)
+		}
+		if label.text != LabelName && label.text != LabelType {
+			return nil, fmt.Errorf("unknown label %q at %d", label.text, label.pos)
+		}
+
+		op := p.next()
+		if op.kind != tokenOp || (op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~") {
+			return nil, p.unexpected(op)
+		}
+
+		value := p.next()
+		if value.kind != tokenString {
+			return nil, p.unexpected(value)
+		}
+
+		m := Matcher{Label: label.text, Op: MatchOp(op.text), Value: value.text}
+		if m.Op == MatchRegexp || m.Op == MatchNotRegex {
+			var err error
+			m.re, err = regexp.Compile(value.text)
+			if err != nil {
+				return nil, fmt.Errorf("bad regexp at %d: %w", value.pos, err)
+			}
+		}
+		matchers = append(matchers, m)
+	}
+	p.next()
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("empty selector at %d", p.peek().pos)
+	}
+
+	return matchers, nil
+}
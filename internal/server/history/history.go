@@ -0,0 +1,171 @@
+// Package history keeps recent values of every metrics series, sampled from storage on an interval.
+package history
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/storage"
+)
+
+type Key struct {
+	MType string
+	Name  string
+}
+
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// ring is a fixed size buffer of points, overwriting the oldest ones
+type ring struct {
+	points []Point
+	next   int
+	full   bool
+}
+
+func (r *ring) add(p Point) {
+	r.points[r.next] = p
+	r.next = (r.next + 1) % len(r.points)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *ring) all() []Point {
+	if !r.full {
+		return append([]Point(nil), r.points[:r.next]...)
+	}
+
+	return append(append([]Point(nil), r.points[r.next:]...), r.points[:r.next]...)
+}
+
+// Recorder keeps up to size last points of every series.
+type Recorder struct {
+	size int
+
+	m      sync.RWMutex
+	series map[Key]*ring
+}
+
+func NewRecorder(size int) *Recorder {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Recorder{
+		size:   size,
+		series: make(map[Key]*ring),
+	}
+}
+
+// Record adds a point with the given time to every series in items.
+func (r *Recorder) Record(at time.Time, items storage.MetricsStorageItems) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for name, value := range items.Gauges {
+		r.add(Key{storage.MetricsTypeGauge, name}, Point{at, value})
+	}
+	for name, value := range items.Counters {
+		r.add(Key{storage.MetricsTypeCounter, name}, Point{at, float64(value)})
+	}
+}
+
+func (r *Recorder) add(key Key, p Point) {
+	series, ok := r.series[key]
+	if !ok {
+		series = &ring{points: make([]Point, r.size)}
+		r.series[key] = series
+	}
+	series.add(p)
+}
+
+// Get returns points of the series, oldest first.
+func (r *Recorder) Get(key Key) []Point {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	series, ok := r.series[key]
+	if !ok {
+		return nil
+	}
+
+	return series.all()
+}
+
+// Range returns points of the series within [from, to], oldest first.
+func (r *Recorder) Range(key Key, from, to time.Time) []Point {
+	points := r.Get(key)
+
+	var rv []Point
+	for _, p := range points {
+		if !p.Time.Before(from) && !p.Time.After(to) {
+			rv = append(rv, p)
+		}
+	}
+
+	return rv
+}
+
+// Increase returns the increase of values over points. Decreases of counters are counted as resets to zero.
+// It's not ok if there are less than two points.
+func Increase(points []Point, counter bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	if !counter {
+		return points[len(points)-1].Value - points[0].Value, true
+	}
+
+	var increase float64
+	for i := 1; i < len(points); i++ {
+		if points[i].Value >= points[i-1].Value {
+			increase += points[i].Value - points[i-1].Value
+		} else {
+			increase += points[i].Value
+		}
+	}
+
+	return increase, true
+}
+
+// Rate returns per second increase of values over points, see Increase.
+func Rate(points []Point, counter bool) (float64, bool) {
+	increase, ok := Increase(points, counter)
+	if !ok {
+		return 0, false
+	}
+
+	seconds := points[len(points)-1].Time.Sub(points[0].Time).Seconds()
+	if seconds <= 0 {
+		return 0, false
+	}
+
+	return increase / seconds, true
+}
+
+// Run samples all metrics from mStorage every interval until ctx is done.
+func (r *Recorder) Run(ctx context.Context, mStorage storage.MetricsStorageGetter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		items, err := mStorage.GetAll(ctx)
+		if err != nil {
+			logger.Log.Errorf("Failed to sample metrics history: %s", err)
+		} else {
+			r.Record(time.Now(), items)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
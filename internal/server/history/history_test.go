@@ -0,0 +1,58 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(3)
+	start := time.Unix(1000, 0)
+
+	for i := 0; i < 5; i++ {
+		items := storage.MetricsStorageItems{
+			Gauges:   map[string]float64{"g": float64(i)},
+			Counters: map[string]int64{"c": int64(i * 10)},
+		}
+		if i == 4 {
+			items.Gauges["late"] = 1
+		}
+		r.Record(start.Add(time.Duration(i)*time.Second), items)
+	}
+
+	assert.Equal(t, []Point{
+		{start.Add(2 * time.Second), 2},
+		{start.Add(3 * time.Second), 3},
+		{start.Add(4 * time.Second), 4},
+	}, r.Get(Key{storage.MetricsTypeGauge, "g"}), "only the last points are kept")
+
+	assert.Equal(t, []Point{{start.Add(4 * time.Second), 1}}, r.Get(Key{storage.MetricsTypeGauge, "late"}))
+	assert.Nil(t, r.Get(Key{storage.MetricsTypeCounter, "g"}))
+
+	assert.Equal(t, []Point{
+		{start.Add(3 * time.Second), 30},
+	}, r.Range(Key{storage.MetricsTypeCounter, "c"}, start.Add(2500*time.Millisecond), start.Add(3*time.Second)))
+}
+
+func TestRate(t *testing.T) {
+	start := time.Unix(1000, 0)
+	points := []Point{
+		{start, 10},
+		{start.Add(10 * time.Second), 30},
+		{start.Add(20 * time.Second), 5},
+	}
+
+	increase, ok := Increase(points, true)
+	assert.True(t, ok)
+	assert.Equal(t, 25.0, increase, "counter reset is counted from zero")
+
+	rate, ok := Rate(points, false)
+	assert.True(t, ok)
+	assert.Equal(t, -0.25, rate)
+
+	_, ok = Rate(points[:1], true)
+	assert.False(t, ok)
+}
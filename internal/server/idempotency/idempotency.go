@@ -0,0 +1,110 @@
+// Package idempotency remembers responses to requests sent with an idempotency key,
+// so that retried requests are answered from the cache instead of being applied again.
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Response is a remembered response. Fingerprint identifies the request it was given to.
+type Response struct {
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+type Store interface {
+	// Get returns the response remembered for key, or nil if there is none
+	Get(ctx context.Context, key string) (*Response, error)
+	// Put remembers the response for key, keeping the first response if there already is one
+	Put(ctx context.Context, key string, response Response) error
+}
+
+type memEntry struct {
+	response  Response
+	expiresAt time.Time
+}
+
+type memKey struct {
+	key       string
+	expiresAt time.Time
+}
+
+// MemStore keeps up to capacity responses in memory for ttl, evicting the oldest first.
+type MemStore struct {
+	ttl      time.Duration
+	capacity int
+	now      func() time.Time
+
+	m       sync.Mutex
+	entries map[string]memEntry
+	order   []memKey
+}
+
+func NewMemStore(ttl time.Duration, capacity int) *MemStore {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &MemStore{
+		ttl:      ttl,
+		capacity: capacity,
+		now:      time.Now,
+		entries:  make(map[string]memEntry),
+	}
+}
+
+func (s *MemStore) Get(ctx context.Context, key string) (*Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || !s.now().Before(entry.expiresAt) {
+		return nil, nil
+	}
+
+	response := entry.response
+	return &response, nil
+}
+
+func (s *MemStore) Put(ctx context.Context, key string, response Response) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := s.now()
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expiresAt) {
+		return nil
+	}
+
+	// An expired key may still be in the order if the clock went back, it is replaced along with its entry
+	if _, ok := s.entries[key]; ok {
+		s.order = slices.DeleteFunc(s.order, func(k memKey) bool { return k.key == key })
+	}
+
+	// Entries are added in expiration order, so expired ones are all at the front
+	for len(s.order) > 0 && (len(s.order) >= s.capacity || !now.Before(s.order[0].expiresAt)) {
+		if entry, ok := s.entries[s.order[0].key]; ok && entry.expiresAt.Equal(s.order[0].expiresAt) {
+			delete(s.entries, s.order[0].key)
+		}
+		s.order = s.order[1:]
+	}
+
+	expiresAt := now.Add(s.ttl)
+	s.entries[key] = memEntry{response: response, expiresAt: expiresAt}
+	s.order = append(s.order, memKey{key: key, expiresAt: expiresAt})
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	response, err := s.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Nil(t, response)
+
+	first := Response{Fingerprint: "f1", Status: 200, ContentType: "application/json", Body: []byte("{}")}
+	require.NoError(t, s.Put(ctx, "a", first))
+	require.NoError(t, s.Put(ctx, "a", Response{Fingerprint: "f2", Status: 400}))
+
+	response, err = s.Get(ctx, "a")
+	require.NoError(t, err)
+	require.NotNil(t, response)
+	assert.Equal(t, first, *response, "first response is kept")
+}
+
+func TestMemStore(t *testing.T) {
+	t.Run("contract", func(t *testing.T) {
+		testStore(t, NewMemStore(time.Hour, 10))
+	})
+
+	t.Run("expiration and capacity", func(t *testing.T) {
+		ctx := context.Background()
+		now := time.Unix(1000, 0)
+		s := NewMemStore(time.Minute, 2)
+		s.now = func() time.Time { return now }
+
+		require.NoError(t, s.Put(ctx, "a", Response{Status: 200}))
+		now = now.Add(30 * time.Second)
+		require.NoError(t, s.Put(ctx, "b", Response{Status: 200}))
+		require.NoError(t, s.Put(ctx, "c", Response{Status: 200}))
+
+		response, err := s.Get(ctx, "a")
+		require.NoError(t, err)
+		assert.Nil(t, response, "oldest key is evicted when over capacity")
+
+		now = now.Add(time.Minute)
+		response, err = s.Get(ctx, "b")
+		require.NoError(t, err)
+		assert.Nil(t, response, "key is expired")
+
+		require.NoError(t, s.Put(ctx, "b", Response{Status: 201}))
+		response, err = s.Get(ctx, "b")
+		require.NoError(t, err)
+		require.NotNil(t, response)
+		assert.Equal(t, 201, response.Status, "expired key can be used again")
+		assert.Len(t, s.entries, 1)
+	})
+
+	t.Run("expired key put again after clock went back", func(t *testing.T) {
+		ctx := context.Background()
+		now := time.Unix(1000, 0)
+		s := NewMemStore(time.Minute, 3)
+		s.now = func() time.Time { return now }
+
+		require.NoError(t, s.Put(ctx, "a", Response{Status: 200}))
+		now = now.Add(-time.Hour)
+		require.NoError(t, s.Put(ctx, "k", Response{Status: 200}))
+
+		// a isn't expired, so the expired k isn't evicted before it is put again
+		now = now.Add(2 * time.Minute)
+		require.NoError(t, s.Put(ctx, "k", Response{Status: 201}))
+		require.NoError(t, s.Put(ctx, "b", Response{Status: 200}))
+		require.NoError(t, s.Put(ctx, "c", Response{Status: 200}))
+
+		response, err := s.Get(ctx, "k")
+		require.NoError(t, err)
+		require.NotNil(t, response, "retry is still deduplicated")
+		assert.Equal(t, 201, response.Status)
+	})
+}
+
+// Runs against a throwaway database given by TEST_DATABASE_DSN, see pg.TestStorage
+func TestPGStore(t *testing.T) {
+	dsn, ok := os.LookupEnv("TEST_DATABASE_DSN")
+	if !ok {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	s := NewPGStore(db, time.Hour)
+	require.NoError(t, s.Bootstrap(ctx))
+	_, err = db.ExecContext(ctx, "TRUNCATE idempotency_keys;")
+	require.NoError(t, err)
+
+	testStore(t, s)
+}
@@ -0,0 +1,97 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const pgCleanupInterval = 10 * time.Minute
+
+// PGStore keeps responses in the idempotency_keys table for ttl,
+// so they survive restarts and are shared by servers using the same database.
+type PGStore struct {
+	conn *sql.DB
+	ttl  time.Duration
+
+	m           sync.Mutex
+	lastCleanup time.Time
+}
+
+func NewPGStore(conn *sql.DB, ttl time.Duration) *PGStore {
+	return &PGStore{conn: conn, ttl: ttl}
+}
+
+func (s *PGStore) Bootstrap(ctx context.Context) error {
+	_, err := s.conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+		    key TEXT PRIMARY KEY,
+		    fingerprint VARCHAR(64),
+		    status INTEGER,
+		    content_type TEXT,
+		    body BYTEA,
+		    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+
+	return err
+}
+
+func (s *PGStore) Get(ctx context.Context, key string) (*Response, error) {
+	row := s.conn.QueryRowContext(
+		ctx,
+		"SELECT fingerprint, status, content_type, body FROM idempotency_keys WHERE key = $1 AND created_at > $2;",
+		key,
+		time.Now().UTC().Add(-s.ttl),
+	)
+
+	var response Response
+	err := row.Scan(&response.Fingerprint, &response.Status, &response.ContentType, &response.Body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+func (s *PGStore) Put(ctx context.Context, key string, response Response) error {
+	now := time.Now().UTC()
+	if err := s.cleanup(ctx, now); err != nil {
+		return err
+	}
+
+	_, err := s.conn.ExecContext(
+		ctx,
+		`
+		INSERT INTO idempotency_keys (key, fingerprint, status, content_type, body, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE SET
+		    fingerprint = EXCLUDED.fingerprint,
+		    status = EXCLUDED.status,
+		    content_type = EXCLUDED.content_type,
+		    body = EXCLUDED.body,
+		    created_at = EXCLUDED.created_at
+		WHERE idempotency_keys.created_at <= $7;
+		`,
+		key, response.Fingerprint, response.Status, response.ContentType, response.Body, now, now.Add(-s.ttl),
+	)
+
+	return err
+}
+
+// cleanup drops expired keys every once in a while
+func (s *PGStore) cleanup(ctx context.Context, now time.Time) error {
+	s.m.Lock()
+	if now.Sub(s.lastCleanup) < pgCleanupInterval {
+		s.m.Unlock()
+		return nil
+	}
+	s.lastCleanup = now
+	s.m.Unlock()
+
+	_, err := s.conn.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at <= $1;", now.Add(-s.ttl))
+	return err
+}
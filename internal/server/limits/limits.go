@@ -0,0 +1,225 @@
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/SamMeown/metrix/internal/server/stats"
+	"github.com/SamMeown/metrix/internal/storage"
+)
+
+var (
+	ErrInvalidName      = errors.New("invalid metrics name")
+	ErrSeriesLimit      = errors.New("series limit exceeded")
+	ErrAgentSeriesLimit = errors.New("agent series limit exceeded")
+)
+
+const (
+	StatRejectedInvalidName      = "rejected_metrics_invalid_name"
+	StatRejectedSeriesLimit      = "rejected_metrics_series_limit"
+	StatRejectedAgentSeriesLimit = "rejected_metrics_agent_series_limit"
+)
+
+// Rules zero values mean "no limit".
+type Rules struct {
+	NamePattern    *regexp.Regexp
+	MaxNameLength  int
+	MaxSeries      int
+	MaxAgentSeries int
+	// AgentIdleTimeout is the time after which series of an agent which sends nothing are forgotten,
+	// so that agents which are gone don't take memory (0 means they are remembered forever).
+	AgentIdleTimeout time.Duration
+}
+
+type Series struct {
+	MType string
+	Name  string
+}
+
+// reservations maps series to the id of the reservation that admitted them,
+// or to 0 once other reservations have used them too.
+type reservations map[Series]uint64
+
+type agentSeries struct {
+	series   reservations
+	lastSeen time.Time
+}
+
+type Limiter struct {
+	rules Rules
+	stats *stats.Registry
+	now   func() time.Time
+
+	m           sync.Mutex
+	lastID      uint64
+	series      reservations
+	agentSeries map[string]*agentSeries
+	lastSweep   time.Time
+}
+
+func New(rules Rules, stats *stats.Registry) *Limiter {
+	return &Limiter{
+		rules:       rules,
+		stats:       stats,
+		now:         time.Now,
+		series:      make(reservations),
+		agentSeries: make(map[string]*agentSeries),
+	}
+}
+
+// Seed registers already stored series so that the global limit accounts for them.
+func (l *Limiter) Seed(items storage.MetricsStorageItems) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for name := range items.Gauges {
+		l.series[Series{storage.MetricsTypeGauge, name}] = 0
+	}
+	for name := range items.Counters {
+		l.series[Series{storage.MetricsTypeCounter, name}] = 0
+	}
+}
+
+// ValidateName checks name against the naming rules, counting rejected names.
+func (l *Limiter) ValidateName(name string) error {
+	err := l.validateName(name)
+	if err != nil {
+		l.stats.Counter(StatRejectedInvalidName).Add(1)
+	}
+
+	return err
+}
+
+func (l *Limiter) validateName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("%w: name is blank", ErrInvalidName)
+	}
+
+	if l.rules.MaxNameLength > 0 && len(name) > l.rules.MaxNameLength {
+		return fmt.Errorf("%w: name is longer than %d bytes", ErrInvalidName, l.rules.MaxNameLength)
+	}
+
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: name contains control characters", ErrInvalidName)
+	}
+
+	if l.rules.NamePattern != nil && !l.rules.NamePattern.MatchString(name) {
+		return fmt.Errorf("%w: name %q does not match %q", ErrInvalidName, name, l.rules.NamePattern)
+	}
+
+	return nil
+}
+
+// Admit validates names of the given series and checks that accepting them from agent
+// keeps the number of distinct series within limits. Series are admitted all or nothing.
+func (l *Limiter) Admit(agent string, series ...Series) error {
+	_, err := l.Reserve(agent, series...)
+	return err
+}
+
+// Reserve admits series like Admit does and returns a func forgetting the series it has newly admitted,
+// to be called if they fail to be stored. Series admitted by other reservations in the meantime are kept.
+func (l *Limiter) Reserve(agent string, series ...Series) (cancel func(), err error) {
+	cancel = func() {}
+	for _, s := range series {
+		if err := l.ValidateName(s.Name); err != nil {
+			return cancel, err
+		}
+	}
+
+	if l.rules.MaxSeries <= 0 && l.rules.MaxAgentSeries <= 0 {
+		return cancel, nil
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	if l.rules.AgentIdleTimeout > 0 && now.Sub(l.lastSweep) > l.rules.AgentIdleTimeout/2 {
+		l.sweep(now)
+	}
+
+	known := l.agentSeries[agent]
+	var knownSeries reservations
+	if known != nil {
+		knownSeries = known.series
+	}
+	newSeries := make(map[Series]struct{})
+	newAgentSeries := make(map[Series]struct{})
+	for _, s := range series {
+		if _, ok := l.series[s]; !ok {
+			newSeries[s] = struct{}{}
+		}
+		if _, ok := knownSeries[s]; !ok {
+			newAgentSeries[s] = struct{}{}
+		}
+	}
+
+	if l.rules.MaxSeries > 0 && len(l.series)+len(newSeries) > l.rules.MaxSeries {
+		l.stats.Counter(StatRejectedSeriesLimit).Add(int64(len(newSeries)))
+		return cancel, fmt.Errorf("%w: at most %d series are allowed", ErrSeriesLimit, l.rules.MaxSeries)
+	}
+
+	if l.rules.MaxAgentSeries > 0 && len(knownSeries)+len(newAgentSeries) > l.rules.MaxAgentSeries {
+		l.stats.Counter(StatRejectedAgentSeriesLimit).Add(int64(len(newAgentSeries)))
+		return cancel, fmt.Errorf("%w: at most %d series are allowed per agent", ErrAgentSeriesLimit, l.rules.MaxAgentSeries)
+	}
+
+	l.lastID++
+	id := l.lastID
+	if l.rules.MaxSeries > 0 {
+		l.series.reserve(id, series)
+	}
+	if l.rules.MaxAgentSeries > 0 {
+		if known == nil {
+			known = &agentSeries{series: make(reservations)}
+			l.agentSeries[agent] = known
+		}
+		known.series.reserve(id, series)
+		known.lastSeen = now
+	}
+
+	cancel = func() {
+		l.m.Lock()
+		defer l.m.Unlock()
+		l.series.release(id, newSeries)
+		if known != nil {
+			known.series.release(id, newAgentSeries)
+		}
+	}
+	return cancel, nil
+}
+
+// reserve records series as admitted by reservation id. Series admitted by other reservations
+// are marked as used by others, so that their reservations can't release them anymore.
+func (r reservations) reserve(id uint64, series []Series) {
+	for _, s := range series {
+		if owner, ok := r[s]; !ok {
+			r[s] = id
+		} else if owner != id {
+			r[s] = 0
+		}
+	}
+}
+
+// release forgets series admitted by reservation id which nobody else has used since.
+func (r reservations) release(id uint64, series map[Series]struct{}) {
+	for s := range series {
+		if r[s] == id {
+			delete(r, s)
+		}
+	}
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	for agent, known := range l.agentSeries {
+		if now.Sub(known.lastSeen) > l.rules.AgentIdleTimeout {
+			delete(l.agentSeries, agent)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,41 @@
+package limits
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/server/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReserveCancel(t *testing.T) {
+	l := New(Rules{MaxSeries: 2, MaxAgentSeries: 2}, stats.NewRegistry())
+	a := Series{MType: "gauge", Name: "a"}
+	b := Series{MType: "gauge", Name: "b"}
+	c := Series{MType: "gauge", Name: "c"}
+
+	cancel, err := l.Reserve("agent1", a, b)
+	require.NoError(t, err)
+	assert.Error(t, l.Admit("agent2", c), "series are taken until the reservation is cancelled")
+
+	// A concurrent request used b, so it stays once the first reservation is cancelled
+	require.NoError(t, l.Admit("agent2", b))
+	cancel()
+	require.NoError(t, l.Admit("agent2", c))
+	assert.Error(t, l.Admit("agent1", a), "b and c are still there")
+}
+
+func TestAgentIdleTimeout(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := New(Rules{MaxAgentSeries: 1, AgentIdleTimeout: time.Minute}, stats.NewRegistry())
+	l.now = func() time.Time { return now }
+
+	require.NoError(t, l.Admit("agent1", Series{MType: "gauge", Name: "a"}))
+	assert.Error(t, l.Admit("agent1", Series{MType: "gauge", Name: "b"}))
+
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, l.Admit("agent2", Series{MType: "gauge", Name: "a"}))
+	assert.NotContains(t, l.agentSeries, "agent1", "idle agents are forgotten")
+	assert.NoError(t, l.Admit("agent1", Series{MType: "gauge", Name: "b"}))
+}
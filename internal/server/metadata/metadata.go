@@ -0,0 +1,212 @@
+// Package metadata keeps units, descriptions and expected types of metrics reported by agents.
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/models"
+	"github.com/SamMeown/metrix/internal/server/stats"
+	"golang.org/x/exp/slices"
+)
+
+const StatTypeConflicts = "metrics_type_conflicts"
+
+// Max lengths of metadata agents report, in characters as OpenAPI counts them.
+const (
+	MaxUnitLength = 32
+	MaxHelpLength = 256
+)
+
+// saveDelay batches changes made within it into one save
+const saveDelay = time.Second
+
+// Meta describes a metrics. Type is the type the metrics is expected to be reported as,
+// it's declared by agents along with unit or help, or taken from the first report otherwise.
+type Meta struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Unit string `json:"unit,omitempty"`
+	Help string `json:"help,omitempty"`
+	// Conflicts lists other types the metrics has been reported as
+	Conflicts []string `json:"conflicts,omitempty"`
+	Declared  bool     `json:"declared,omitempty"`
+}
+
+type Registry struct {
+	path  string
+	stats *stats.Registry
+
+	m     sync.RWMutex
+	metas map[string]*Meta
+	// saveM keeps saves in order, so that an older snapshot doesn't overwrite a newer one
+	saveM sync.Mutex
+	// pending is set while a save is scheduled
+	pending atomic.Bool
+}
+
+// NewRegistry creates an empty registry. If path is not empty, metadata is saved to it
+// in the background shortly after changes.
+func NewRegistry(path string, stats *stats.Registry) *Registry {
+	return &Registry{
+		path:  path,
+		stats: stats,
+		metas: make(map[string]*Meta),
+	}
+}
+
+// Load restores metadata saved before.
+func (r *Registry) Load() error {
+	if r.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []Meta
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	for i := range saved {
+		r.metas[saved[i].Name] = &saved[i]
+	}
+
+	return nil
+}
+
+// Observe registers metadata and types of reported metrics, detecting metrics reported with different types.
+func (r *Registry) Observe(batch []models.Metrics) {
+	changed := false
+
+	r.m.Lock()
+	for _, m := range batch {
+		if r.observe(m) {
+			changed = true
+		}
+	}
+	r.m.Unlock()
+
+	if changed && r.path != "" && r.pending.CompareAndSwap(false, true) {
+		time.AfterFunc(saveDelay, r.Flush)
+	}
+}
+
+// Flush saves metadata changed since the last save.
+func (r *Registry) Flush() {
+	if !r.pending.Swap(false) {
+		return
+	}
+	if err := r.save(); err != nil {
+		logger.Log.Errorf("Failed to save metrics metadata: %s", err)
+	}
+}
+
+// observe registers a reported metrics and tells if its metadata has changed.
+func (r *Registry) observe(m models.Metrics) bool {
+	declares := m.Unit != "" || m.Help != ""
+
+	meta, ok := r.metas[m.ID]
+	if !ok {
+		r.metas[m.ID] = &Meta{Name: m.ID, Type: m.MType, Unit: m.Unit, Help: m.Help, Declared: declares}
+		return true
+	}
+
+	if m.MType != meta.Type {
+		// The type declared by an agent takes over the one just seen first
+		if declares && !meta.Declared {
+			meta.Conflicts = append(slices.DeleteFunc(meta.Conflicts, func(t string) bool { return t == m.MType }), meta.Type)
+			meta.Type, meta.Unit, meta.Help, meta.Declared = m.MType, m.Unit, m.Help, true
+			return true
+		}
+
+		r.stats.Counter(StatTypeConflicts).Add(1)
+		if slices.Contains(meta.Conflicts, m.MType) {
+			return false
+		}
+		logger.Log.Warnf("Metrics %s is reported as %s, while it is expected to be %s", m.ID, m.MType, meta.Type)
+		meta.Conflicts = append(meta.Conflicts, m.MType)
+		return true
+	}
+
+	if declares && (m.Unit != meta.Unit || m.Help != meta.Help || !meta.Declared) {
+		meta.Unit, meta.Help, meta.Declared = m.Unit, m.Help, true
+		return true
+	}
+
+	return false
+}
+
+// Get returns metadata of the metrics.
+func (r *Registry) Get(name string) (Meta, bool) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	meta, ok := r.metas[name]
+	if !ok {
+		return Meta{}, false
+	}
+	return meta.clone(), true
+}
+
+// All returns metadata of all metrics ordered by name.
+func (r *Registry) All() []Meta {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	rv := make([]Meta, 0, len(r.metas))
+	for _, meta := range r.metas {
+		rv = append(rv, meta.clone())
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+
+	return rv
+}
+
+func (m *Meta) clone() Meta {
+	rv := *m
+	rv.Conflicts = slices.Clone(m.Conflicts)
+	return rv
+}
+
+// save writes metadata to a temporary file first, so that a crash doesn't leave it truncated.
+func (r *Registry) save() error {
+	r.saveM.Lock()
+	defer r.saveM.Unlock()
+
+	data, err := json.Marshal(r.All())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), r.path)
+}
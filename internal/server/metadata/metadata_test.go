@@ -0,0 +1,61 @@
+package metadata
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/SamMeown/metrix/internal/models"
+	"github.com/SamMeown/metrix/internal/server/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.meta")
+	statsRegistry := stats.NewRegistry()
+	registry := NewRegistry(path, statsRegistry)
+
+	registry.Observe([]models.Metrics{
+		{ID: "HeapAlloc", MType: "gauge", Unit: "bytes", Help: "Bytes of allocated heap objects"},
+		{ID: "PollCount", MType: "counter"},
+		{ID: "Sys", MType: "counter"},
+	})
+
+	meta, ok := registry.Get("HeapAlloc")
+	require.True(t, ok)
+	assert.Equal(t, Meta{Name: "HeapAlloc", Type: "gauge", Unit: "bytes", Help: "Bytes of allocated heap objects", Declared: true}, meta)
+	_, ok = registry.Get("Missing")
+	assert.False(t, ok)
+
+	// Reports without metadata keep the declared one
+	registry.Observe([]models.Metrics{{ID: "HeapAlloc", MType: "gauge"}})
+	meta, _ = registry.Get("HeapAlloc")
+	assert.Equal(t, "bytes", meta.Unit)
+
+	// Reports of another type are conflicts, declarations take over types seen first
+	registry.Observe([]models.Metrics{
+		{ID: "HeapAlloc", MType: "counter"},
+		{ID: "HeapAlloc", MType: "counter"},
+		{ID: "PollCount", MType: "gauge"},
+		{ID: "Sys", MType: "gauge", Unit: "bytes"},
+	})
+	assert.Equal(t, []Meta{
+		{Name: "HeapAlloc", Type: "gauge", Unit: "bytes", Help: "Bytes of allocated heap objects", Conflicts: []string{"counter"}, Declared: true},
+		{Name: "PollCount", Type: "counter", Conflicts: []string{"gauge"}},
+		{Name: "Sys", Type: "gauge", Unit: "bytes", Conflicts: []string{"counter"}, Declared: true},
+	}, registry.All())
+	assert.Equal(t, int64(3), statsRegistry.Snapshot()[StatTypeConflicts])
+
+	registry.Flush()
+	restored := NewRegistry(path, nil)
+	require.NoError(t, restored.Load())
+	assert.Equal(t, registry.All(), restored.All())
+}
+
+func TestRegistryWithoutFile(t *testing.T) {
+	registry := NewRegistry("", nil)
+	require.NoError(t, registry.Load())
+
+	registry.Observe([]models.Metrics{{ID: "a", MType: "gauge"}})
+	assert.Len(t, registry.All(), 1)
+}
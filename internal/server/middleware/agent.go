@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/SamMeown/metrix/internal/server/auth"
+)
+
+const AgentIDHeader = "X-Agent-ID"
+
+// AgentID identifies the agent that sent the request: by the agent id header if present,
+// otherwise by the remote host address.
+func AgentID(req *http.Request) string {
+	if id := req.Header.Get(AgentIDHeader); id != "" {
+		return id
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// SeriesOwner identifies the agent whose series count against the per agent series limit:
+// by the authenticated token name, otherwise by the client address. The agent id header
+// isn't used, as clients could get around the limit by changing it.
+func SeriesOwner(trustedProxies []*net.IPNet) ClientKey {
+	byIP := ClientKeyByIP(trustedProxies)
+	return func(req *http.Request) string {
+		if principal := auth.FromContext(req.Context()); principal != nil {
+			return "token:" + principal.Name
+		}
+
+		return byIP(req)
+	}
+}
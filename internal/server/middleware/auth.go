@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/SamMeown/metrix/internal/server/apierror"
+	"github.com/SamMeown/metrix/internal/server/auth"
+)
+
+// Authorizing requires a bearer token with the given scope and stores its principal in the request context.
+func Authorizing(authenticator *auth.Authenticator, scope auth.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			principal := authenticator.Authenticate(req.Header.Get("Authorization"))
+			if principal == nil {
+				res.Header().Set("WWW-Authenticate", `Bearer realm="metrix"`)
+				apierror.Respond(res, req, http.StatusUnauthorized, apierror.CodeUnauthorized, "Authentication required")
+				return
+			}
+
+			if !principal.HasScope(scope) {
+				apierror.Respond(res, req, http.StatusForbidden, apierror.CodeForbidden, "Token has no "+string(scope)+" scope")
+				return
+			}
+
+			next.ServeHTTP(res, req.WithContext(auth.WithPrincipal(req.Context(), principal)))
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
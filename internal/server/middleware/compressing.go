@@ -5,11 +5,15 @@ import (
 	"io"
 	"net/http"
 	"strings"
+
+	"github.com/SamMeown/metrix/internal/server/apierror"
 )
 
 var compressableTypes = []string{
 	"application/json",
+	"application/x-ndjson",
 	"text/html",
+	"text/csv",
 }
 
 type gzipWriter struct {
@@ -71,6 +75,19 @@ func (g *gzipWriter) Write(p []byte) (int, error) {
 	}
 }
 
+// Flush sends compressed data written so far, for streamed responses
+func (g *gzipWriter) Flush() {
+	if g.statusCode == nil {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.shouldCompress() {
+		if err := g.zw.Flush(); err != nil {
+			return
+		}
+	}
+	http.NewResponseController(g.w).Flush()
+}
+
 func (g *gzipWriter) Close() error {
 	if g.shouldCompress() {
 		return g.zw.Close()
@@ -123,7 +140,7 @@ func Compressing(next http.Handler) http.Handler {
 		if gzipEncoded {
 			gr, err := newGzipReader(req.Body)
 			if err != nil {
-				res.WriteHeader(http.StatusInternalServerError)
+				apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, "Failed to decompress body")
 				return
 			}
 			defer gr.Close()
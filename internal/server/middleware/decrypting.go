@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/SamMeown/metrix/internal/crypto/envelope"
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/server/apierror"
+)
+
+// Decrypting opens request bodies encrypted with the server public key.
+// Requests without the encryption header are passed through as is, unless required is set
+// and they have a body.
+func Decrypting(decryptor *envelope.Decryptor, required bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			scheme := req.Header.Get(envelope.Header)
+			if scheme == "" && required {
+				// Only the first byte is read to tell an empty body, so that streamed bodies aren't buffered
+				body := bufio.NewReader(req.Body)
+				if _, err := body.Peek(1); err != io.EOF {
+					if err != nil {
+						respondReadError(res, req, err)
+						return
+					}
+					apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, "Request body must be encrypted")
+					return
+				}
+				req.Body = struct {
+					io.Reader
+					io.Closer
+				}{body, req.Body}
+			}
+			if scheme == "" {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			if scheme != decryptor.Scheme() {
+				apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, "Unsupported content encryption")
+				return
+			}
+
+			sealed, err := io.ReadAll(req.Body)
+			if err != nil {
+				respondReadError(res, req, err)
+				return
+			}
+
+			body, err := decryptor.Decrypt(sealed)
+			if err != nil {
+				logger.Log.Debugf("Failed to decrypt body: %s", err)
+				apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, "Failed to decrypt body")
+				return
+			}
+
+			req.Body.Close()
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			req.Header.Del(envelope.Header)
+
+			next.ServeHTTP(res, req)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/server/apierror"
+	"github.com/SamMeown/metrix/internal/server/idempotency"
+	"github.com/SamMeown/metrix/internal/server/stats"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 128
+	idempotencyStoreTimeout = 5 * time.Second
+)
+
+const StatReplayedIdempotent = "replayed_idempotent_requests"
+
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recordingWriter) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recordingWriter) Write(body []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(body)
+	return r.ResponseWriter.Write(body)
+}
+
+// keyLocks serializes requests with the same idempotency key
+type keyLocks struct {
+	m     sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (k *keyLocks) lock(key string) func() {
+	k.m.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.m.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		k.m.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.m.Unlock()
+	}
+}
+
+// Idempotent answers requests repeating an already processed idempotency key with the remembered response.
+// Keys are scoped by agent, and reusing a key for a different request is rejected.
+// Server errors are not remembered, so such requests can be retried.
+func Idempotent(store idempotency.Store, registry *stats.Registry) func(http.Handler) http.Handler {
+	locks := &keyLocks{locks: make(map[string]*keyLock)}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			key := req.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next.ServeHTTP(res, req)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeIdempotencyKeyInvalid, "Idempotency key is too long")
+				return
+			}
+
+			bodyBytes, err := io.ReadAll(req.Body)
+			if err != nil {
+				apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, "Failed to read body")
+				return
+			}
+			req.Body.Close()
+			req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+			hash := sha256.New()
+			hash.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\n"))
+			hash.Write(bodyBytes)
+			fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+			key = AgentID(req) + "/" + key
+			unlock := locks.lock(key)
+			defer unlock()
+
+			cached, err := store.Get(req.Context(), key)
+			if err != nil {
+				logger.Log.Errorf("Failed to look up idempotency key: %s", err)
+				apierror.Respond(res, req, http.StatusInternalServerError, apierror.CodeInternal, "Internal server error")
+				return
+			}
+			if cached != nil {
+				if cached.Fingerprint != fingerprint {
+					apierror.Respond(res, req, http.StatusUnprocessableEntity, apierror.CodeIdempotencyKeyReused,
+						"Idempotency key was already used for a different request")
+					return
+				}
+
+				logger.Log.Debugf("Replaying response for idempotency key %s", key)
+				registry.Counter(StatReplayedIdempotent).Add(1)
+				if cached.ContentType != "" {
+					res.Header().Set("Content-Type", cached.ContentType)
+				}
+				res.Header().Set(IdempotentReplayedHeader, "true")
+				res.WriteHeader(cached.Status)
+				if _, err := res.Write(cached.Body); err != nil {
+					logger.Log.Errorf("Failed to write response body")
+				}
+				return
+			}
+
+			rw := &recordingWriter{ResponseWriter: res}
+			next.ServeHTTP(rw, req)
+
+			if rw.status == 0 {
+				rw.status = http.StatusOK
+			}
+			if rw.status >= http.StatusInternalServerError {
+				return
+			}
+
+			// The response is already sent, so it has to be remembered even if the client is gone
+			ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+			defer cancel()
+			err = store.Put(ctx, key, idempotency.Response{
+				Fingerprint: fingerprint,
+				Status:      rw.status,
+				ContentType: res.Header().Get("Content-Type"),
+				Body:        rw.body.Bytes(),
+			})
+			if err != nil {
+				logger.Log.Errorf("Failed to remember idempotency key: %s", err)
+			}
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/server/apierror"
+	"github.com/SamMeown/metrix/internal/server/ratelimit"
+	"github.com/SamMeown/metrix/internal/server/stats"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	StatRejectedRateLimit    = "rejected_requests_rate_limit"
+	StatRejectedBodyTooLarge = "rejected_requests_body_too_large"
+)
+
+// ClientKey identifies the client that sent the request for rate limiting.
+type ClientKey func(req *http.Request) string
+
+func ClientKeyByIP(trustedProxies []*net.IPNet) ClientKey {
+	return func(req *http.Request) string {
+		return "ip:" + ClientIP(req, trustedProxies).String()
+	}
+}
+
+// ClientKeyByAgent identifies clients by the agent id header. Clients choose it themselves,
+// so it only suits agents that are trusted not to get around the limit by changing it.
+func ClientKeyByAgent(req *http.Request) string {
+	return "agent:" + AgentID(req)
+}
+
+// ClientKeyByToken identifies clients by their bearer token, falling back to the client address for requests without one.
+func ClientKeyByToken(trustedProxies []*net.IPNet) ClientKey {
+	byIP := ClientKeyByIP(trustedProxies)
+	return func(req *http.Request) string {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			return byIP(req)
+		}
+
+		hash := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(hash[:])
+	}
+}
+
+// RateLimiting rejects requests of clients that are over the limiter rate with 429 Too Many Requests.
+func RateLimiting(limiter *ratelimit.Limiter, clientKey ClientKey, registry *stats.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			key := clientKey(req)
+			if ok, wait := limiter.Allow(key); !ok {
+				logger.Log.Debugf("Request rate limit exceeded by %s", key)
+				registry.Counter(StatRejectedRateLimit).Add(1)
+				res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				apierror.Respond(res, req, http.StatusTooManyRequests, apierror.CodeRateLimited, "Too many requests")
+				return
+			}
+
+			next.ServeHTTP(res, req)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Except applies middleware to requests to paths other than the given ones.
+func Except(middleware func(http.Handler) http.Handler, paths ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := middleware(next)
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			if slices.Contains(paths, req.URL.Path) {
+				next.ServeHTTP(res, req)
+				return
+			}
+			wrapped.ServeHTTP(res, req)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Only applies middleware to requests to the given paths.
+func Only(middleware func(http.Handler) http.Handler, paths ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := middleware(next)
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			if !slices.Contains(paths, req.URL.Path) {
+				next.ServeHTTP(res, req)
+				return
+			}
+			wrapped.ServeHTTP(res, req)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// respondReadError rejects a request whose body couldn't be read, with 413 if it is over a body limit.
+func respondReadError(res http.ResponseWriter, req *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		apierror.Respond(res, req, http.StatusRequestEntityTooLarge, apierror.CodeBodyTooLarge, "Request body is too large")
+		return
+	}
+
+	apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, "Failed to read body")
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	registry *stats.Registry
+	counted  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if !b.counted && errors.As(err, &maxBytesErr) {
+		b.counted = true
+		b.registry.Counter(StatRejectedBodyTooLarge).Add(1)
+	}
+
+	return n, err
+}
+
+// LimitingStream limits request body to maxBytes without reading it, for handlers which process
+// bodies as they read them. Reading past the limit fails with *http.MaxBytesError.
+func LimitingStream(maxBytes int64, registry *stats.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			req.Body = &limitedBody{ReadCloser: http.MaxBytesReader(res, req.Body, maxBytes), registry: registry}
+
+			next.ServeHTTP(res, req)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// LimitingBody reads request body up to maxBytes and rejects larger ones with 413 Request Entity Too Large.
+// Applied after Compressing it limits the decompressed size, which is what handlers have to deal with.
+func LimitingBody(maxBytes int64, registry *stats.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			bodyBytes, err := io.ReadAll(http.MaxBytesReader(res, req.Body, maxBytes))
+			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					registry.Counter(StatRejectedBodyTooLarge).Add(1)
+				}
+				respondReadError(res, req, err)
+				return
+			}
+
+			req.Body.Close()
+			req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+			next.ServeHTTP(res, req)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
@@ -28,6 +28,10 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 	r.responseData.status = statusCode
 }
 
+func (r *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func Logging(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
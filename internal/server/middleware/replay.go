@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrStaleRequest   = errors.New("request timestamp is outside the allowed window")
+	ErrReplayedNonce  = errors.New("request nonce was already used")
+	ErrNonceCacheFull = errors.New("too many signed requests within the allowed window")
+)
+
+type nonceEntry struct {
+	nonce string
+	seen  time.Time
+}
+
+// ReplayGuard rejects signed requests whose timestamp is too far from the server clock
+// or whose nonce has been seen within the window. It remembers at most capacity nonces
+// (0 means no limit). Nonces are only forgotten once their requests are too old to be replayed,
+// so new nonces are rejected while the cache is full.
+type ReplayGuard struct {
+	window       time.Duration
+	capacity     int
+	acceptLegacy bool
+	now          func() time.Time
+
+	m     sync.Mutex
+	seen  map[string]struct{}
+	order []nonceEntry
+}
+
+func NewReplayGuard(window time.Duration, capacity int, acceptLegacy bool) *ReplayGuard {
+	return &ReplayGuard{
+		window:       window,
+		capacity:     capacity,
+		acceptLegacy: acceptLegacy,
+		now:          time.Now,
+		seen:         make(map[string]struct{}),
+	}
+}
+
+// Check validates timestamp (unix seconds) and records nonce.
+func (g *ReplayGuard) Check(timestamp, nonce string) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" {
+		return ErrStaleRequest
+	}
+
+	now := g.now()
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > g.window || skew < -g.window {
+		return ErrStaleRequest
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	// Nonces older than twice the window belong to requests that would be rejected by timestamp anyway
+	for len(g.order) > 0 && now.Sub(g.order[0].seen) > 2*g.window {
+		delete(g.seen, g.order[0].nonce)
+		g.order = g.order[1:]
+	}
+
+	if _, ok := g.seen[nonce]; ok {
+		return ErrReplayedNonce
+	}
+	if g.capacity > 0 && len(g.order) >= g.capacity {
+		return ErrNonceCacheFull
+	}
+
+	g.seen[nonce] = struct{}{}
+	g.order = append(g.order, nonceEntry{nonce: nonce, seen: now})
+
+	return nil
+}
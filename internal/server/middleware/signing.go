@@ -2,27 +2,55 @@ package middleware
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"github.com/SamMeown/metrix/internal/crypto/signer"
 	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/server/apierror"
+	"github.com/SamMeown/metrix/internal/server/stats"
 	"io"
 	"net/http"
 )
 
 type deferredWriter struct {
 	http.ResponseWriter
-	status int
-	body   bytes.Buffer
+	status    int
+	body      bytes.Buffer
+	streaming bool
 }
 
 func (d *deferredWriter) WriteHeader(status int) {
+	if d.streaming {
+		d.ResponseWriter.WriteHeader(status)
+		return
+	}
 	d.status = status
 }
 
 func (d *deferredWriter) Write(body []byte) (int, error) {
+	if d.streaming {
+		return d.ResponseWriter.Write(body)
+	}
 	return d.body.Write(body)
 }
 
-func Signing(signer *signer.Signer) func(http.Handler) http.Handler {
+// Flush switches to streaming, as a body which is never complete can't be signed.
+// Streamed responses are sent unsigned.
+func (d *deferredWriter) Flush() {
+	if !d.streaming {
+		d.streaming = true
+		if d.status != 0 {
+			d.ResponseWriter.WriteHeader(d.status)
+		}
+		if _, err := io.Copy(d.ResponseWriter, &d.body); err != nil {
+			return
+		}
+	}
+	http.NewResponseController(d.ResponseWriter).Flush()
+}
+
+// Signing signs response bodies with the primary key of keyring.
+func Signing(keyring *signer.Keyring) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(res http.ResponseWriter, req *http.Request) {
 			dr := &deferredWriter{
@@ -30,10 +58,17 @@ func Signing(signer *signer.Signer) func(http.Handler) http.Handler {
 			}
 
 			next.ServeHTTP(dr, req)
+			if dr.streaming {
+				return
+			}
 
 			if dr.body.Len() > 0 {
-				signature := signer.GetSignature(dr.body.Bytes())
-				res.Header().Add("HashSHA256", signature)
+				keyID, contentSigner := keyring.Primary()
+				signature := contentSigner.GetSignature(dr.body.Bytes())
+				res.Header().Add(signer.HeaderSignature, signature)
+				if keyID != "" {
+					res.Header().Set(signer.HeaderKeyID, keyID)
+				}
 			}
 
 			if dr.status != 0 {
@@ -51,29 +86,153 @@ func Signing(signer *signer.Signer) func(http.Handler) http.Handler {
 	}
 }
 
-func SignValidating(signer *signer.Signer) func(http.Handler) http.Handler {
+type SignPolicy string
+
+const (
+	// SignPolicyOff disables request signature checks
+	SignPolicyOff SignPolicy = "off"
+	// SignPolicyPermissive logs and counts unsigned requests but lets them through, bad signatures are still rejected
+	SignPolicyPermissive SignPolicy = "permissive"
+	// SignPolicyEnforce additionally rejects update requests without signatures
+	SignPolicyEnforce SignPolicy = "enforce"
+)
+
+const (
+	StatRejectedInvalidSignature = "rejected_requests_invalid_signature"
+	StatRejectedMissingSignature = "rejected_requests_missing_signature"
+	StatRejectedReplayedRequest  = "rejected_requests_replayed"
+	StatUnverifiedRequests       = "unverified_requests"
+)
+
+var (
+	errSignatureMissing = errors.New("content signature not found")
+	errSignatureInvalid = errors.New("content signature is not valid")
+	errUnknownKey       = errors.New("unknown signature key")
+	errLegacySignature  = errors.New("content signature has no timestamp and nonce")
+)
+
+type signatureCheckKey struct{}
+
+type signatureCheck struct {
+	err error
+}
+
+func getSignatureCheck(req *http.Request) signatureCheck {
+	check, ok := req.Context().Value(signatureCheckKey{}).(signatureCheck)
+	if !ok {
+		return signatureCheck{err: errSignatureMissing}
+	}
+
+	return check
+}
+
+func verifyRequest(keyring *signer.Keyring, guard *ReplayGuard, req *http.Request, body []byte) error {
+	signature := req.Header.Get(signer.HeaderSignature)
+	if signature == "" {
+		return errSignatureMissing
+	}
+
+	contentSigner := keyring.Signer(req.Header.Get(signer.HeaderKeyID))
+	if contentSigner == nil {
+		return errUnknownKey
+	}
+
+	timestamp := req.Header.Get(signer.HeaderTimestamp)
+	nonce := req.Header.Get(signer.HeaderNonce)
+	if timestamp == "" && nonce == "" {
+		if guard != nil && !guard.acceptLegacy {
+			return errLegacySignature
+		}
+		if !contentSigner.ValidateSignature(signature, body) {
+			return errSignatureInvalid
+		}
+		// Legacy signatures cover the body only, so they prove nothing about bodyless requests
+		if len(body) == 0 {
+			return errSignatureMissing
+		}
+
+		return nil
+	}
+
+	if !contentSigner.ValidateRequestSignature(signature, req.Method, req.URL.EscapedPath(), timestamp, nonce, body) {
+		return errSignatureInvalid
+	}
+	if guard != nil {
+		return guard.Check(timestamp, nonce)
+	}
+
+	return nil
+}
+
+// SignValidating checks request signatures made with the keyring key given by the key id header
+// (or the primary key if there is none). Signatures covering the canonical request (method, path,
+// timestamp, nonce and body) are additionally checked by guard, if it is set, to reject replayed requests.
+// Requests with bad signatures, unknown keys, stale timestamps or replayed nonces are rejected whatever
+// the policy is, as none of them come from an agent which hasn't been upgraded yet. Requests without
+// signatures are passed through, SignRequired decides on them according to policy.
+func SignValidating(keyring *signer.Keyring, guard *ReplayGuard, registry *stats.Registry) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(res http.ResponseWriter, req *http.Request) {
-			bodyBytes, err := io.ReadAll(req.Body)
-			if err != nil {
-				http.Error(res, "Failed to read body", http.StatusInternalServerError)
+			// Unsigned bodies are left unread, so that streamed ones aren't buffered
+			if req.Header.Get(signer.HeaderSignature) == "" {
+				logger.Log.Debugln("Content signature not found")
+				req = req.WithContext(context.WithValue(req.Context(), signatureCheckKey{}, signatureCheck{err: errSignatureMissing}))
+				next.ServeHTTP(res, req)
 				return
 			}
 
-			signature := req.Header.Get("HashSHA256")
-			if signature == "" && len(bodyBytes) > 0 {
-				logger.Log.Debugln("Content signature not found")
-				//http.Error(res, "Content signature not found", http.StatusBadRequest)
-				//return
-			}
-			if signature != "" && !signer.ValidateSignature(signature, bodyBytes) {
-				http.Error(res, "Content signature is not valid", http.StatusBadRequest)
+			bodyBytes, err := io.ReadAll(req.Body)
+			if err != nil {
+				respondReadError(res, req, err)
 				return
 			}
 
 			req.Body.Close()
 			req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
+			err = verifyRequest(keyring, guard, req, bodyBytes)
+			req = req.WithContext(context.WithValue(req.Context(), signatureCheckKey{}, signatureCheck{err: err}))
+			switch {
+			case err == nil:
+			case errors.Is(err, errSignatureMissing):
+				// Legacy signatures of bodyless requests prove nothing, SignRequired treats them as missing
+			case errors.Is(err, ErrNonceCacheFull):
+				logger.Log.Warnf("Signed request rejected: %s", err)
+				apierror.Respond(res, req, http.StatusTooManyRequests, apierror.CodeRateLimited, err.Error())
+				return
+			default:
+				logger.Log.Debugf("Signed request rejected: %s", err)
+				if errors.Is(err, ErrStaleRequest) || errors.Is(err, ErrReplayedNonce) {
+					registry.Counter(StatRejectedReplayedRequest).Add(1)
+				} else {
+					registry.Counter(StatRejectedInvalidSignature).Add(1)
+				}
+				apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeInvalidSignature, err.Error())
+				return
+			}
+
+			next.ServeHTTP(res, req)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// SignRequired rejects (or logs, depending on policy) unsigned requests. It relies on SignValidating being applied first.
+func SignRequired(policy SignPolicy, registry *stats.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			// Requests with bad signatures are already rejected or counted by SignValidating
+			if check := getSignatureCheck(req); errors.Is(check.err, errSignatureMissing) {
+				if policy == SignPolicyEnforce {
+					registry.Counter(StatRejectedMissingSignature).Add(1)
+					apierror.Respond(res, req, http.StatusUnauthorized, apierror.CodeInvalidSignature, "Content signature not found")
+					return
+				}
+				logger.Log.Warnf("Unsigned request to %s", req.URL.Path)
+				registry.Counter(StatUnverifiedRequests).Add(1)
+			}
+
 			next.ServeHTTP(res, req)
 		}
 
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/server/apierror"
+)
+
+const RealIPHeader = "X-Real-IP"
+
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the request peer address, or the X-Real-IP header value
+// if the peer is one of the trusted proxies.
+func ClientIP(req *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	if ip != nil && containsIP(trustedProxies, ip) {
+		if realIP := net.ParseIP(req.Header.Get(RealIPHeader)); realIP != nil {
+			return realIP
+		}
+	}
+
+	return ip
+}
+
+// TrustedSubnet only lets through requests from clients within subnets.
+func TrustedSubnet(subnets []*net.IPNet, trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			ip := ClientIP(req, trustedProxies)
+			if ip == nil || !containsIP(subnets, ip) {
+				logger.Log.Debugf("Request from untrusted address %s (%s)", ip, req.RemoteAddr)
+				apierror.Respond(res, req, http.StatusForbidden, apierror.CodeForbidden, "Client address is not trusted")
+				return
+			}
+
+			next.ServeHTTP(res, req)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
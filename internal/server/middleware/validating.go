@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/openapi"
+	"github.com/SamMeown/metrix/internal/server/apierror"
+)
+
+// itemIndex returns the batch item index a validation error path points into, e.g. 3 for "/3/value".
+func itemIndex(path string) *int {
+	first, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	index, err := strconv.Atoi(first)
+	if err != nil || path == "" {
+		return nil
+	}
+
+	return &index
+}
+
+// Validating checks JSON request bodies against the schema the OpenAPI document gives for operation at path.
+func Validating(validator *openapi.Validator, path string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(res http.ResponseWriter, req *http.Request) {
+			if !validator.Validates(req.Method, path) {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			bodyBytes, err := io.ReadAll(req.Body)
+			if err != nil {
+				apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, "Failed to read body")
+				return
+			}
+			req.Body.Close()
+			req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+
+			validationErrs, err := validator.ValidateRequest(req.Method, path, bodyBytes)
+			if err != nil {
+				apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeInvalidJSON, Message: err.Error()})
+				return
+			}
+
+			if len(validationErrs) > 0 {
+				logger.Log.Debugf("Request body does not match the schema: %v", validationErrs)
+				apiErr := apierror.Error{
+					Code:    apierror.CodeSchemaViolation,
+					Message: "Request body does not match the schema",
+				}
+				for _, validationErr := range validationErrs {
+					apiErr.Errors = append(apiErr.Errors, apierror.Error{
+						Code:    apierror.CodeSchemaViolation,
+						Message: validationErr.Error(),
+						Index:   itemIndex(validationErr.Path),
+					})
+				}
+				apierror.Write(res, http.StatusBadRequest, apiErr)
+				return
+			}
+
+			next.ServeHTTP(res, req)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
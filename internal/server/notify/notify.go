@@ -0,0 +1,313 @@
+// Package notify sends alert state changes to webhook receivers.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/backoff"
+	"github.com/SamMeown/metrix/internal/crypto/signer"
+	"github.com/SamMeown/metrix/internal/logger"
+	"github.com/SamMeown/metrix/internal/server/alerting"
+	"golang.org/x/exp/slices"
+)
+
+const queueSize = 256
+
+// Duration is a time.Duration read from strings like "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// Receiver is an entry of the receivers file, e.g.
+//
+//	{"receivers": [{"name": "ops", "url": "https://example.com/hook", "secret": "...", "groupWait": "30s"}]}
+//
+// Alerts changing state within groupWait are sent in one notification. Template is a text/template
+// of the JSON body executed with Notification, the notification itself is sent if it's empty.
+// States default to firing and resolved, retries are backoff delays in seconds.
+type Receiver struct {
+	Name      string            `json:"name"`
+	URL       string            `json:"url"`
+	Secret    string            `json:"secret,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Template  string            `json:"template,omitempty"`
+	States    []alerting.State  `json:"states,omitempty"`
+	GroupWait Duration          `json:"groupWait,omitempty"`
+	Retries   []int             `json:"retries,omitempty"`
+}
+
+type receiversFile struct {
+	Receivers []Receiver `json:"receivers"`
+}
+
+// Notification is a group of alert changes sent to a receiver.
+type Notification struct {
+	Receiver string `json:"receiver"`
+	// Status is firing if any of the alerts is firing and resolved otherwise
+	Status alerting.State   `json:"status"`
+	Alerts []alerting.Alert `json:"alerts"`
+}
+
+func Load(path string) ([]Receiver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file receiversFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	return file.Receivers, nil
+}
+
+type receiver struct {
+	Receiver
+	template *template.Template
+	signer   *signer.Signer
+	queue    chan alerting.Alert
+	// sent is the last state change sent for every rule
+	sent map[string]string
+}
+
+type Notifier struct {
+	client    *http.Client
+	receivers []*receiver
+}
+
+// New creates notifier sending with client. Call Run to start sending.
+func New(receivers []Receiver, client *http.Client) (*Notifier, error) {
+	n := &Notifier{client: client}
+	for _, r := range receivers {
+		if r.Name == "" {
+			return nil, fmt.Errorf("receiver %q has no name", r.URL)
+		}
+		if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("receiver %s: bad url %q", r.Name, r.URL)
+		}
+		if len(r.States) == 0 {
+			r.States = []alerting.State{alerting.StateFiring, alerting.StateResolved}
+		}
+
+		rcv := &receiver{
+			Receiver: r,
+			signer:   signer.New(r.Secret),
+			queue:    make(chan alerting.Alert, queueSize),
+			sent:     make(map[string]string),
+		}
+		if r.Template != "" {
+			var err error
+			rcv.template, err = template.New(r.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(r.Template)
+			if err != nil {
+				return nil, fmt.Errorf("receiver %s: %w", r.Name, err)
+			}
+		}
+		n.receivers = append(n.receivers, rcv)
+	}
+
+	return n, nil
+}
+
+func toJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// Notify queues the alert to receivers interested in its state. It doesn't block, so it's dropped if a queue is full.
+func (n *Notifier) Notify(alert alerting.Alert) {
+	for _, r := range n.receivers {
+		if !slices.Contains(r.States, alert.State) {
+			continue
+		}
+
+		select {
+		case r.queue <- alert:
+		default:
+			logger.Log.Errorf("Notification queue of %s is full, alert %s is dropped", r.Name, alert.Rule)
+		}
+	}
+}
+
+// Run sends queued alerts until ctx is done.
+func (n *Notifier) Run(ctx context.Context) {
+	done := make(chan struct{})
+	for _, r := range n.receivers {
+		go func(r *receiver) {
+			n.run(ctx, r)
+			done <- struct{}{}
+		}(r)
+	}
+
+	for range n.receivers {
+		<-done
+	}
+}
+
+func (n *Notifier) run(ctx context.Context, r *receiver) {
+	var group []alerting.Alert
+	var groupTimer *time.Timer
+	var groupDone <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			if groupTimer != nil {
+				groupTimer.Stop()
+			}
+			return
+		case alert := <-r.queue:
+			// A later change of the same rule replaces the earlier one within a group
+			i := slices.IndexFunc(group, func(a alerting.Alert) bool { return a.Rule == alert.Rule })
+			if i >= 0 {
+				group[i] = alert
+			} else {
+				group = append(group, alert)
+			}
+			if groupTimer == nil {
+				groupTimer = time.NewTimer(time.Duration(r.GroupWait))
+				groupDone = groupTimer.C
+			}
+		case <-groupDone:
+			n.sendGroup(ctx, r, group)
+			group, groupTimer, groupDone = nil, nil, nil
+		}
+	}
+}
+
+func changeKey(alert alerting.Alert) string {
+	key := string(alert.State)
+	if alert.ActiveAt != nil {
+		key += " " + alert.ActiveAt.String()
+	}
+	return key
+}
+
+// sendGroup sends the group of alerts, skipping changes already sent
+func (n *Notifier) sendGroup(ctx context.Context, r *receiver, group []alerting.Alert) {
+	alerts := make([]alerting.Alert, 0, len(group))
+	for _, alert := range group {
+		if r.sent[alert.Rule] != changeKey(alert) {
+			alerts = append(alerts, alert)
+		}
+	}
+	if len(alerts) == 0 {
+		return
+	}
+
+	notification := Notification{Receiver: r.Name, Status: alerting.StateResolved, Alerts: alerts}
+	for _, alert := range alerts {
+		if alert.State == alerting.StateFiring {
+			notification.Status = alerting.StateFiring
+		}
+	}
+
+	if err := n.send(ctx, r, notification); err != nil {
+		logger.Log.Errorf("Failed to notify %s: %s", r.Name, err)
+		return
+	}
+
+	for _, alert := range alerts {
+		r.sent[alert.Rule] = changeKey(alert)
+	}
+}
+
+func (r *receiver) body(notification Notification) ([]byte, error) {
+	if r.template == nil {
+		return json.Marshal(notification)
+	}
+
+	var buf bytes.Buffer
+	if err := r.template.Execute(&buf, notification); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("template result is not a valid JSON")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(nonce), nil
+}
+
+// send posts the notification, retrying on network errors and server side failures
+func (n *Notifier) send(ctx context.Context, r *receiver, notification Notification) error {
+	body, err := r.body(notification)
+	if err != nil {
+		return err
+	}
+
+	return backoff.NewBackoff(r.Retries, nil).RetryContext(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range r.Headers {
+			req.Header.Set(name, value)
+		}
+
+		if r.signer != nil {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			nonce, err := newNonce()
+			if err != nil {
+				return err
+			}
+			req.Header.Set(signer.HeaderSignature, r.signer.GetRequestSignature(req.Method, req.URL.EscapedPath(), timestamp, nonce, body))
+			req.Header.Set(signer.HeaderTimestamp, timestamp)
+			req.Header.Set(signer.HeaderNonce, nonce)
+		}
+
+		res, err := n.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return backoff.NewRetryableError(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+
+		switch {
+		case res.StatusCode < 300:
+			return nil
+		case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+			return backoff.NewRetryableError(fmt.Errorf("receiver responded %s", res.Status))
+		default:
+			return fmt.Errorf("receiver responded %s", res.Status)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/crypto/signer"
+	"github.com/SamMeown/metrix/internal/server/alerting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testReceiver is a webhook receiver checking signatures and remembering received bodies.
+// It fails the first failures requests with 503.
+type testReceiver struct {
+	*httptest.Server
+	t      *testing.T
+	secret string
+
+	m        sync.Mutex
+	failures int
+	bodies   chan []byte
+}
+
+func newTestReceiver(t *testing.T, secret string, failures int) *testReceiver {
+	r := &testReceiver{t: t, secret: secret, failures: failures, bodies: make(chan []byte, 16)}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.handle))
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+func (r *testReceiver) handle(res http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	require.NoError(r.t, err)
+
+	if r.secret != "" {
+		valid := signer.New(r.secret).ValidateRequestSignature(
+			req.Header.Get(signer.HeaderSignature),
+			req.Method,
+			req.URL.EscapedPath(),
+			req.Header.Get(signer.HeaderTimestamp),
+			req.Header.Get(signer.HeaderNonce),
+			body,
+		)
+		if !assert.True(r.t, valid, "signature is valid") {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	r.m.Lock()
+	fail := r.failures > 0
+	r.failures--
+	r.m.Unlock()
+	if fail {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	r.bodies <- body
+}
+
+func (r *testReceiver) next() []byte {
+	select {
+	case body := <-r.bodies:
+		return body
+	case <-time.After(3 * time.Second):
+		require.FailNow(r.t, "no notification received")
+		return nil
+	}
+}
+
+func (r *testReceiver) none() {
+	select {
+	case body := <-r.bodies:
+		assert.Failf(r.t, "unexpected notification", "%s", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	plain := newTestReceiver(t, "secret", 0)
+	templated := newTestReceiver(t, "", 1)
+
+	notifier, err := New([]Receiver{
+		{Name: "plain", URL: plain.URL + "/hook", Secret: "secret", GroupWait: Duration(50 * time.Millisecond)},
+		{
+			Name:      "templated",
+			URL:       templated.URL,
+			Template:  `{"text": {{json (printf "%s: %d alerts" .Status (len .Alerts))}}}`,
+			States:    []alerting.State{alerting.StateFiring},
+			GroupWait: Duration(50 * time.Millisecond),
+			Retries:   []int{1},
+		},
+	}, http.DefaultClient)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.Run(ctx)
+
+	activeAt := time.Unix(1000, 0)
+	alert := func(rule string, state alerting.State) alerting.Alert {
+		return alerting.Alert{Rule: rule, Expr: rule + " > 1", Metric: rule, State: state, ActiveAt: &activeAt}
+	}
+
+	notifier.Notify(alert("a", alerting.StateFiring))
+	notifier.Notify(alert("b", alerting.StateFiring))
+	notifier.Notify(alert("b", alerting.StateResolved))
+
+	var notification Notification
+	require.NoError(t, json.Unmarshal(plain.next(), &notification))
+	assert.Equal(t, "plain", notification.Receiver)
+	assert.Equal(t, alerting.StateFiring, notification.Status)
+	require.Len(t, notification.Alerts, 2, "changes are grouped")
+	assert.Equal(t, alerting.StateFiring, notification.Alerts[0].State)
+	assert.Equal(t, alerting.StateResolved, notification.Alerts[1].State, "only the last change of a rule is sent")
+
+	assert.JSONEq(t, `{"text": "firing: 2 alerts"}`, string(templated.next()), "delivered after retry")
+
+	t.Run("test the same change is not sent again", func(t *testing.T) {
+		notifier.Notify(alert("a", alerting.StateFiring))
+		plain.none()
+		templated.none()
+	})
+
+	t.Run("test receivers get only their states", func(t *testing.T) {
+		notifier.Notify(alert("a", alerting.StateResolved))
+
+		require.NoError(t, json.Unmarshal(plain.next(), &notification))
+		assert.Equal(t, alerting.StateResolved, notification.Status)
+		templated.none()
+	})
+}
+
+func TestNewNotifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		receiver Receiver
+	}{
+		{"test no name", Receiver{URL: "http://localhost/hook"}},
+		{"test bad url", Receiver{Name: "a", URL: "localhost/hook"}},
+		{"test bad template", Receiver{Name: "a", URL: "http://localhost/hook", Template: "{{.Status"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New([]Receiver{tt.receiver}, http.DefaultClient)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Package prometheus writes metrics in the Prometheus text exposition format.
+package prometheus
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SamMeown/metrix/internal/server/metadata"
+	"github.com/SamMeown/metrix/internal/storage"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// Name turns a metrics name into a valid Prometheus one, replacing invalid characters with underscores.
+func Name(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+type family struct {
+	name  string
+	mType string
+	value float64
+	meta  metadata.Meta
+}
+
+// Write writes items the allow func allows, with help and units from registry.
+// A name can have one type only, so metrics reported with a type other than the expected one are skipped,
+// as well as metrics having the same name as others after replacing invalid characters.
+func Write(w io.Writer, items storage.MetricsStorageItems, registry *metadata.Registry, allow func(name string) bool) error {
+	var families []family
+	add := func(name, mType string, value float64) {
+		if !allow(name) {
+			return
+		}
+		meta, ok := registry.Get(name)
+		if ok && meta.Type != mType {
+			return
+		}
+		families = append(families, family{name: name, mType: mType, value: value, meta: meta})
+	}
+	for name, value := range items.Gauges {
+		add(name, storage.MetricsTypeGauge, value)
+	}
+	for name, value := range items.Counters {
+		add(name, storage.MetricsTypeCounter, float64(value))
+	}
+	sort.Slice(families, func(i, j int) bool {
+		if families[i].name != families[j].name {
+			return families[i].name < families[j].name
+		}
+		return families[i].mType < families[j].mType
+	})
+
+	bw := bufio.NewWriter(w)
+	written := make(map[string]struct{}, len(families))
+	for _, f := range families {
+		name := Name(f.name)
+		if _, ok := written[name]; ok {
+			continue
+		}
+		written[name] = struct{}{}
+
+		help := f.meta.Help
+		if f.meta.Unit != "" {
+			help = strings.TrimSpace(help + " (" + f.meta.Unit + ")")
+		}
+		if help != "" {
+			bw.WriteString("# HELP " + name + " " + helpEscaper.Replace(help) + "\n")
+		}
+		bw.WriteString("# TYPE " + name + " " + f.mType + "\n")
+		bw.WriteString(name + " " + formatValue(f.value) + "\n")
+	}
+
+	return bw.Flush()
+}
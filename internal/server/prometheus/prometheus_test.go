@@ -0,0 +1,56 @@
+package prometheus
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/SamMeown/metrix/internal/models"
+	"github.com/SamMeown/metrix/internal/server/metadata"
+	"github.com/SamMeown/metrix/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestName(t *testing.T) {
+	assert.Equal(t, "HeapAlloc", Name("HeapAlloc"))
+	assert.Equal(t, "agent_cpu:usage", Name("agent.cpu:usage"))
+	assert.Equal(t, "_1m_load", Name("1m load"))
+	assert.Equal(t, "a_b", Name("a-b"))
+}
+
+func TestWrite(t *testing.T) {
+	registry := metadata.NewRegistry("", nil)
+	registry.Observe([]models.Metrics{
+		{ID: "HeapAlloc", MType: "gauge", Unit: "bytes", Help: "Bytes of allocated\nheap objects"},
+		{ID: "Conflicting", MType: "gauge"},
+	})
+
+	items := storage.MetricsStorageItems{
+		Gauges: map[string]float64{
+			"HeapAlloc":   1024,
+			"Conflicting": 1,
+			"Ratio.a":     math.Inf(1),
+			"Ratio_a":     2,
+			"Secret":      3,
+		},
+		Counters: map[string]int64{
+			"PollCount":   5,
+			"Conflicting": 2,
+		},
+	}
+
+	var b strings.Builder
+	err := Write(&b, items, registry, func(name string) bool { return name != "Secret" })
+	require.NoError(t, err)
+	assert.Equal(t, `# TYPE Conflicting gauge
+Conflicting 1
+# HELP HeapAlloc Bytes of allocated\nheap objects (bytes)
+# TYPE HeapAlloc gauge
+HeapAlloc 1024
+# TYPE PollCount counter
+PollCount 5
+# TYPE Ratio_a gauge
+Ratio_a +Inf
+`, b.String())
+}
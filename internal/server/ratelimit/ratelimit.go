@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket rate limiter with a bucket per key.
+// Buckets refilled to the burst size are dropped periodically, so idle clients don't take memory.
+type Limiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	m         sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New creates limiter allowing rate requests per second with bursts of up to burst requests.
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the key bucket. If there is none, it returns false
+// and the time after which a token will be available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
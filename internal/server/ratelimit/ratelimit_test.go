@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok)
+	}
+
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other keys have their own buckets
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+
+	now = now.Add(time.Hour)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, 1, "idle buckets are swept")
+}
@@ -6,12 +6,14 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/SamMeown/metrix/internal/models"
 	"github.com/SamMeown/metrix/internal/storage"
 )
 
 type MetricsStorageSaver struct {
+	m       sync.Mutex
 	storage storage.MetricsStorage
 	file    *os.File
 	writer  *bufio.Writer
@@ -33,6 +35,9 @@ func NewMetricsStorageSaver(storage storage.MetricsStorage, path string) (*Metri
 }
 
 func (s *MetricsStorageSaver) Load(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
 	for {
 		data, err := s.reader.ReadBytes('\n')
 		if err != nil {
@@ -63,6 +68,9 @@ func (s *MetricsStorageSaver) Load(ctx context.Context) error {
 }
 
 func (s *MetricsStorageSaver) Save(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
 	snapshot, err := s.storage.GetAll(ctx)
 	if err != nil {
 		return err
@@ -108,3 +116,10 @@ func (s *MetricsStorageSaver) Save(ctx context.Context) error {
 
 	return s.writer.Flush()
 }
+
+func (s *MetricsStorageSaver) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.file.Close()
+}
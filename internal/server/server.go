@@ -1,72 +1,185 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/SamMeown/metrix/internal/crypto/envelope"
 	"github.com/SamMeown/metrix/internal/crypto/signer"
+	"github.com/SamMeown/metrix/internal/crypto/tlsconf"
 	"golang.org/x/exp/maps"
-	"log"
+	"io"
+	"math"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/SamMeown/metrix/internal/logger"
 	"github.com/SamMeown/metrix/internal/models"
+	"github.com/SamMeown/metrix/internal/openapi"
+	"github.com/SamMeown/metrix/internal/server/alerting"
+	"github.com/SamMeown/metrix/internal/server/apierror"
+	"github.com/SamMeown/metrix/internal/server/auth"
 	"github.com/SamMeown/metrix/internal/server/config"
+	"github.com/SamMeown/metrix/internal/server/dashboard"
+	"github.com/SamMeown/metrix/internal/server/derived"
+	"github.com/SamMeown/metrix/internal/server/expr"
+	"github.com/SamMeown/metrix/internal/server/history"
+	"github.com/SamMeown/metrix/internal/server/idempotency"
+	"github.com/SamMeown/metrix/internal/server/limits"
+	"github.com/SamMeown/metrix/internal/server/metadata"
 	middlewares "github.com/SamMeown/metrix/internal/server/middleware"
+	"github.com/SamMeown/metrix/internal/server/notify"
+	"github.com/SamMeown/metrix/internal/server/prometheus"
+	"github.com/SamMeown/metrix/internal/server/ratelimit"
 	"github.com/SamMeown/metrix/internal/server/saver"
+	"github.com/SamMeown/metrix/internal/server/stats"
+	"github.com/SamMeown/metrix/internal/server/stream"
 	"github.com/SamMeown/metrix/internal/storage"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
-var tableTemplate = `
-<!DOCTYPE html>
-<html>
-<head>
-<style>
-table {
-  font-family: arial, sans-serif;
-  border-collapse: collapse;
-  width: 100%%;
+const (
+	streamBufferSize        = 64
+	streamKeepaliveInterval = 15 * time.Second
+	notifyTimeout           = 10 * time.Second
+	defaultListLimit        = 100
+	maxListLimit            = 1000
+	exportFlushRows         = 1000
+	importChunkSize         = 1000
+	finalSaveTimeout        = 30 * time.Second
+)
+
+// Ways imported counters are combined with stored ones.
+const (
+	importCountersMerge   = "merge"
+	importCountersReplace = "replace"
+)
+
+func limitError(err error) (int, apierror.Error) {
+	if errors.Is(err, limits.ErrInvalidName) {
+		return http.StatusBadRequest, apierror.Error{Code: apierror.CodeInvalidName, Message: err.Error()}
+	}
+
+	return http.StatusUnprocessableEntity, apierror.Error{Code: apierror.CodeSeriesLimit, Message: err.Error()}
+}
+
+func allowMetrics(res http.ResponseWriter, req *http.Request, names ...string) bool {
+	for _, name := range names {
+		if !auth.AllowsMetric(req.Context(), name) {
+			http.Error(res, fmt.Sprintf("Access to metrics %q is not allowed", name), http.StatusForbidden)
+			return false
+		}
+	}
+
+	return true
 }
 
-td, th {
-  border: 1px solid #dddddd;
-  text-align: left;
-  padding: 8px;
+// reserveMetrics admits series, returning a func to release them if they fail to be stored.
+func reserveMetrics(
+	res http.ResponseWriter,
+	req *http.Request,
+	limiter *limits.Limiter,
+	seriesOwner middlewares.ClientKey,
+	series ...limits.Series,
+) (cancel func(), ok bool) {
+	for _, s := range series {
+		if !allowMetrics(res, req, s.Name) {
+			return nil, false
+		}
+	}
+
+	cancel, err := limiter.Reserve(seriesOwner(req), series...)
+	if err != nil {
+		logger.Log.Debugf("Metrics rejected: %s", err)
+		status, _ := limitError(err)
+		http.Error(res, err.Error(), status)
+		return nil, false
+	}
+
+	return cancel, true
 }
 
-tr:nth-child(even) {
-  background-color: #dddddd;
+// validateMetrics checks a single metrics update sent as JSON.
+func validateMetrics(req *http.Request, limiter *limits.Limiter, metrics models.Metrics) (int, *apierror.Error) {
+	if metrics.ID == "" {
+		return http.StatusNotFound, &apierror.Error{Code: apierror.CodeMissingName, Message: "No metrics name"}
+	}
+
+	switch metrics.MType {
+	case storage.MetricsTypeGauge:
+		if metrics.Value == nil {
+			return http.StatusBadRequest, &apierror.Error{Code: apierror.CodeMissingValue, Message: "No metrics value"}
+		}
+	case storage.MetricsTypeCounter:
+		if metrics.Delta == nil {
+			return http.StatusBadRequest, &apierror.Error{Code: apierror.CodeMissingValue, Message: "No metrics value"}
+		}
+	default:
+		return http.StatusBadRequest, &apierror.Error{Code: apierror.CodeInvalidType, Message: "Wrong metrics type"}
+	}
+
+	if err := limiter.ValidateName(metrics.ID); err != nil {
+		return http.StatusBadRequest, &apierror.Error{Code: apierror.CodeInvalidName, Message: err.Error()}
+	}
+
+	// Metadata is persisted and served back, so it is checked here as well as by the schema for imports
+	if utf8.RuneCountInString(metrics.Unit) > metadata.MaxUnitLength || utf8.RuneCountInString(metrics.Help) > metadata.MaxHelpLength {
+		return http.StatusBadRequest, &apierror.Error{
+			Code:    apierror.CodeSchemaViolation,
+			Message: fmt.Sprintf("Unit and help are limited to %d and %d characters", metadata.MaxUnitLength, metadata.MaxHelpLength),
+		}
+	}
+
+	if !auth.AllowsMetric(req.Context(), metrics.ID) {
+		return http.StatusForbidden, &apierror.Error{
+			Code:    apierror.CodeForbidden,
+			Message: fmt.Sprintf("Access to metrics %q is not allowed", metrics.ID),
+		}
+	}
+
+	return http.StatusOK, nil
 }
-</style>
-</head>
-<body>
 
-<h2>Metrics</h2>
+func writeJSON(res http.ResponseWriter, response any) {
+	resp, err := json.Marshal(response)
+	if err != nil {
+		apierror.Write(res, http.StatusInternalServerError, apierror.Error{Code: apierror.CodeInternal, Message: err.Error()})
+		return
+	}
 
-<table>
-  <tr>
-    <th>Name</th>
-    <th>Value</th>
-  </tr>
-  %s
-</table>
+	logger.Log.Debugf("Response body: %s", resp)
 
-</body>
-</html>
-`
+	res.WriteHeader(http.StatusOK)
+	_, err = res.Write(resp)
+	if err != nil {
+		logger.Log.Errorf("Failed to write response body")
+	}
+}
 
-var tableRowTemlate = `<tr>
-    <td>%s</td>
-    <td>%v</td>
-  </tr>`
+func internalError(res http.ResponseWriter, err error) {
+	logger.Log.Errorf("Request failed: %s", err)
+	apierror.Write(res, http.StatusInternalServerError, apierror.Error{Code: apierror.CodeInternal, Message: "Internal server error"})
+}
 
-func handleUpdateJSON(mStorage storage.MetricsStorage, onUpdate func()) func(http.ResponseWriter, *http.Request) {
+func handleUpdateJSON(
+	mStorage storage.MetricsStorage,
+	limiter *limits.Limiter,
+	seriesOwner middlewares.ClientKey,
+	registry *metadata.Registry,
+	onUpdate func(context.Context, []stream.Update),
+) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
@@ -75,128 +188,192 @@ func handleUpdateJSON(mStorage storage.MetricsStorage, onUpdate func()) func(htt
 
 		_, err := buf.ReadFrom(req.Body)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeBadRequest, Message: err.Error()})
 			return
 		}
 
 		err = json.Unmarshal(buf.Bytes(), &metrics)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeInvalidJSON, Message: err.Error()})
 			return
 		}
 
 		logger.Log.Debugf("Body: %+v", metrics)
 
-		if metrics.ID == "" {
-			http.Error(res, "No metrics name", http.StatusNotFound)
+		if status, apiErr := validateMetrics(req, limiter, metrics); apiErr != nil {
+			apiErr.ID = metrics.ID
+			apierror.Write(res, status, *apiErr)
 			return
 		}
 
-		switch metrics.MType {
-		case storage.MetricsTypeGauge:
-			if metrics.Value != nil {
-				mStorage.SetGauge(req.Context(), metrics.ID, *metrics.Value)
-			} else {
-				http.Error(res, "No metrics value", http.StatusBadRequest)
-				return
-			}
-		case storage.MetricsTypeCounter:
-			if metrics.Delta != nil {
-				mStorage.SetCounter(req.Context(), metrics.ID, *metrics.Delta)
-			} else {
-				http.Error(res, "No metrics value", http.StatusBadRequest)
-				return
-			}
-		default:
-			http.Error(res, "Wrong metrics type", http.StatusBadRequest)
+		cancel, err := limiter.Reserve(seriesOwner(req), limits.Series{MType: metrics.MType, Name: metrics.ID})
+		if err != nil {
+			logger.Log.Debugf("Metrics rejected: %s", err)
+			status, apiErr := limitError(err)
+			apiErr.ID = metrics.ID
+			apierror.Write(res, status, apiErr)
 			return
 		}
 
 		response := metrics
 		response.Delta = nil
-		switch response.MType {
+		switch metrics.MType {
 		case storage.MetricsTypeGauge:
-			value, _ := mStorage.GetGauge(req.Context(), response.ID)
-			response.Value = value
+			err = mStorage.SetGauge(req.Context(), metrics.ID, *metrics.Value)
+			if err != nil {
+				cancel()
+			} else {
+				response.Value, err = mStorage.GetGauge(req.Context(), metrics.ID)
+			}
 		case storage.MetricsTypeCounter:
-			counter, _ := mStorage.GetCounter(req.Context(), response.ID)
-			value := float64(*counter)
-			response.Value = &value
+			var counter *int64
+			err = mStorage.SetCounter(req.Context(), metrics.ID, *metrics.Delta)
+			if err != nil {
+				cancel()
+			} else {
+				counter, err = mStorage.GetCounter(req.Context(), metrics.ID)
+			}
+			if counter != nil {
+				value := float64(*counter)
+				response.Value = &value
+			}
 		}
-
-		resp, err := json.Marshal(response)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+			internalError(res, err)
+			return
 		}
 
-		res.WriteHeader(http.StatusOK)
-		_, err = res.Write(resp)
-		if err != nil {
-			logger.Log.Errorf("Failed to write response body")
-		}
+		registry.Observe([]models.Metrics{metrics})
+
+		writeJSON(res, response)
 
-		onUpdate()
+		onUpdate(req.Context(), []stream.Update{
+			{ID: metrics.ID, MType: metrics.MType, Value: *response.Value, Delta: metrics.Delta, Time: time.Now()},
+		})
 	}
 }
 
-func handleUpdatesJSON(mStorage storage.MetricsStorage, onUpdate func()) func(http.ResponseWriter, *http.Request) {
+// batchResponse is the /updates response in partial mode.
+type batchResponse struct {
+	Metrics []models.Metrics `json:"metrics"`
+	Errors  []apierror.Error `json:"errors,omitempty"`
+}
+
+// handleUpdatesJSON applies a batch of updates. By default the batch is applied all or nothing,
+// with ?partial=true valid metrics are applied and invalid ones are reported alongside the updated values.
+func handleUpdatesJSON(
+	mStorage storage.MetricsStorage,
+	limiter *limits.Limiter,
+	seriesOwner middlewares.ClientKey,
+	registry *metadata.Registry,
+	onUpdate func(context.Context, []stream.Update),
+) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "application/json")
 
+		partial, _ := strconv.ParseBool(req.URL.Query().Get("partial"))
+
 		var metrics []models.Metrics
 		var buf bytes.Buffer
 
 		_, err := buf.ReadFrom(req.Body)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeBadRequest, Message: err.Error()})
 			return
 		}
 
 		err = json.Unmarshal(buf.Bytes(), &metrics)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeInvalidJSON, Message: err.Error()})
 			return
 		}
 
 		logger.Log.Debugf("Body: %+v", metrics)
 
+		owner := seriesOwner(req)
+		accepted := make([]models.Metrics, 0, len(metrics))
+		// cancels forget admitted series if the batch fails to be stored
+		var cancels []func()
+		var itemErrors []apierror.Error
+		status := http.StatusOK
+		for i, m := range metrics {
+			itemStatus, apiErr := validateMetrics(req, limiter, m)
+			// In partial mode series are admitted one by one, so that those within limits still get through
+			if apiErr == nil && partial {
+				cancel, err := limiter.Reserve(owner, limits.Series{MType: m.MType, Name: m.ID})
+				if err != nil {
+					var limitErr apierror.Error
+					itemStatus, limitErr = limitError(err)
+					apiErr = &limitErr
+				} else {
+					cancels = append(cancels, cancel)
+				}
+			}
+
+			if apiErr != nil {
+				if status == http.StatusOK {
+					status = itemStatus
+				}
+				index := i
+				apiErr.ID = m.ID
+				apiErr.Index = &index
+				itemErrors = append(itemErrors, *apiErr)
+				continue
+			}
+
+			accepted = append(accepted, m)
+		}
+
+		if len(itemErrors) > 0 && (!partial || len(accepted) == 0) {
+			logger.Log.Debugf("Batch rejected: %d of %d metrics are invalid", len(itemErrors), len(metrics))
+			apierror.Write(res, status, apierror.Error{
+				Code:    apierror.CodeInvalidBatch,
+				Message: fmt.Sprintf("%d of %d metrics are invalid", len(itemErrors), len(metrics)),
+				Errors:  itemErrors,
+			})
+			return
+		}
+
 		metricsItems := storage.MetricsStorageItems{
 			Gauges:   make(map[string]float64),
 			Counters: make(map[string]int64),
 		}
-		for _, m := range metrics {
-			if m.ID == "" {
-				http.Error(res, "No metrics name", http.StatusNotFound)
-				return
-			}
-
+		series := make([]limits.Series, 0, len(accepted))
+		for _, m := range accepted {
 			switch m.MType {
 			case storage.MetricsTypeGauge:
-				if m.Value != nil {
-					metricsItems.Gauges[m.ID] = *m.Value
-				} else {
-					http.Error(res, "No metrics value", http.StatusBadRequest)
-					return
+				if _, ok := metricsItems.Gauges[m.ID]; !ok {
+					series = append(series, limits.Series{MType: m.MType, Name: m.ID})
 				}
+				metricsItems.Gauges[m.ID] = *m.Value
 			case storage.MetricsTypeCounter:
-				if m.Delta != nil {
-					metricsItems.Counters[m.ID] += *m.Delta
-				} else {
-					http.Error(res, "No metrics value", http.StatusBadRequest)
-					return
+				if _, ok := metricsItems.Counters[m.ID]; !ok {
+					series = append(series, limits.Series{MType: m.MType, Name: m.ID})
 				}
-			default:
-				http.Error(res, "Wrong metrics type", http.StatusBadRequest)
+				metricsItems.Counters[m.ID] += *m.Delta
+			}
+		}
+
+		if !partial {
+			cancel, err := limiter.Reserve(owner, series...)
+			if err != nil {
+				logger.Log.Debugf("Metrics rejected: %s", err)
+				status, apiErr := limitError(err)
+				apierror.Write(res, status, apiErr)
 				return
 			}
+			cancels = append(cancels, cancel)
 		}
 
 		if err := mStorage.SetMany(req.Context(), metricsItems); err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+			for _, cancel := range cancels {
+				cancel()
+			}
+			internalError(res, err)
 			return
 		}
 
-		response := make([]models.Metrics, 0)
+		registry.Observe(accepted)
 
 		updatedMetrics := storage.MetricsStorageKeys{
 			Gauges:   maps.Keys(metricsItems.Gauges),
@@ -204,53 +381,251 @@ func handleUpdatesJSON(mStorage storage.MetricsStorage, onUpdate func()) func(ht
 		}
 		updatedItems, err := mStorage.GetMany(req.Context(), updatedMetrics)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+			internalError(res, err)
+			return
 		}
 
-		for name, value := range updatedItems.Gauges {
-			value := value
-			response = append(
-				response,
-				models.Metrics{
-					ID:    name,
-					MType: storage.MetricsTypeGauge,
-					Value: &value,
-				},
-			)
+		// Updated values are listed in the order the series first appear in the batch
+		now := time.Now()
+		var response []models.Metrics
+		if partial {
+			response = make([]models.Metrics, 0, len(series))
 		}
-		for name, value := range updatedItems.Counters {
-			value := value
-			floatValue := float64(value)
-			response = append(
-				response,
-				models.Metrics{
-					ID:    name,
-					MType: storage.MetricsTypeCounter,
-					Value: &floatValue,
-				},
-			)
+		updates := make([]stream.Update, 0, len(series))
+		for _, s := range series {
+			var value float64
+			var ok bool
+			switch s.MType {
+			case storage.MetricsTypeGauge:
+				value, ok = updatedItems.Gauges[s.Name]
+			case storage.MetricsTypeCounter:
+				var counter int64
+				counter, ok = updatedItems.Counters[s.Name]
+				value = float64(counter)
+			}
+			if ok {
+				if partial {
+					response = append(response, models.Metrics{ID: s.Name, MType: s.MType, Value: &value})
+				}
+
+				update := stream.Update{ID: s.Name, MType: s.MType, Value: value, Time: now}
+				if s.MType == storage.MetricsTypeCounter {
+					delta := metricsItems.Counters[s.Name]
+					update.Delta = &delta
+				}
+				updates = append(updates, update)
+			}
 		}
 
-		resp, err := json.Marshal(response)
-		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+		if partial {
+			writeJSON(res, batchResponse{Metrics: response, Errors: itemErrors})
+		} else {
+			res.WriteHeader(http.StatusOK)
+			//TODO: send true response body when the test TestBatchAPI/batch_update_random_metrics is fixed
+			_, err = res.Write([]byte("{}"))
+			if err != nil {
+				logger.Log.Errorf("Failed to write response body")
+			}
 		}
 
-		logger.Log.Debugf("Response body: %s", resp)
+		onUpdate(req.Context(), updates)
+	}
+}
+
+// importResponse is the /import response.
+type importResponse struct {
+	Imported int `json:"imported"`
+}
 
-		res.WriteHeader(http.StatusOK)
-		//TODO: send true response body when the test TestBatchAPI/batch_update_random_metrics is fixed
-		//_, err = res.Write(resp)
-		_, err = res.Write([]byte("{}"))
+// handleImport applies a dump of newline delimited metrics, as written by saver.MetricsStorageSaver.Save,
+// in chunks of importChunkSize. Imported counters are added to stored ones, with ?counters=replace they replace them.
+// A bad line stops the import, while chunks before it stay applied. The body is read as it goes,
+// it is limited to the max import size by middlewares instead of the max body size.
+func handleImport(
+	mStorage storage.MetricsStorage,
+	limiter *limits.Limiter,
+	seriesOwner middlewares.ClientKey,
+	registry *metadata.Registry,
+	onUpdate func(context.Context, []stream.Update),
+) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		mode := req.URL.Query().Get("counters")
+		if mode == "" {
+			mode = importCountersMerge
+		}
+		if mode != importCountersMerge && mode != importCountersReplace {
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{
+				Code:    apierror.CodeBadRequest,
+				Message: fmt.Sprintf("Unknown counters mode %q", mode),
+			})
+			return
+		}
+		replace := mode == importCountersReplace
+
+		owner := seriesOwner(req)
+		imported := 0
+		chunk := make([]models.Metrics, 0, importChunkSize)
+
+		// flush applies the chunk, writing an error response if it fails
+		flush := func() bool {
+			items := storage.MetricsStorageItems{
+				Gauges:   make(map[string]float64),
+				Counters: make(map[string]int64),
+			}
+			series := make([]limits.Series, 0, len(chunk))
+			for _, m := range chunk {
+				switch m.MType {
+				case storage.MetricsTypeGauge:
+					if _, ok := items.Gauges[m.ID]; !ok {
+						series = append(series, limits.Series{MType: m.MType, Name: m.ID})
+					}
+					items.Gauges[m.ID] = *m.Value
+				case storage.MetricsTypeCounter:
+					if _, ok := items.Counters[m.ID]; !ok {
+						series = append(series, limits.Series{MType: m.MType, Name: m.ID})
+					}
+					if replace {
+						items.Counters[m.ID] = *m.Delta
+					} else {
+						items.Counters[m.ID] += *m.Delta
+					}
+				}
+			}
+
+			cancel, err := limiter.Reserve(owner, series...)
+			if err != nil {
+				logger.Log.Debugf("Import rejected after %d metrics: %s", imported, err)
+				status, apiErr := limitError(err)
+				apierror.Write(res, status, apiErr)
+				return false
+			}
+
+			updates, err := importItems(req.Context(), mStorage, items, replace)
+			if err != nil {
+				cancel()
+				internalError(res, err)
+				return false
+			}
+
+			registry.Observe(chunk)
+			onUpdate(req.Context(), updates)
+
+			imported += len(chunk)
+			chunk = chunk[:0]
+			return true
+		}
+
+		reject := func(index int, status int, apiErr *apierror.Error) {
+			apiErr.Index = &index
+			apierror.Write(res, status, apierror.Error{
+				Code:    apierror.CodeInvalidBatch,
+				Message: fmt.Sprintf("Line %d is invalid, %d metrics imported before it", index+1, imported),
+				Errors:  []apierror.Error{*apiErr},
+			})
+		}
+
+		reader := bufio.NewReader(req.Body)
+		for index := 0; ; index++ {
+			data, err := reader.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					apierror.Write(res, http.StatusRequestEntityTooLarge, apierror.Error{
+						Code:    apierror.CodeBodyTooLarge,
+						Message: fmt.Sprintf("Import is larger than %d bytes, %d metrics imported", maxBytesErr.Limit, imported),
+					})
+					return
+				}
+				apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeBadRequest, Message: err.Error()})
+				return
+			}
+
+			if len(bytes.TrimSpace(data)) > 0 {
+				var m models.Metrics
+				if jsonErr := json.Unmarshal(data, &m); jsonErr != nil {
+					reject(index, http.StatusBadRequest, &apierror.Error{Code: apierror.CodeInvalidJSON, Message: jsonErr.Error()})
+					return
+				}
+				if status, apiErr := validateMetrics(req, limiter, m); apiErr != nil {
+					apiErr.ID = m.ID
+					reject(index, status, apiErr)
+					return
+				}
+				chunk = append(chunk, m)
+			}
+
+			if len(chunk) == importChunkSize || (err == io.EOF && len(chunk) > 0) {
+				if !flush() {
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+
+		logger.Log.Infof("Imported %d metrics", imported)
+		writeJSON(res, importResponse{Imported: imported})
+	}
+}
+
+// importItems stores imported items and returns the resulting updates. To replace counters only the difference
+// with stored values is added, so concurrent updates are applied either before or after the import, but not lost.
+func importItems(ctx context.Context, mStorage storage.MetricsStorage, items storage.MetricsStorageItems, replace bool) ([]stream.Update, error) {
+	keys := storage.MetricsStorageKeys{
+		Gauges:   maps.Keys(items.Gauges),
+		Counters: maps.Keys(items.Counters),
+	}
+	sort.Strings(keys.Gauges)
+	sort.Strings(keys.Counters)
+
+	deltas := items.Counters
+	if replace {
+		stored, err := mStorage.GetMany(ctx, storage.MetricsStorageKeys{Counters: keys.Counters})
 		if err != nil {
-			logger.Log.Errorf("Failed to write response body")
+			return nil, err
 		}
+		deltas = make(map[string]int64, len(items.Counters))
+		for name, value := range items.Counters {
+			deltas[name] = value - stored.Counters[name]
+		}
+	}
+
+	if err := mStorage.SetMany(ctx, storage.MetricsStorageItems{Gauges: items.Gauges, Counters: deltas}); err != nil {
+		return nil, err
+	}
 
-		onUpdate()
+	updated, err := mStorage.GetMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	updates := make([]stream.Update, 0, len(keys.Gauges)+len(keys.Counters))
+	for _, name := range keys.Gauges {
+		if value, ok := updated.Gauges[name]; ok {
+			updates = append(updates, stream.Update{ID: name, MType: storage.MetricsTypeGauge, Value: value, Time: now})
+		}
 	}
+	for _, name := range keys.Counters {
+		if value, ok := updated.Counters[name]; ok {
+			delta := deltas[name]
+			updates = append(updates, stream.Update{ID: name, MType: storage.MetricsTypeCounter, Value: float64(value), Delta: &delta, Time: now})
+		}
+	}
+
+	return updates, nil
 }
 
-func handleUpdate(mStorage storage.MetricsStorage, onUpdate func()) func(http.ResponseWriter, *http.Request) {
+func handleUpdate(
+	mStorage storage.MetricsStorage,
+	limiter *limits.Limiter,
+	seriesOwner middlewares.ClientKey,
+	registry *metadata.Registry,
+	onUpdate func(context.Context, []stream.Update),
+) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
@@ -281,26 +656,56 @@ func handleUpdate(mStorage storage.MetricsStorage, onUpdate func()) func(http.Re
 			return
 		}
 
+		var update *stream.Update
 		switch metricsType {
 		case storage.MetricsTypeGauge:
 			if metricsValue, convErr := strconv.ParseFloat(metricsValueStr, 64); convErr == nil {
-				mStorage.SetGauge(req.Context(), metricsName, metricsValue)
+				cancel, ok := reserveMetrics(res, req, limiter, seriesOwner, limits.Series{MType: metricsType, Name: metricsName})
+				if !ok {
+					return
+				}
+				if err := mStorage.SetGauge(req.Context(), metricsName, metricsValue); err != nil {
+					cancel()
+					logger.Log.Errorf("Request failed: %s", err)
+					http.Error(res, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				update = &stream.Update{ID: metricsName, MType: metricsType, Value: metricsValue}
 			} else {
 				http.Error(res, "Can not parse metrics value", http.StatusBadRequest)
 				return
 			}
 		case storage.MetricsTypeCounter:
 			if metricsValue, convErr := strconv.ParseInt(metricsValueStr, 10, 64); convErr == nil {
-				mStorage.SetCounter(req.Context(), metricsName, metricsValue)
+				cancel, ok := reserveMetrics(res, req, limiter, seriesOwner, limits.Series{MType: metricsType, Name: metricsName})
+				if !ok {
+					return
+				}
+				if err := mStorage.SetCounter(req.Context(), metricsName, metricsValue); err != nil {
+					cancel()
+					logger.Log.Errorf("Request failed: %s", err)
+					http.Error(res, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				if counter, _ := mStorage.GetCounter(req.Context(), metricsName); counter != nil {
+					update = &stream.Update{ID: metricsName, MType: metricsType, Value: float64(*counter), Delta: &metricsValue}
+				}
 			} else {
 				http.Error(res, "Can not parse metrics value", http.StatusBadRequest)
 				return
 			}
 		}
 
+		registry.Observe([]models.Metrics{{ID: metricsName, MType: metricsType}})
+
 		res.WriteHeader(http.StatusOK)
 
-		onUpdate()
+		var updates []stream.Update
+		if update != nil {
+			update.Time = time.Now()
+			updates = append(updates, *update)
+		}
+		onUpdate(req.Context(), updates)
 	}
 }
 
@@ -313,55 +718,63 @@ func handleValueJSON(mStorage storage.MetricsStorage) func(http.ResponseWriter,
 
 		_, err := buf.ReadFrom(req.Body)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeBadRequest, Message: err.Error()})
 			return
 		}
 		err = json.Unmarshal(buf.Bytes(), &request)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusBadRequest)
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeInvalidJSON, Message: err.Error()})
 			return
 		}
 
 		logger.Log.Debugf("Body: %+v", request)
 
 		if request.ID == "" {
-			http.Error(res, "No metrics name", http.StatusBadRequest)
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeMissingName, Message: "No metrics name"})
+			return
+		}
+
+		if !auth.AllowsMetric(req.Context(), request.ID) {
+			apierror.Write(res, http.StatusForbidden, apierror.Error{
+				Code:    apierror.CodeForbidden,
+				Message: fmt.Sprintf("Access to metrics %q is not allowed", request.ID),
+				ID:      request.ID,
+			})
 			return
 		}
 
 		response := request
+		found := false
 
 		switch request.MType {
 		default:
-			http.Error(res, "Wrong metrics type", http.StatusBadRequest)
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{
+				Code:    apierror.CodeInvalidType,
+				Message: "Wrong metrics type",
+				ID:      request.ID,
+			})
 			return
 		case storage.MetricsTypeGauge:
-			value, _ := mStorage.GetGauge(req.Context(), request.ID)
-			if value == nil {
-				http.Error(res, "Metrics not found", http.StatusNotFound)
-				return
-			}
-			response.Value = value
+			response.Value, err = mStorage.GetGauge(req.Context(), request.ID)
+			found = response.Value != nil
 		case storage.MetricsTypeCounter:
-			value, _ := mStorage.GetCounter(req.Context(), request.ID)
-			if value == nil {
-				http.Error(res, "Metrics not found", http.StatusNotFound)
-				return
-			}
-			response.Delta = value
+			response.Delta, err = mStorage.GetCounter(req.Context(), request.ID)
+			found = response.Delta != nil
 		}
-
-		resp, err := json.Marshal(response)
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+			internalError(res, err)
 			return
 		}
-
-		res.WriteHeader(http.StatusOK)
-		_, err = res.Write(resp)
-		if err != nil {
-			logger.Log.Errorf("Failed to write response body")
+		if !found {
+			apierror.Write(res, http.StatusNotFound, apierror.Error{
+				Code:    apierror.CodeNotFound,
+				Message: "Metrics not found",
+				ID:      request.ID,
+			})
+			return
 		}
+
+		writeJSON(res, response)
 	}
 }
 
@@ -372,6 +785,10 @@ func handleValue(mStorage storage.MetricsStorage) func(res http.ResponseWriter,
 		var metricsType = chi.URLParam(req, "metricsType")
 		var metricsName = chi.URLParam(req, "metricsName")
 
+		if !allowMetrics(res, req, metricsName) {
+			return
+		}
+
 		var valueString string
 		switch metricsType {
 		default:
@@ -415,80 +832,965 @@ func handlePing(mStorage storage.MetricsStorage) func(http.ResponseWriter, *http
 	}
 }
 
-func handleRoot(mStorage storage.MetricsStorage) func(res http.ResponseWriter, req *http.Request) {
+func handleOpenAPI(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+
+	_, err := res.Write(openapi.Spec())
+	if err != nil {
+		logger.Log.Errorf("Failed to write response body")
+	}
+}
+
+func handleStats(registry *stats.Registry) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
-		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		res.Header().Set("Content-Type", "application/json")
 
-		var rows string
-		snapshot, _ := mStorage.GetAll(req.Context())
-		for name, value := range snapshot.Gauges {
-			rows += fmt.Sprintf(tableRowTemlate, name, value)
-		}
-		for name, value := range snapshot.Counters {
-			rows += fmt.Sprintf(tableRowTemlate, name, value)
+		resp, err := json.Marshal(registry.Snapshot())
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		table := fmt.Sprintf(tableTemplate, rows)
-
 		res.WriteHeader(http.StatusOK)
-
-		_, err := fmt.Fprintln(res, table)
+		_, err = res.Write(resp)
 		if err != nil {
-			panic(err)
+			logger.Log.Errorf("Failed to write response body")
 		}
 	}
 }
 
-func metricsRouter(
-	ctx context.Context,
-	conf config.Config,
-	mStorage storage.MetricsStorage,
-	saver *saver.MetricsStorageSaver,
-	signer *signer.Signer,
-) chi.Router {
-	router := chi.NewRouter()
-	router.Use(middleware.StripSlashes, middlewares.Logging, middlewares.Compressing)
-	if signer != nil {
-		router.Use(middlewares.SignValidating(signer), middlewares.Signing(signer))
-	}
+// handleStream sends applied metrics updates as server-sent events until the client or the server is gone.
+// Updates can be filtered by type and name regexp with the type and name query params.
+func handleStream(ctx context.Context, hub *stream.Hub) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		filter := stream.Filter{
+			MType: req.URL.Query().Get("type"),
+			Allow: func(name string) bool { return auth.AllowsMetric(req.Context(), name) },
+		}
+		switch filter.MType {
+		case "", storage.MetricsTypeGauge, storage.MetricsTypeCounter:
+		default:
+			apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeInvalidType, "Wrong metrics type")
+			return
+		}
+		if pattern := req.URL.Query().Get("name"); pattern != "" {
+			var err error
+			filter.Name, err = regexp.Compile(pattern)
+			if err != nil {
+				apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, fmt.Sprintf("Bad name pattern: %s", err))
+				return
+			}
+		}
 
-	onUpdateDone := onUpdate(ctx, conf.StoreInterval, saver)
+		subscription := hub.Subscribe(filter)
+		defer hub.Unsubscribe(subscription)
 
-	router.Post("/updates", handleUpdatesJSON(mStorage, onUpdateDone))
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.Header().Set("X-Accel-Buffering", "no")
+		res.WriteHeader(http.StatusOK)
 
-	// Need to route update requests to the same handler even if some named path components are absent
-	// So we haven't found better way other than using such routing
-	router.Route("/update", func(router chi.Router) {
-		router.Post("/", handleUpdateJSON(mStorage, onUpdateDone))
-		router.Route("/{metricsType}", func(router chi.Router) {
-			router.Post("/", handleUpdate(mStorage, onUpdateDone))
-			router.Route("/{metricsName}", func(router chi.Router) {
-				router.Post("/", handleUpdate(mStorage, onUpdateDone))
-				router.Route("/{metricsValue}", func(router chi.Router) {
-					router.Post("/", handleUpdate(mStorage, onUpdateDone))
-				})
-			})
-		})
+		rc := http.NewResponseController(res)
+		if err := rc.Flush(); err != nil {
+			logger.Log.Errorf("Failed to start stream: %s", err)
+			return
+		}
+
+		keepalive := time.NewTicker(streamKeepaliveInterval)
+		defer keepalive.Stop()
+
+		for {
+			var err error
+			select {
+			case <-ctx.Done():
+				return
+			case <-req.Context().Done():
+				return
+			case <-keepalive.C:
+				_, err = fmt.Fprint(res, ": keepalive\n\n")
+			case updates := <-subscription.Updates():
+				if dropped := subscription.Dropped(); dropped > 0 {
+					_, err = fmt.Fprintf(res, "event: dropped\ndata: {\"count\":%d}\n\n", dropped)
+				}
+				for _, update := range updates {
+					if err != nil {
+						break
+					}
+					var data []byte
+					data, err = json.Marshal(update)
+					if err == nil {
+						_, err = fmt.Fprintf(res, "event: update\ndata: %s\n\n", data)
+					}
+				}
+			}
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				logger.Log.Debugf("Stream closed: %s", err)
+				return
+			}
+		}
+	}
+}
+
+type alertsList struct {
+	Alerts []alerting.Alert `json:"alerts"`
+}
+
+// handleAlerts lists states of alert rules, optionally filtered with the state query param.
+func handleAlerts(engine *alerting.Engine) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		state := alerting.State(req.URL.Query().Get("state"))
+		switch state {
+		case "", alerting.StateInactive, alerting.StatePending, alerting.StateFiring, alerting.StateResolved:
+		default:
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{
+				Code:    apierror.CodeBadRequest,
+				Message: fmt.Sprintf("Unknown alert state %q", state),
+			})
+			return
+		}
+
+		response := alertsList{Alerts: []alerting.Alert{}}
+		if engine != nil {
+			for _, alert := range engine.Alerts() {
+				if (state == "" || alert.State == state) && auth.AllowsMetric(req.Context(), alert.Metric) {
+					response.Alerts = append(response.Alerts, alert)
+				}
+			}
+		}
+
+		writeJSON(res, response)
+	}
+}
+
+type queryRequest struct {
+	Query string `json:"query"`
+}
+
+// queryValue is a float marshalled as a string if it's not finite, as JSON numbers can't be.
+type queryValue float64
+
+func (v queryValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Inf"`), nil
+	default:
+		return json.Marshal(f)
+	}
+}
+
+type querySample struct {
+	Labels map[string]string `json:"labels"`
+	Value  queryValue        `json:"value"`
+}
+
+type queryPoint struct {
+	Time  int64      `json:"t"`
+	Value queryValue `json:"v"`
+}
+
+type querySeries struct {
+	Labels map[string]string `json:"labels"`
+	Points []queryPoint      `json:"points"`
+}
+
+type queryResult struct {
+	ResultType string `json:"resultType"`
+	Result     any    `json:"result"`
+}
+
+func newQueryResult(value expr.Value) queryResult {
+	result := queryResult{ResultType: value.Type()}
+	switch v := value.(type) {
+	case expr.Scalar:
+		result.Result = queryValue(v)
+	case expr.Vector:
+		samples := make([]querySample, len(v))
+		for i, s := range v {
+			samples[i] = querySample{Labels: s.Labels, Value: queryValue(s.Value)}
+		}
+		result.Result = samples
+	case expr.Matrix:
+		series := make([]querySeries, len(v))
+		for i, s := range v {
+			series[i] = querySeries{Labels: s.Labels, Points: make([]queryPoint, len(s.Points))}
+			for j, p := range s.Points {
+				series[i].Points[j] = queryPoint{Time: p.Time.UnixMilli(), Value: queryValue(p.Value)}
+			}
+		}
+		result.Result = series
+	}
+	return result
+}
+
+// handleQuery evaluates an expression against current metrics and their recorded history.
+// Metrics the client is not allowed to read are invisible to the expression.
+func handleQuery(mStorage storage.MetricsStorage, recorder *history.Recorder) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		var request queryRequest
+		var buf bytes.Buffer
+
+		_, err := buf.ReadFrom(req.Body)
+		if err != nil {
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeBadRequest, Message: err.Error()})
+			return
+		}
+		err = json.Unmarshal(buf.Bytes(), &request)
+		if err != nil {
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeInvalidJSON, Message: err.Error()})
+			return
+		}
+
+		// Expressions are cheap to parse within the limit, longer ones are not even looked at
+		if len(request.Query) > expr.MaxLength {
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{
+				Code:    apierror.CodeInvalidQuery,
+				Message: fmt.Sprintf("Query is longer than %d bytes", expr.MaxLength),
+			})
+			return
+		}
+
+		node, err := expr.Parse(request.Query)
+		if err != nil {
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeInvalidQuery, Message: err.Error()})
+			return
+		}
+
+		snapshot, err := mStorage.GetAll(req.Context())
+		if err != nil {
+			internalError(res, err)
+			return
+		}
+
+		evaluator := &expr.Evaluator{
+			Items:   snapshot,
+			History: recorder,
+			Now:     time.Now(),
+			Allow:   func(name string) bool { return auth.AllowsMetric(req.Context(), name) },
+		}
+		value, err := evaluator.Eval(node)
+		if err != nil {
+			apierror.Write(res, http.StatusUnprocessableEntity, apierror.Error{Code: apierror.CodeInvalidQuery, Message: err.Error()})
+			return
+		}
+
+		writeJSON(res, newQueryResult(value))
+	}
+}
+
+type metadataList struct {
+	Metadata []metadata.Meta `json:"metadata"`
+}
+
+// handleMetadata lists units, help and expected types of metrics.
+// With the conflicts=true query param only metrics reported with more than one type are listed.
+func handleMetadata(registry *metadata.Registry) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		conflicts, _ := strconv.ParseBool(req.URL.Query().Get("conflicts"))
+
+		response := metadataList{Metadata: []metadata.Meta{}}
+		for _, meta := range registry.All() {
+			if (!conflicts || len(meta.Conflicts) > 0) && auth.AllowsMetric(req.Context(), meta.Name) {
+				response.Metadata = append(response.Metadata, meta)
+			}
+		}
+
+		writeJSON(res, response)
+	}
+}
+
+// handlePrometheus exposes current values of metrics for Prometheus to scrape.
+func handlePrometheus(mStorage storage.MetricsStorage, registry *metadata.Registry) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		snapshot, err := mStorage.GetAll(req.Context())
+		if err != nil {
+			logger.Log.Errorf("Request failed: %s", err)
+			http.Error(res, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Set("Content-Type", prometheus.ContentType)
+		res.WriteHeader(http.StatusOK)
+
+		allow := func(name string) bool { return auth.AllowsMetric(req.Context(), name) }
+		if err := prometheus.Write(res, snapshot, registry, allow); err != nil {
+			logger.Log.Errorf("Failed to write response body")
+		}
+	}
+}
+
+type exportRecord struct {
+	ID    string     `json:"id"`
+	MType string     `json:"type"`
+	Unit  string     `json:"unit,omitempty"`
+	Time  time.Time  `json:"time"`
+	Value queryValue `json:"value"`
+}
+
+// exportEncoder writes export records in one of the formats.
+type exportEncoder interface {
+	Encode(record exportRecord) error
+	Flush() error
+}
+
+type csvExportEncoder struct {
+	w *csv.Writer
+}
+
+func (e csvExportEncoder) Encode(record exportRecord) error {
+	return e.w.Write([]string{
+		record.ID,
+		record.MType,
+		record.Unit,
+		record.Time.Format(time.RFC3339Nano),
+		strconv.FormatFloat(float64(record.Value), 'g', -1, 64),
 	})
+}
+
+func (e csvExportEncoder) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExportEncoder struct {
+	enc *json.Encoder
+}
+
+func (e ndjsonExportEncoder) Encode(record exportRecord) error {
+	return e.enc.Encode(record)
+}
 
-	router.Get("/value/{metricsType}/{metricsName}", handleValue(mStorage))
+func (ndjsonExportEncoder) Flush() error {
+	return nil
+}
 
-	router.Post("/value", handleValueJSON(mStorage))
+// handleExport streams current values of metrics as CSV or newline delimited JSON, chosen with the format query param.
+// With the history query param set to a duration, values recorded within it are exported before current ones.
+// Records are written as they are encoded, flushing the response every exportFlushRows records.
+func handleExport(mStorage storage.MetricsStorage, recorder *history.Recorder, registry *metadata.Registry) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		format := req.URL.Query().Get("format")
+		if format == "" {
+			format = "ndjson"
+		}
+		if format != "csv" && format != "ndjson" {
+			apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, fmt.Sprintf("Unknown export format %q", format))
+			return
+		}
 
-	router.Get("/ping", handlePing(mStorage))
+		var historyRange time.Duration
+		if value := req.URL.Query().Get("history"); value != "" {
+			var err error
+			historyRange, err = time.ParseDuration(value)
+			if err != nil || historyRange <= 0 {
+				apierror.Respond(res, req, http.StatusBadRequest, apierror.CodeBadRequest, fmt.Sprintf("Bad history range %q", value))
+				return
+			}
+		}
 
-	router.Get("/", handleRoot(mStorage))
+		snapshot, err := mStorage.GetAll(req.Context())
+		if err != nil {
+			logger.Log.Errorf("Request failed: %s", err)
+			apierror.Respond(res, req, http.StatusInternalServerError, apierror.CodeInternal, "Internal server error")
+			return
+		}
+
+		now := time.Now()
+		var encoder exportEncoder
+		if format == "csv" {
+			res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w := csv.NewWriter(res)
+			encoder = csvExportEncoder{w: w}
+			if err := w.Write([]string{"id", "type", "unit", "time", "value"}); err != nil {
+				logger.Log.Errorf("Failed to write response body")
+				return
+			}
+		} else {
+			res.Header().Set("Content-Type", "application/x-ndjson")
+			encoder = ndjsonExportEncoder{enc: json.NewEncoder(res)}
+		}
+		res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="metrics-%s.%s"`, now.UTC().Format("20060102T150405Z"), format))
+		res.WriteHeader(http.StatusOK)
+
+		type series struct {
+			name  string
+			mType string
+			value float64
+		}
+		all := make([]series, 0, len(snapshot.Gauges)+len(snapshot.Counters))
+		for name, value := range snapshot.Gauges {
+			all = append(all, series{name: name, mType: storage.MetricsTypeGauge, value: value})
+		}
+		for name, value := range snapshot.Counters {
+			all = append(all, series{name: name, mType: storage.MetricsTypeCounter, value: float64(value)})
+		}
+		sort.Slice(all, func(i, j int) bool {
+			if all[i].name != all[j].name {
+				return all[i].name < all[j].name
+			}
+			return all[i].mType < all[j].mType
+		})
+
+		rc := http.NewResponseController(res)
+		rows := 0
+		write := func(record exportRecord) error {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+			rows++
+			if rows%exportFlushRows == 0 {
+				if err := encoder.Flush(); err != nil {
+					return err
+				}
+				return rc.Flush()
+			}
+			return nil
+		}
+
+		for _, s := range all {
+			if !auth.AllowsMetric(req.Context(), s.name) {
+				continue
+			}
+
+			meta, _ := registry.Get(s.name)
+			record := exportRecord{ID: s.name, MType: s.mType, Unit: meta.Unit}
+			if historyRange > 0 {
+				for _, p := range recorder.Range(history.Key{MType: s.mType, Name: s.name}, now.Add(-historyRange), now) {
+					record.Time, record.Value = p.Time, queryValue(p.Value)
+					if err = write(record); err != nil {
+						break
+					}
+				}
+			}
+			if err == nil {
+				record.Time, record.Value = now, queryValue(s.value)
+				err = write(record)
+			}
+			if err != nil {
+				logger.Log.Errorf("Export failed: %s", err)
+				return
+			}
+		}
+
+		if err := encoder.Flush(); err != nil {
+			logger.Log.Errorf("Export failed: %s", err)
+		}
+	}
+}
+
+type historyPoint struct {
+	Time  int64   `json:"t"`
+	Value float64 `json:"v"`
+}
+
+type metricsSeries struct {
+	ID    string  `json:"id"`
+	MType string  `json:"type"`
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+	Help  string  `json:"help,omitempty"`
+	// ExpectedType is set if the metrics is expected to be reported with another type
+	ExpectedType string         `json:"expectedType,omitempty"`
+	History      []historyPoint `json:"history"`
+}
+
+type metricsList struct {
+	Metrics        []metricsSeries `json:"metrics"`
+	SampleInterval int             `json:"sampleInterval"`
+}
+
+// handleMetricsList lists current values of metrics along with their recent history.
+// It can be filtered by type and name substring with the type and q query params.
+func handleMetricsList(
+	mStorage storage.MetricsStorage,
+	recorder *history.Recorder,
+	registry *metadata.Registry,
+	sampleInterval int,
+) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		mType := req.URL.Query().Get("type")
+		switch mType {
+		case "", storage.MetricsTypeGauge, storage.MetricsTypeCounter:
+		default:
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeInvalidType, Message: "Wrong metrics type"})
+			return
+		}
+		query := strings.ToLower(req.URL.Query().Get("q"))
+
+		snapshot, err := mStorage.GetAll(req.Context())
+		if err != nil {
+			internalError(res, err)
+			return
+		}
+
+		response := metricsList{Metrics: []metricsSeries{}, SampleInterval: sampleInterval}
+		add := func(metricsType, name string, value float64) {
+			if mType != "" && mType != metricsType {
+				return
+			}
+			if !strings.Contains(strings.ToLower(name), query) || !auth.AllowsMetric(req.Context(), name) {
+				return
+			}
+
+			points := recorder.Get(history.Key{MType: metricsType, Name: name})
+			item := metricsSeries{ID: name, MType: metricsType, Value: value, History: make([]historyPoint, len(points))}
+			if meta, ok := registry.Get(name); ok {
+				item.Unit, item.Help = meta.Unit, meta.Help
+				if meta.Type != metricsType {
+					item.ExpectedType = meta.Type
+				}
+			}
+			for i, p := range points {
+				item.History[i] = historyPoint{Time: p.Time.UnixMilli(), Value: p.Value}
+			}
+			response.Metrics = append(response.Metrics, item)
+		}
+		for name, value := range snapshot.Gauges {
+			add(storage.MetricsTypeGauge, name, value)
+		}
+		for name, value := range snapshot.Counters {
+			add(storage.MetricsTypeCounter, name, float64(value))
+		}
+
+		sort.Slice(response.Metrics, func(i, j int) bool {
+			a, b := response.Metrics[i], response.Metrics[j]
+			if a.ID != b.ID {
+				return a.ID < b.ID
+			}
+			return a.MType < b.MType
+		})
+
+		writeJSON(res, response)
+	}
+}
+
+type listedMetrics struct {
+	models.Metrics
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+type metricsPage struct {
+	Metrics []listedMetrics `json:"metrics"`
+	// Total is the number of listed metrics on all pages, it's only known to clients allowed to read all metrics
+	Total      *int   `json:"total,omitempty"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// encodeCursor returns an opaque cursor of the position after the metrics.
+func encodeCursor(entry storage.MetricsEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(entry.MType + ":" + entry.Name))
+}
+
+func decodeCursor(cursor string, query *storage.MetricsListQuery) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return err
+	}
+
+	mType, name, ok := strings.Cut(string(data), ":")
+	if !ok || name == "" {
+		return errors.New("no metrics in cursor")
+	}
+	query.AfterType, query.AfterName = mType, name
+	return nil
+}
+
+// handleMetricsPage lists metrics a page at a time, ordered by name and type.
+// They can be filtered by type, name prefix and name regexp with the type, prefix and regex query params.
+// Pages are continued with nextCursor of the previous one as the cursor query param.
+func handleMetricsPage(mStorage storage.MetricsStorage) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+
+		params := req.URL.Query()
+		query := storage.MetricsListQuery{
+			MType:  params.Get("type"),
+			Prefix: params.Get("prefix"),
+			Regex:  params.Get("regex"),
+		}
+		switch query.MType {
+		case "", storage.MetricsTypeGauge, storage.MetricsTypeCounter:
+		default:
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeInvalidType, Message: "Wrong metrics type"})
+			return
+		}
+		if _, err := regexp.Compile(query.Regex); err != nil {
+			apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeBadRequest, Message: fmt.Sprintf("Bad name regex: %s", err)})
+			return
+		}
+
+		limit := defaultListLimit
+		if value := params.Get("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxListLimit {
+				apierror.Write(res, http.StatusBadRequest, apierror.Error{
+					Code:    apierror.CodeBadRequest,
+					Message: fmt.Sprintf("Limit should be from 1 to %d", maxListLimit),
+				})
+				return
+			}
+		}
+		if cursor := params.Get("cursor"); cursor != "" {
+			if err := decodeCursor(cursor, &query); err != nil {
+				apierror.Write(res, http.StatusBadRequest, apierror.Error{Code: apierror.CodeBadRequest, Message: "Bad cursor"})
+				return
+			}
+		}
+
+		// One more metrics is listed to know if there is a next page.
+		// Metrics the client is not allowed to read are skipped, so listing goes on until the page is full.
+		var entries []storage.MetricsEntry
+		for len(entries) <= limit {
+			query.Limit = limit + 1 - len(entries)
+			batch, err := mStorage.List(req.Context(), query)
+			if err != nil {
+				internalError(res, err)
+				return
+			}
+
+			for _, entry := range batch {
+				if auth.AllowsMetric(req.Context(), entry.Name) {
+					entries = append(entries, entry)
+				}
+			}
+			if len(batch) < query.Limit {
+				break
+			}
+			last := batch[len(batch)-1]
+			query.AfterName, query.AfterType = last.Name, last.MType
+		}
+
+		response := metricsPage{Metrics: []listedMetrics{}}
+		if len(entries) > limit {
+			entries = entries[:limit]
+			response.NextCursor = encodeCursor(entries[limit-1])
+		}
+		for i := range entries {
+			entry := &entries[i]
+			item := listedMetrics{Metrics: models.Metrics{ID: entry.Name, MType: entry.MType}}
+			if entry.MType == storage.MetricsTypeGauge {
+				item.Value = &entry.Gauge
+			} else {
+				item.Delta = &entry.Counter
+			}
+			if !entry.UpdatedAt.IsZero() {
+				item.UpdatedAt = &entry.UpdatedAt
+			}
+			response.Metrics = append(response.Metrics, item)
+		}
+
+		if auth.AllowsAllMetrics(req.Context()) {
+			total, err := mStorage.Count(req.Context(), query)
+			if err != nil {
+				internalError(res, err)
+				return
+			}
+			response.Total = &total
+		}
+
+		writeJSON(res, response)
+	}
+}
+
+func metricsRouter(
+	ctx context.Context,
+	conf config.Config,
+	mStorage storage.MetricsStorage,
+	saver *saver.MetricsStorageSaver,
+	keyring *signer.Keyring,
+	decryptor *envelope.Decryptor,
+	authenticator *auth.Authenticator,
+	idempotencyStore idempotency.Store,
+	workers *sync.WaitGroup,
+) chi.Router {
+	statsRegistry := stats.NewRegistry()
+
+	// Background workers write to the storage, so Run waits for them to stop before saving and closing it
+	if workers == nil {
+		workers = &sync.WaitGroup{}
+	}
+	background := func(fn func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			fn()
+		}()
+	}
+
+	router := chi.NewRouter()
+	router.Use(middleware.StripSlashes, middlewares.Logging)
+	if conf.RateLimit > 0 {
+		router.Use(middlewares.RateLimiting(ratelimit.New(conf.RateLimit, conf.RateBurst), clientKey(conf), statsRegistry))
+	}
+	// Imports are too large to be read into memory at once, so their bodies are only limited and left to the handler
+	limitingBodies := func(router chi.Router) {
+		if conf.MaxBodySize > 0 {
+			router.Use(middlewares.Except(middlewares.LimitingBody(int64(conf.MaxBodySize), statsRegistry), "/import"))
+		}
+		if conf.MaxImportSize > 0 {
+			router.Use(middlewares.Only(middlewares.LimitingStream(int64(conf.MaxImportSize), statsRegistry), "/import"))
+		}
+	}
+	if decryptor != nil {
+		limitingBodies(router)
+		router.Use(middlewares.Decrypting(decryptor, conf.CryptoRequired))
+	}
+	router.Use(middlewares.Compressing)
+	limitingBodies(router)
+
+	// Unsigned requests are let through unless enforcing is opted in, as they always were
+	signPolicy := middlewares.SignPolicy(conf.SignPolicy)
+	if signPolicy == "" {
+		signPolicy = middlewares.SignPolicyPermissive
+	}
+	checkSignatures := keyring != nil && signPolicy != middlewares.SignPolicyOff
+	if checkSignatures {
+		var replayGuard *middlewares.ReplayGuard
+		if conf.SignMaxSkew > 0 {
+			replayGuard = middlewares.NewReplayGuard(
+				time.Duration(conf.SignMaxSkew)*time.Second,
+				conf.SignNonceCacheSize,
+				conf.SignAcceptLegacy,
+			)
+		}
+		router.Use(middlewares.SignValidating(keyring, replayGuard, statsRegistry))
+	}
+	if keyring != nil {
+		router.Use(middlewares.Signing(keyring))
+	}
+
+	limiter := newLimiter(ctx, conf, mStorage, statsRegistry)
+	seriesOwner := middlewares.SeriesOwner(conf.TrustedProxies)
+
+	registry := metadata.NewRegistry(conf.MetadataFile, statsRegistry)
+	if err := registry.Load(); err != nil {
+		logger.Log.Errorf("Failed to restore metrics metadata: %s", err)
+	}
+
+	if idempotencyStore == nil {
+		idempotencyStore = idempotency.NewMemStore(time.Duration(conf.IdempotencyTTL)*time.Second, conf.IdempotencyCacheSize)
+	}
+
+	hub := stream.NewHub(streamBufferSize, statsRegistry)
+	saveOnUpdate := onUpdate(conf.StoreInterval, saver)
+	onUpdateDone := func(ctx context.Context, updates []stream.Update) {
+		hub.Publish(updates)
+		saveOnUpdate(ctx)
+	}
+
+	recorder := history.NewRecorder(conf.HistorySize)
+	if conf.HistoryInterval > 0 {
+		background(func() { recorder.Run(ctx, mStorage, time.Duration(conf.HistoryInterval)*time.Second) })
+	}
+
+	alerts := newAlerting(ctx, conf, mStorage, recorder, background)
+
+	if conf.DerivedRulesFile != "" && conf.DerivedInterval > 0 {
+		rules, err := derived.Load(conf.DerivedRulesFile)
+		if err != nil {
+			panic(err)
+		}
+		derivedRecorder := derived.NewRecorder(rules, mStorage)
+		background(func() { derivedRecorder.Run(ctx, time.Duration(conf.DerivedInterval)*time.Second) })
+	}
+
+	apiDoc, err := openapi.Load()
+	if err != nil {
+		panic(err)
+	}
+	validator := openapi.NewValidator(apiDoc)
+
+	router.Get("/openapi.json", handleOpenAPI)
+
+	// The dashboard page contains no data, metrics are requested from the API with the user's token
+	router.Get("/", dashboard.Index)
+	router.Handle("/dashboard/*", http.StripPrefix("/dashboard", dashboard.Assets()))
+
+	authorizing := func(scope auth.Scope) func(http.Handler) http.Handler {
+		if authenticator == nil {
+			return func(next http.Handler) http.Handler { return next }
+		}
+		return middlewares.Authorizing(authenticator, scope)
+	}
+
+	router.Group(func(router chi.Router) {
+		if len(conf.TrustedSubnets) > 0 {
+			router.Use(middlewares.TrustedSubnet(conf.TrustedSubnets, conf.TrustedProxies))
+		}
+		router.Use(authorizing(auth.ScopeWrite))
+		if checkSignatures {
+			router.Use(middlewares.SignRequired(signPolicy, statsRegistry))
+		}
+
+		router.With(middlewares.Validating(validator, "/updates"), middlewares.Idempotent(idempotencyStore, statsRegistry)).
+			Post("/updates", handleUpdatesJSON(mStorage, limiter, seriesOwner, registry, onUpdateDone))
+
+		router.Post("/import", handleImport(mStorage, limiter, seriesOwner, registry, onUpdateDone))
+
+		// Need to route update requests to the same handler even if some named path components are absent
+		// So we haven't found better way other than using such routing
+		router.Route("/update", func(router chi.Router) {
+			router.With(middlewares.Validating(validator, "/update")).
+				Post("/", handleUpdateJSON(mStorage, limiter, seriesOwner, registry, onUpdateDone))
+			router.Route("/{metricsType}", func(router chi.Router) {
+				router.Post("/", handleUpdate(mStorage, limiter, seriesOwner, registry, onUpdateDone))
+				router.Route("/{metricsName}", func(router chi.Router) {
+					router.Post("/", handleUpdate(mStorage, limiter, seriesOwner, registry, onUpdateDone))
+					router.Route("/{metricsValue}", func(router chi.Router) {
+						router.Post("/", handleUpdate(mStorage, limiter, seriesOwner, registry, onUpdateDone))
+					})
+				})
+			})
+		})
+	})
+
+	router.Group(func(router chi.Router) {
+		router.Use(authorizing(auth.ScopeRead))
+
+		router.Get("/value/{metricsType}/{metricsName}", handleValue(mStorage))
+
+		router.With(middlewares.Validating(validator, "/value")).
+			Post("/value", handleValueJSON(mStorage))
+
+		router.Get("/api/metrics", handleMetricsList(mStorage, recorder, registry, conf.HistoryInterval))
+
+		router.Get("/metadata", handleMetadata(registry))
+
+		router.Get("/metrics", handlePrometheus(mStorage, registry))
+
+		router.Get("/export", handleExport(mStorage, recorder, registry))
+
+		router.Get("/metrics/list", handleMetricsPage(mStorage))
+
+		router.Get("/stream", handleStream(ctx, hub))
+
+		router.Get("/alerts", handleAlerts(alerts))
+
+		router.With(middlewares.Validating(validator, "/query")).
+			Post("/query", handleQuery(mStorage, recorder))
+	})
+
+	router.Group(func(router chi.Router) {
+		router.Use(authorizing(auth.ScopeAdmin))
+
+		router.Get("/ping", handlePing(mStorage))
+
+		router.Get("/stats", handleStats(statsRegistry))
+	})
 
 	return router
 }
 
-func onUpdate(ctx context.Context, interval int, saver *saver.MetricsStorageSaver) func() {
+func clientKey(conf config.Config) middlewares.ClientKey {
+	switch conf.RateLimitKey {
+	case "agent":
+		return middlewares.ClientKeyByAgent
+	case "token":
+		return middlewares.ClientKeyByToken(conf.TrustedProxies)
+	default:
+		return middlewares.ClientKeyByIP(conf.TrustedProxies)
+	}
+}
+
+func newLimiter(ctx context.Context, conf config.Config, mStorage storage.MetricsStorage, registry *stats.Registry) *limits.Limiter {
+	rules := limits.Rules{
+		MaxNameLength:  conf.MetricNameMaxLength,
+		MaxSeries:      conf.MaxSeries,
+		MaxAgentSeries: conf.MaxAgentSeries,
+
+		AgentIdleTimeout: time.Duration(conf.AgentSeriesTTL) * time.Second,
+	}
+	if conf.MetricNamePattern != "" {
+		rules.NamePattern = regexp.MustCompile(conf.MetricNamePattern)
+	}
+
+	limiter := limits.New(rules, registry)
+	if conf.MaxSeries > 0 {
+		snapshot, err := mStorage.GetAll(ctx)
+		if err != nil {
+			logger.Log.Errorf("Failed to seed series limiter: %s", err)
+		} else {
+			limiter.Seed(snapshot)
+		}
+	}
+
+	return limiter
+}
+
+// newAlerting starts evaluating alert rules from conf.AlertRulesFile in background, if it's set.
+func newAlerting(
+	ctx context.Context,
+	conf config.Config,
+	mStorage storage.MetricsStorage,
+	recorder *history.Recorder,
+	background func(func()),
+) *alerting.Engine {
+	if conf.AlertRulesFile == "" {
+		return nil
+	}
+
+	rules, err := alerting.Load(conf.AlertRulesFile)
+	if err != nil {
+		panic(err)
+	}
+	for _, rule := range rules {
+		if rule.UsesHistory() && conf.HistoryInterval <= 0 {
+			logger.Log.Warnf("Alert rule %s needs metrics history, which is disabled", rule.Name)
+		}
+	}
+
+	engine := alerting.NewEngine(rules, mStorage, recorder, conf.AlertStateFile)
+	if err := engine.LoadState(); err != nil {
+		logger.Log.Errorf("Failed to restore alert states: %s", err)
+	}
+
+	if conf.NotifyReceiversFile != "" {
+		receivers, err := notify.Load(conf.NotifyReceiversFile)
+		if err != nil {
+			panic(err)
+		}
+		notifier, err := notify.New(receivers, &http.Client{Timeout: notifyTimeout})
+		if err != nil {
+			panic(err)
+		}
+		engine.OnChange(notifier.Notify)
+		background(func() { notifier.Run(ctx) })
+	}
+
+	if conf.AlertEvalInterval > 0 {
+		background(func() { engine.Run(ctx, time.Duration(conf.AlertEvalInterval)*time.Second) })
+	}
+
+	return engine
+}
+
+func onUpdate(interval int, saver *saver.MetricsStorageSaver) func(context.Context) {
 	if saver == nil {
-		return func() {}
+		return func(context.Context) {}
 	}
 
+	var m sync.Mutex
 	var lastSaveTime = time.Now()
-	return func() {
+	return func(ctx context.Context) {
+		m.Lock()
+		defer m.Unlock()
 		if interval == 0 ||
 			time.Since(lastSaveTime) > time.Duration(interval)*time.Second {
 
@@ -503,14 +1805,18 @@ func onUpdate(ctx context.Context, interval int, saver *saver.MetricsStorageSave
 	}
 }
 
-var server *http.Server
-
+// Run serves metrics API until ctx is cancelled. Then it stops accepting new connections,
+// waits up to conf.ShutdownTimeout for in-flight requests to complete, waits for background
+// workers to stop and saves the storage.
 func Run(
 	ctx context.Context,
 	conf config.Config,
 	mStorage storage.MetricsStorage,
 	saver *saver.MetricsStorageSaver,
-	signer *signer.Signer,
+	keyring *signer.Keyring,
+	decryptor *envelope.Decryptor,
+	authenticator *auth.Authenticator,
+	idempotencyStore idempotency.Store,
 ) {
 	err := logger.Initialize("info")
 	if err != nil {
@@ -518,37 +1824,72 @@ func Run(
 	}
 	defer logger.Log.Sync()
 
-	if saver != nil {
-		if conf.Restore {
-			err := saver.Load(ctx)
-			if err != nil {
-				logger.Log.Debugf("Error loading db: %s", err.Error())
-			}
+	if saver != nil && conf.Restore {
+		err := saver.Load(ctx)
+		if err != nil {
+			logger.Log.Debugf("Error loading db: %s", err.Error())
 		}
+	}
 
-		defer func() {
-			err := saver.Save(ctx)
-			if err != nil {
-				logger.Log.Debugf("Error saving db: %s", err.Error())
-			}
-			logger.Log.Infof("Storage is saved.")
+	var workers sync.WaitGroup
+	workersCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	server := &http.Server{
+		Addr:    conf.Address,
+		Handler: metricsRouter(workersCtx, conf, mStorage, saver, keyring, decryptor, authenticator, idempotencyStore, &workers),
+	}
+
+	serveErr := make(chan error, 1)
+	if conf.TLSCertFile != "" {
+		server.TLSConfig, err = tlsconf.Server(conf.TLSClientCAFile)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			serveErr <- server.ListenAndServeTLS(conf.TLSCertFile, conf.TLSKeyFile)
+		}()
+	} else {
+		go func() {
+			serveErr <- server.ListenAndServe()
 		}()
 	}
 
-	server = &http.Server{
-		Addr:    conf.Address,
-		Handler: metricsRouter(ctx, conf, mStorage, saver, signer),
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		logger.Log.Infof("Shutting down server...")
+		err = shutdown(server, time.Duration(conf.ShutdownTimeout)*time.Second)
 	}
-	err = server.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
 
+	stopWorkers()
+	workers.Wait()
 	logger.Log.Infof("Server is stopped.")
+
+	if saver != nil {
+		// Requests may have taken all of the shutdown timeout, the final save gets its own
+		saveCtx, cancel := context.WithTimeout(context.Background(), finalSaveTimeout)
+		defer cancel()
+		err := saver.Save(saveCtx)
+		if err != nil {
+			logger.Log.Errorf("Error saving db: %s", err.Error())
+			return
+		}
+		logger.Log.Infof("Storage is saved.")
+	}
 }
 
-func Stop() {
-	if err := server.Close(); err != nil {
-		log.Fatalf("HTTP close error: %v", err)
+func shutdown(server *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Log.Errorf("Requests are not drained in %s, closing connections", timeout)
+		return server.Close()
 	}
+
+	return err
 }
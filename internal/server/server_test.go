@@ -1,21 +1,39 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/SamMeown/metrix/internal/agent/client/api"
+	"github.com/SamMeown/metrix/internal/crypto/envelope"
 	"github.com/SamMeown/metrix/internal/crypto/signer"
 	"github.com/SamMeown/metrix/internal/storage/mock"
+	"github.com/SamMeown/metrix/internal/utils/config_utils"
 	"github.com/golang/mock/gomock"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/SamMeown/metrix/internal/server/auth"
 	"github.com/SamMeown/metrix/internal/server/config"
 	"github.com/SamMeown/metrix/internal/server/saver"
 	"github.com/SamMeown/metrix/internal/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHandleUpdate(t *testing.T) {
@@ -34,8 +52,9 @@ func TestHandleUpdate(t *testing.T) {
 			requestMethod: http.MethodPost,
 			requestPath:   "/update/",
 			want: want{
+				// Routed to the JSON update handler, which fails on the empty body
 				statusCode:  http.StatusBadRequest,
-				contentType: "text/plain; charset=utf-8",
+				contentType: "application/json",
 			},
 		},
 		{
@@ -110,13 +129,13 @@ func TestHandleUpdate(t *testing.T) {
 				StoreInterval: 999999,
 				Restore:       false,
 			}
-			nullSigner := (*signer.Signer)(nil)
+			nullSigner := (*signer.Keyring)(nil)
 			nullSaver := &saver.MetricsStorageSaver{}
 			mStorage := storage.New()
 
 			req := httptest.NewRequest(tt.requestMethod, tt.requestPath, nil)
 			recorder := httptest.NewRecorder()
-			handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nullSigner)
+			handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nullSigner, nil, nil, nil, nil)
 
 			handler.ServeHTTP(recorder, req)
 
@@ -140,7 +159,7 @@ func TestHandleValue(t *testing.T) {
 	mStorage.EXPECT().GetCounter(gomock.Any(), "b").Return(&counterValue, nil)
 
 	nullSaver := &saver.MetricsStorageSaver{}
-	nullSigner := (*signer.Signer)(nil)
+	nullSigner := (*signer.Keyring)(nil)
 	testConfig := config.Config{
 		StoreInterval: 999999,
 		Restore:       false,
@@ -183,7 +202,7 @@ func TestHandleValue(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			req := httptest.NewRequest(tt.requestMethod, tt.requestPath, nil)
 			recorder := httptest.NewRecorder()
-			handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nullSigner)
+			handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nullSigner, nil, nil, nil, nil)
 
 			handler.ServeHTTP(recorder, req)
 
@@ -200,3 +219,1705 @@ func TestHandleValue(t *testing.T) {
 		})
 	}
 }
+
+func TestMetricsLimits(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval:       999999,
+		MetricNameMaxLength: 16,
+		MaxSeries:           3,
+		MaxAgentSeries:      2,
+	}
+	nullSigner := (*signer.Keyring)(nil)
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nullSigner, nil, nil, nil, nil)
+
+	tests := []struct {
+		name        string
+		requestPath string
+		remoteAddr  string
+		agentID     string
+		body        string
+		wantStatus  int
+	}{
+		{
+			name:        "test blank name",
+			requestPath: "/update",
+			body:        `{"id":"  ","type":"gauge","value":1}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "test name with control characters",
+			requestPath: "/update",
+			body:        `{"id":"a\u0001b","type":"gauge","value":1}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "test too long name",
+			requestPath: "/update/counter/" + strings.Repeat("a", 17) + "/1",
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "test agent series within limits",
+			requestPath: "/updates",
+			remoteAddr:  "10.0.0.1:1234",
+			body:        `[{"id":"a","type":"gauge","value":1},{"id":"b","type":"counter","delta":1}]`,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "test agent series limit",
+			requestPath: "/update",
+			remoteAddr:  "10.0.0.1:1234",
+			body:        `{"id":"c","type":"gauge","value":1}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+		},
+		{
+			name:        "test known series are not limited",
+			requestPath: "/update/gauge/a/2",
+			remoteAddr:  "10.0.0.1:1234",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "test agent id header doesn't reset agent series",
+			requestPath: "/update",
+			remoteAddr:  "10.0.0.1:1234",
+			agentID:     "agent3",
+			body:        `{"id":"c","type":"gauge","value":1}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+		},
+		{
+			name:        "test other agent within limits",
+			requestPath: "/update",
+			remoteAddr:  "10.0.0.2:1234",
+			body:        `{"id":"c","type":"gauge","value":1}`,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "test global series limit",
+			requestPath: "/update",
+			remoteAddr:  "10.0.0.2:1234",
+			body:        `{"id":"d","type":"gauge","value":1}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.requestPath, strings.NewReader(tt.body))
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			if tt.agentID != "" {
+				req.Header.Set("X-Agent-ID", tt.agentID)
+			}
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			result := recorder.Result()
+			io.Copy(io.Discard, result.Body)
+			result.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, result.StatusCode)
+		})
+	}
+
+	gauge, _ := mStorage.GetGauge(context.Background(), "d")
+	assert.Nil(t, gauge)
+
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	result := recorder.Result()
+	defer result.Body.Close()
+	var stats map[string]int64
+	assert.NoError(t, json.NewDecoder(result.Body).Decode(&stats))
+	assert.Equal(t, int64(3), stats["rejected_metrics_invalid_name"])
+	assert.Equal(t, int64(1), stats["rejected_metrics_series_limit"])
+	assert.Equal(t, int64(2), stats["rejected_metrics_agent_series_limit"])
+}
+
+func TestEncryptedUpdates(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	encryptor, err := envelope.NewEncryptor(key.PublicKey())
+	require.NoError(t, err)
+	decryptor, err := envelope.NewDecryptor(key)
+	require.NoError(t, err)
+
+	testConfig := config.Config{
+		StoreInterval: 999999,
+	}
+	contentSigner := signer.New("secret")
+	keyring, err := signer.NewKeyring("", map[string]string{"": "secret"})
+	require.NoError(t, err)
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, keyring, decryptor, nil, nil, nil)
+
+	body := []byte(`[{"id":"a","type":"counter","delta":3}]`)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	gz.Close()
+	sealed, err := encryptor.Encrypt(compressed.Bytes())
+	require.NoError(t, err)
+
+	send := func(payload []byte, scheme string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("HashSHA256", contentSigner.GetSignature(body))
+		req.Header.Set(envelope.Header, scheme)
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		result := recorder.Result()
+		io.Copy(io.Discard, result.Body)
+		result.Body.Close()
+
+		return result.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, send(sealed, encryptor.Scheme()))
+	assert.Equal(t, http.StatusBadRequest, send(sealed, envelope.SchemeRSA))
+	assert.Equal(t, http.StatusBadRequest, send(compressed.Bytes(), encryptor.Scheme()))
+
+	counter, _ := mStorage.GetCounter(context.Background(), "a")
+	require.NotNil(t, counter)
+	assert.Equal(t, int64(3), *counter)
+
+	assert.Equal(t, http.StatusOK, send(compressed.Bytes(), ""), "cleartext is accepted unless required")
+
+	testConfig.CryptoRequired = true
+	handler = metricsRouter(context.Background(), testConfig, mStorage, nullSaver, keyring, decryptor, nil, nil, nil)
+	assert.Equal(t, http.StatusBadRequest, send(compressed.Bytes(), ""))
+	assert.Equal(t, http.StatusOK, send(sealed, encryptor.Scheme()))
+
+	req := httptest.NewRequest(http.MethodGet, "/value/counter/a", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code, "bodyless requests need no encryption")
+}
+
+func TestSignedRequestReplay(t *testing.T) {
+	contentSigner := signer.New("secret")
+	keyring, err := signer.NewKeyring("", map[string]string{"": "secret"})
+	require.NoError(t, err)
+
+	body := []byte(`[{"id":"a","type":"counter","delta":1}]`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name       string
+		timestamp  string
+		nonce      string
+		signature  string
+		wantStatus int
+	}{
+		{
+			name:       "test fresh request",
+			timestamp:  now,
+			nonce:      "n1",
+			signature:  contentSigner.GetRequestSignature(http.MethodPost, "/updates", now, "n1", body),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "test replayed request",
+			timestamp:  now,
+			nonce:      "n1",
+			signature:  contentSigner.GetRequestSignature(http.MethodPost, "/updates", now, "n1", body),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "test nonce not covered by signature",
+			timestamp:  now,
+			nonce:      "n2",
+			signature:  contentSigner.GetRequestSignature(http.MethodPost, "/updates", now, "n1", body),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "test stale request",
+			timestamp:  stale,
+			nonce:      "n3",
+			signature:  contentSigner.GetRequestSignature(http.MethodPost, "/updates", stale, "n3", body),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "test legacy signature",
+			signature:  contentSigner.GetSignature(body),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "test another fresh request",
+			timestamp:  now,
+			nonce:      "n4",
+			signature:  contentSigner.GetRequestSignature(http.MethodPost, "/updates", now, "n4", body),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "test nonce cache full",
+			timestamp:  now,
+			nonce:      "n5",
+			signature:  contentSigner.GetRequestSignature(http.MethodPost, "/updates", now, "n5", body),
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:       "test replay while nonce cache is full",
+			timestamp:  now,
+			nonce:      "n1",
+			signature:  contentSigner.GetRequestSignature(http.MethodPost, "/updates", now, "n1", body),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	// Replays are rejected under the default permissive policy too
+	for _, policy := range []string{"enforce", ""} {
+		t.Run("policy "+policy, func(t *testing.T) {
+			testConfig := config.Config{
+				StoreInterval:      999999,
+				SignPolicy:         policy,
+				SignMaxSkew:        60,
+				SignNonceCacheSize: 2,
+				SignAcceptLegacy:   false,
+			}
+			nullSaver := &saver.MetricsStorageSaver{}
+			mStorage := storage.New()
+			handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, keyring, nil, nil, nil, nil)
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+					req.Header.Set(signer.HeaderSignature, tt.signature)
+					if tt.timestamp != "" {
+						req.Header.Set(signer.HeaderTimestamp, tt.timestamp)
+					}
+					if tt.nonce != "" {
+						req.Header.Set(signer.HeaderNonce, tt.nonce)
+					}
+					recorder := httptest.NewRecorder()
+
+					handler.ServeHTTP(recorder, req)
+
+					result := recorder.Result()
+					io.Copy(io.Discard, result.Body)
+					result.Body.Close()
+
+					assert.Equal(t, tt.wantStatus, result.StatusCode)
+				})
+			}
+
+			counter, _ := mStorage.GetCounter(context.Background(), "a")
+			require.NotNil(t, counter)
+			assert.Equal(t, int64(2), *counter)
+		})
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval: 999999,
+		SignPolicy:    "enforce",
+	}
+	keyring, err := signer.NewKeyring("new", map[string]string{"old": "old secret", "new": "new secret"})
+	require.NoError(t, err)
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, keyring, nil, nil, nil, nil)
+
+	body := []byte(`{"id":"a","type":"gauge","value":1}`)
+	tests := []struct {
+		name       string
+		keyID      string
+		key        string
+		wantStatus int
+	}{
+		{"test old key", "old", "old secret", http.StatusOK},
+		{"test new key", "new", "new secret", http.StatusOK},
+		{"test primary key without id", "", "new secret", http.StatusOK},
+		{"test non primary key without id", "", "old secret", http.StatusBadRequest},
+		{"test unknown key", "older", "old secret", http.StatusBadRequest},
+		{"test mismatched key", "old", "new secret", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/update", bytes.NewReader(body))
+			req.Header.Set(signer.HeaderSignature, signer.New(tt.key).GetSignature(body))
+			if tt.keyID != "" {
+				req.Header.Set(signer.HeaderKeyID, tt.keyID)
+			}
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			result := recorder.Result()
+			respBody, _ := io.ReadAll(result.Body)
+			result.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, result.StatusCode)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, "new", result.Header.Get(signer.HeaderKeyID))
+				assert.Equal(t, signer.New("new secret").GetSignature(respBody), result.Header.Get(signer.HeaderSignature))
+			}
+		})
+	}
+}
+
+func TestSignPolicy(t *testing.T) {
+	keyring, err := signer.NewKeyring("", map[string]string{"": "secret"})
+	require.NoError(t, err)
+	_, contentSigner := keyring.Primary()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	type request struct {
+		method     string
+		path       string
+		signedPath string
+	}
+	requests := []request{
+		{method: http.MethodPost, path: "/update/counter/a/1"},
+		{method: http.MethodPost, path: "/update/counter/a/1", signedPath: "/update/counter/a/1"},
+		{method: http.MethodPost, path: "/update/counter/a/100", signedPath: "/update/counter/a/1"},
+		{method: http.MethodGet, path: "/value/counter/a"},
+	}
+
+	tests := []struct {
+		name         string
+		policy       string
+		wantStatuses []int
+		wantCounter  int64
+		wantStats    map[string]int64
+	}{
+		{
+			name:         "test enforce",
+			policy:       "enforce",
+			wantStatuses: []int{http.StatusUnauthorized, http.StatusOK, http.StatusBadRequest, http.StatusOK},
+			wantCounter:  1,
+			wantStats: map[string]int64{
+				"rejected_requests_missing_signature": 1,
+				"rejected_requests_invalid_signature": 1,
+			},
+		},
+		{
+			name:         "test permissive",
+			policy:       "permissive",
+			wantStatuses: []int{http.StatusOK, http.StatusOK, http.StatusBadRequest, http.StatusOK},
+			wantCounter:  2,
+			wantStats: map[string]int64{
+				"unverified_requests":                 1,
+				"rejected_requests_invalid_signature": 1,
+			},
+		},
+		{
+			name:         "test off",
+			policy:       "off",
+			wantStatuses: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK},
+			wantCounter:  102,
+			wantStats:    map[string]int64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig := config.Config{
+				StoreInterval: 999999,
+				SignPolicy:    tt.policy,
+			}
+			nullSaver := &saver.MetricsStorageSaver{}
+			mStorage := storage.New()
+			handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, keyring, nil, nil, nil, nil)
+
+			for i, r := range requests {
+				req := httptest.NewRequest(r.method, r.path, nil)
+				if r.signedPath != "" {
+					nonce := fmt.Sprintf("%s-%d", tt.policy, i)
+					req.Header.Set(signer.HeaderSignature, contentSigner.GetRequestSignature(r.method, r.signedPath, now, nonce, nil))
+					req.Header.Set(signer.HeaderTimestamp, now)
+					req.Header.Set(signer.HeaderNonce, nonce)
+				}
+				recorder := httptest.NewRecorder()
+
+				handler.ServeHTTP(recorder, req)
+
+				result := recorder.Result()
+				io.Copy(io.Discard, result.Body)
+				result.Body.Close()
+
+				assert.Equal(t, tt.wantStatuses[i], result.StatusCode, "%s %s", r.method, r.path)
+			}
+
+			counter, _ := mStorage.GetCounter(context.Background(), "a")
+			require.NotNil(t, counter)
+			assert.Equal(t, tt.wantCounter, *counter)
+
+			req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			result := recorder.Result()
+			defer result.Body.Close()
+			var stats map[string]int64
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&stats))
+			assert.Equal(t, tt.wantStats, stats)
+		})
+	}
+}
+
+func TestForgedSignature(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval: 999999,
+	}
+	keyring, err := signer.NewKeyring("", map[string]string{"": "secret"})
+	require.NoError(t, err)
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, keyring, nil, nil, nil, nil)
+
+	tests := []struct {
+		name       string
+		signature  string
+		keyID      string
+		wantStatus int
+	}{
+		{"test unsigned", "", "", http.StatusOK},
+		{"test forged signature", "deadbeef", "", http.StatusBadRequest},
+		{"test unknown key", signer.New("secret").GetSignature(nil), "other", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/update/counter/a/1", nil)
+			if tt.signature != "" {
+				req.Header.Set(signer.HeaderSignature, tt.signature)
+			}
+			if tt.keyID != "" {
+				req.Header.Set(signer.HeaderKeyID, tt.keyID)
+			}
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			result := recorder.Result()
+			io.Copy(io.Discard, result.Body)
+			result.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, result.StatusCode)
+		})
+	}
+
+	counter, _ := mStorage.GetCounter(context.Background(), "a")
+	require.NotNil(t, counter)
+	assert.Equal(t, int64(1), *counter, "only the unsigned update is applied")
+}
+
+func TestTokenAuth(t *testing.T) {
+	authenticator, err := auth.New([]auth.Token{
+		{Name: "agent", Token: "agent-token", Scopes: []auth.Scope{auth.ScopeWrite}, Prefixes: []string{"Heap"}},
+		{Name: "viewer", Token: "viewer-token", Scopes: []auth.Scope{auth.ScopeRead}},
+		{Name: "ops", Token: "ops-token", Scopes: []auth.Scope{auth.ScopeAdmin}},
+	})
+	require.NoError(t, err)
+
+	testConfig := config.Config{
+		StoreInterval: 999999,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, authenticator, nil, nil)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		token      string
+		wantStatus int
+	}{
+		{"test no token", http.MethodPost, "/update/gauge/HeapAlloc/1", "", "", http.StatusUnauthorized},
+		{"test unknown token", http.MethodPost, "/update/gauge/HeapAlloc/1", "", "other", http.StatusUnauthorized},
+		{"test write", http.MethodPost, "/update/gauge/HeapAlloc/1", "", "agent-token", http.StatusOK},
+		{"test write not allowed name", http.MethodPost, "/update/gauge/Alloc/1", "", "agent-token", http.StatusForbidden},
+		{"test batch with not allowed name", http.MethodPost, "/updates", `[{"id":"HeapSys","type":"gauge","value":1},{"id":"Sys","type":"gauge","value":1}]`, "agent-token", http.StatusForbidden},
+		{"test read without scope", http.MethodGet, "/value/gauge/HeapAlloc", "", "agent-token", http.StatusForbidden},
+		{"test write without scope", http.MethodPost, "/update/gauge/HeapAlloc/1", "", "viewer-token", http.StatusForbidden},
+		{"test read", http.MethodGet, "/value/gauge/HeapAlloc", "", "viewer-token", http.StatusOK},
+		{"test read json", http.MethodPost, "/value", `{"id":"HeapAlloc","type":"gauge"}`, "viewer-token", http.StatusOK},
+		{"test dashboard is public", http.MethodGet, "/", "", "", http.StatusOK},
+		{"test metrics list without token", http.MethodGet, "/api/metrics", "", "", http.StatusUnauthorized},
+		{"test metrics list", http.MethodGet, "/api/metrics", "", "viewer-token", http.StatusOK},
+		{"test ping without admin scope", http.MethodGet, "/ping", "", "viewer-token", http.StatusForbidden},
+		{"test admin", http.MethodGet, "/ping", "", "ops-token", http.StatusOK},
+		{"test admin implies write", http.MethodPost, "/update/gauge/Alloc/1", "", "ops-token", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			result := recorder.Result()
+			io.Copy(io.Discard, result.Body)
+			result.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, result.StatusCode)
+		})
+	}
+
+	gauge, _ := mStorage.GetGauge(context.Background(), "HeapSys")
+	assert.Nil(t, gauge)
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	trustedSubnets, err := configutils.ParseCIDRList("10.0.0.0/8, 192.168.1.0/24")
+	require.NoError(t, err)
+	trustedProxies, err := configutils.ParseCIDRList("172.16.0.1/32")
+	require.NoError(t, err)
+
+	testConfig := config.Config{
+		StoreInterval:  999999,
+		TrustedSubnets: trustedSubnets,
+		TrustedProxies: trustedProxies,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		remoteAddr string
+		realIP     string
+		wantStatus int
+	}{
+		{"test trusted peer", http.MethodPost, "/update/gauge/a/1", "10.1.2.3:5555", "", http.StatusOK},
+		{"test untrusted peer", http.MethodPost, "/update/gauge/a/1", "8.8.8.8:5555", "", http.StatusForbidden},
+		{"test real ip from untrusted proxy", http.MethodPost, "/update/gauge/a/1", "8.8.8.8:5555", "10.1.2.3", http.StatusForbidden},
+		{"test trusted real ip from proxy", http.MethodPost, "/updates", "172.16.0.1:5555", "192.168.1.10", http.StatusOK},
+		{"test untrusted real ip from proxy", http.MethodPost, "/update/gauge/a/1", "172.16.0.1:5555", "192.168.2.10", http.StatusForbidden},
+		{"test reads are not restricted", http.MethodGet, "/value/gauge/a", "8.8.8.8:5555", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`[]`))
+			req.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+
+			result := recorder.Result()
+			io.Copy(io.Discard, result.Body)
+			result.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, result.StatusCode)
+		})
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval: 999999,
+		RateLimit:     1,
+		RateBurst:     2,
+		RateLimitKey:  "agent",
+		MaxBodySize:   1024,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	send := func(agentID string, body []byte, gzipped bool) *http.Response {
+		if gzipped {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			_, err := zw.Write(body)
+			require.NoError(t, err)
+			require.NoError(t, zw.Close())
+			body = buf.Bytes()
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+		req.Header.Set("X-Agent-ID", agentID)
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		result := recorder.Result()
+		io.Copy(io.Discard, result.Body)
+		result.Body.Close()
+		return result
+	}
+
+	t.Run("test rate limit", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			assert.Equal(t, http.StatusOK, send("flooder", []byte(`[]`), false).StatusCode)
+		}
+
+		result := send("flooder", []byte(`[]`), false)
+		assert.Equal(t, http.StatusTooManyRequests, result.StatusCode)
+		assert.Equal(t, "1", result.Header.Get("Retry-After"))
+
+		assert.Equal(t, http.StatusOK, send("other", []byte(`[]`), false).StatusCode)
+	})
+
+	t.Run("test body size limit", func(t *testing.T) {
+		bomb := bytes.Repeat([]byte(" "), 1<<20)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, send("bomber", bomb, true).StatusCode)
+
+		body := []byte(`[{"id":"a","type":"gauge","value":1}]`)
+		assert.Equal(t, http.StatusOK, send("sender", body, true).StatusCode)
+	})
+}
+
+func TestJSONErrors(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval: 999999,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	type errorEnvelope struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+			ID      string `json:"id"`
+			Errors  []struct {
+				Code  string `json:"code"`
+				ID    string `json:"id"`
+				Index *int   `json:"index"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+
+	send := func(path string, body string) (*http.Response, errorEnvelope) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		result := recorder.Result()
+		defer result.Body.Close()
+
+		var envelope errorEnvelope
+		if result.StatusCode != http.StatusOK {
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&envelope))
+			assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
+		}
+		return result, envelope
+	}
+
+	t.Run("test batch reports every invalid item", func(t *testing.T) {
+		result, envelope := send("/updates", `[
+			{"id":"ok","type":"gauge","value":1},
+			{"id":"novalue","type":"gauge"},
+			{"id":"badtype","type":"histogram","value":1},
+			{"id":"","type":"counter","delta":1}
+		]`)
+
+		assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+		assert.Equal(t, "invalid_batch", envelope.Error.Code)
+		require.Len(t, envelope.Error.Errors, 3)
+		for i, want := range []struct {
+			code  string
+			id    string
+			index int
+		}{
+			{"missing_value", "novalue", 1},
+			{"invalid_type", "badtype", 2},
+			{"missing_name", "", 3},
+		} {
+			assert.Equal(t, want.code, envelope.Error.Errors[i].Code)
+			assert.Equal(t, want.id, envelope.Error.Errors[i].ID)
+			require.NotNil(t, envelope.Error.Errors[i].Index)
+			assert.Equal(t, want.index, *envelope.Error.Errors[i].Index)
+		}
+
+		value, err := mStorage.GetGauge(context.Background(), "ok")
+		require.NoError(t, err)
+		assert.Nil(t, value, "invalid batch must not be applied")
+	})
+
+	t.Run("test malformed json", func(t *testing.T) {
+		result, envelope := send("/update", `{"id":`)
+		assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+		assert.Equal(t, "invalid_json", envelope.Error.Code)
+	})
+
+	t.Run("test value not found", func(t *testing.T) {
+		result, envelope := send("/value", `{"id":"missing","type":"counter"}`)
+		assert.Equal(t, http.StatusNotFound, result.StatusCode)
+		assert.Equal(t, "not_found", envelope.Error.Code)
+		assert.Equal(t, "missing", envelope.Error.ID)
+	})
+}
+
+func TestPartialBatch(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval: 999999,
+		MaxSeries:     2,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	send := func(body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/updates?partial=true", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		return recorder.Result()
+	}
+
+	result := send(`[
+		{"id":"a","type":"gauge","value":1.5},
+		{"id":"c","type":"counter","delta":2},
+		{"id":"c","type":"counter","delta":3},
+		{"id":"novalue","type":"gauge"},
+		{"id":"overflow","type":"gauge","value":1}
+	]`)
+	defer result.Body.Close()
+	require.Equal(t, http.StatusOK, result.StatusCode)
+
+	var response struct {
+		Metrics []struct {
+			ID    string  `json:"id"`
+			MType string  `json:"type"`
+			Value float64 `json:"value"`
+		} `json:"metrics"`
+		Errors []struct {
+			Code  string `json:"code"`
+			ID    string `json:"id"`
+			Index int    `json:"index"`
+		} `json:"errors"`
+	}
+	require.NoError(t, json.NewDecoder(result.Body).Decode(&response))
+
+	require.Len(t, response.Metrics, 2)
+	assert.Equal(t, "a", response.Metrics[0].ID)
+	assert.Equal(t, 1.5, response.Metrics[0].Value)
+	assert.Equal(t, "c", response.Metrics[1].ID)
+	assert.Equal(t, float64(5), response.Metrics[1].Value)
+
+	require.Len(t, response.Errors, 2)
+	assert.Equal(t, "missing_value", response.Errors[0].Code)
+	assert.Equal(t, 3, response.Errors[0].Index)
+	assert.Equal(t, "series_limit", response.Errors[1].Code)
+	assert.Equal(t, "overflow", response.Errors[1].ID)
+	assert.Equal(t, 4, response.Errors[1].Index)
+
+	counter, err := mStorage.GetCounter(context.Background(), "c")
+	require.NoError(t, err)
+	require.NotNil(t, counter)
+	assert.Equal(t, int64(5), *counter)
+
+	result = send(`[{"id":"novalue","type":"gauge"}]`)
+	result.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, result.StatusCode, "nothing valid to apply")
+}
+
+func TestBatchStoreFailure(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval: 999999,
+		MaxSeries:     1,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	handler := metricsRouter(context.Background(), testConfig, storage.New(), nullSaver, nil, nil, nil, nil, nil)
+
+	send := func(ctx context.Context, path, body string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)).WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// Storage fails on a cancelled context, series of failed batches must not count towards the limit
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, http.StatusInternalServerError, send(cancelled, "/updates", `[{"id":"a","type":"gauge","value":1}]`))
+	assert.Equal(t, http.StatusInternalServerError, send(cancelled, "/updates?partial=true", `[{"id":"b","type":"gauge","value":1}]`))
+
+	assert.Equal(t, http.StatusOK, send(context.Background(), "/updates", `[{"id":"c","type":"gauge","value":1}]`))
+}
+
+func TestIdempotentUpdates(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval:        999999,
+		IdempotencyTTL:       3600,
+		IdempotencyCacheSize: 100,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	send := func(agentID, key, body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/updates", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Agent-ID", agentID)
+		req.Header.Set("Idempotency-Key", key)
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, req)
+
+		result := recorder.Result()
+		io.Copy(io.Discard, result.Body)
+		result.Body.Close()
+		return result
+	}
+
+	counterValue := func() int64 {
+		counter, err := mStorage.GetCounter(context.Background(), "c")
+		require.NoError(t, err)
+		require.NotNil(t, counter)
+		return *counter
+	}
+
+	batch := `[{"id":"c","type":"counter","delta":5}]`
+
+	result := send("agent1", "key1", batch)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Empty(t, result.Header.Get("Idempotent-Replayed"))
+
+	result = send("agent1", "key1", batch)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "true", result.Header.Get("Idempotent-Replayed"))
+	assert.Equal(t, int64(5), counterValue(), "retried batch is not applied again")
+
+	result = send("agent1", "key1", `[{"id":"c","type":"counter","delta":7}]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, result.StatusCode)
+	assert.Equal(t, int64(5), counterValue())
+
+	result = send("agent2", "key1", batch)
+	assert.Equal(t, http.StatusOK, result.StatusCode, "keys are scoped by agent")
+	assert.Equal(t, int64(10), counterValue())
+
+	result = send("agent1", "key2", batch)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, int64(15), counterValue())
+}
+
+func TestOpenAPI(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval: 999999,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	server := httptest.NewServer(metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil))
+	defer server.Close()
+
+	client := api.NewClient(server.URL, server.Client())
+	ctx := context.Background()
+
+	t.Run("test document is served", func(t *testing.T) {
+		response, err := client.GetOpenAPI(ctx)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, response.StatusCode())
+		require.NotNil(t, response.JSON200)
+		assert.Contains(t, *response.JSON200, "paths")
+	})
+
+	t.Run("test schema violations", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/updates",
+			strings.NewReader(`[{"id":"a","type":"gauge","value":1},{"id":"b","type":"gauge","value":"1"}]`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		result, err := server.Client().Do(req)
+		require.NoError(t, err)
+		defer result.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+
+		var envelope api.ErrorResponse
+		require.NoError(t, json.NewDecoder(result.Body).Decode(&envelope))
+		assert.Equal(t, "schema_violation", envelope.Error.Code)
+		require.Len(t, envelope.Error.Errors, 1)
+		assert.Equal(t, "/1/value: expected number", envelope.Error.Errors[0].Message)
+		require.NotNil(t, envelope.Error.Errors[0].Index)
+		assert.Equal(t, 1, *envelope.Error.Errors[0].Index)
+	})
+
+	t.Run("test generated client", func(t *testing.T) {
+		gauge, delta := 1.5, int64(3)
+		partial := true
+		response, err := client.UpdateMetricsBatch(ctx, &api.UpdateMetricsBatchParams{Partial: &partial}, []api.Metrics{
+			{ID: "g", MType: "gauge", Value: &gauge},
+			{ID: "c", MType: "counter", Delta: &delta},
+			{ID: "c", MType: "counter"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, response.StatusCode())
+		require.NotNil(t, response.JSON200)
+		assert.Len(t, response.JSON200.Metrics, 2)
+		require.Len(t, response.JSON200.Errors, 1)
+		assert.Equal(t, "missing_value", response.JSON200.Errors[0].Code)
+
+		value, err := client.GetMetricsValue(ctx, api.Metrics{ID: "c", MType: "counter"})
+		require.NoError(t, err)
+		require.NotNil(t, value.JSON200)
+		require.NotNil(t, value.JSON200.Delta)
+		assert.Equal(t, int64(3), *value.JSON200.Delta)
+
+		value, err = client.GetMetricsValue(ctx, api.Metrics{ID: "missing", MType: "counter"})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, value.StatusCode())
+		require.NotNil(t, value.JSONDefault)
+		assert.Equal(t, "not_found", value.JSONDefault.Error.Code)
+
+		plain, err := client.GetMetricsValuePlain(ctx, "gauge", "g")
+		require.NoError(t, err)
+		assert.Equal(t, "1.5\n", string(plain.Body))
+	})
+}
+
+func TestDashboard(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval:   999999,
+		HistoryInterval: 999999,
+		HistorySize:     10,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	require.NoError(t, mStorage.SetGauge(context.Background(), "Alloc", 1.5))
+	require.NoError(t, mStorage.SetCounter(context.Background(), "PollCount", 3))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(metricsRouter(ctx, testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil))
+	defer server.Close()
+
+	client := api.NewClient(server.URL, server.Client())
+
+	t.Run("test page and assets are served", func(t *testing.T) {
+		for path, contentType := range map[string]string{
+			"/":                    "text/html",
+			"/dashboard/app.js":    "javascript",
+			"/dashboard/style.css": "text/css",
+		} {
+			result, err := server.Client().Get(server.URL + path)
+			require.NoError(t, err)
+			io.Copy(io.Discard, result.Body)
+			result.Body.Close()
+
+			assert.Equal(t, http.StatusOK, result.StatusCode, path)
+			assert.Contains(t, result.Header.Get("Content-Type"), contentType, path)
+		}
+	})
+
+	t.Run("test metrics are listed with history", func(t *testing.T) {
+		var list *api.MetricsList
+		// The condition runs in another goroutine, so it must not fail the test itself
+		require.Eventually(t, func() bool {
+			response, err := client.ListMetrics(ctx, nil)
+			if err != nil || response.StatusCode() != http.StatusOK || response.JSON200 == nil {
+				return false
+			}
+			list = response.JSON200
+			return len(list.Metrics) == 2 && len(list.Metrics[1].History) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, 999999, list.SampleInterval)
+		assert.Equal(t, "Alloc", list.Metrics[0].ID)
+		assert.Equal(t, 1.5, list.Metrics[0].Value)
+		assert.Equal(t, "PollCount", list.Metrics[1].ID)
+		assert.Equal(t, "counter", list.Metrics[1].Type)
+		assert.Equal(t, 3.0, list.Metrics[1].History[0].V)
+	})
+
+	t.Run("test metrics are filtered", func(t *testing.T) {
+		mType, q := "gauge", "poll"
+		response, err := client.ListMetrics(ctx, &api.ListMetricsParams{Type: &mType})
+		require.NoError(t, err)
+		require.NotNil(t, response.JSON200)
+		require.Len(t, response.JSON200.Metrics, 1)
+		assert.Equal(t, "Alloc", response.JSON200.Metrics[0].ID)
+
+		response, err = client.ListMetrics(ctx, &api.ListMetricsParams{Q: &q})
+		require.NoError(t, err)
+		require.NotNil(t, response.JSON200)
+		require.Len(t, response.JSON200.Metrics, 1)
+		assert.Equal(t, "PollCount", response.JSON200.Metrics[0].ID)
+	})
+}
+
+func TestStream(t *testing.T) {
+	keyring, err := signer.NewKeyring("", map[string]string{"": "secret"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		keyring *signer.Keyring
+	}{
+		{"test plain", nil},
+		{"test with signed responses", keyring},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig := config.Config{
+				StoreInterval: 999999,
+				SignPolicy:    "off",
+			}
+			nullSaver := &saver.MetricsStorageSaver{}
+			mStorage := storage.New()
+			server := httptest.NewServer(metricsRouter(context.Background(), testConfig, mStorage, nullSaver, tt.keyring, nil, nil, nil, nil))
+			defer server.Close()
+
+			result, err := server.Client().Get(server.URL + "/stream?type=counter&name=^Poll")
+			require.NoError(t, err)
+			defer result.Body.Close()
+			require.Equal(t, http.StatusOK, result.StatusCode)
+			assert.Equal(t, "text/event-stream", result.Header.Get("Content-Type"))
+
+			updates := []struct {
+				path string
+				body string
+			}{
+				{"/update/gauge/PollCount/1", ""},
+				{"/update/counter/Alloc/1", ""},
+				{"/update/counter/PollCount/2", ""},
+				{"/update", `{"id":"PollCount","type":"counter","delta":3}`},
+				{"/updates", `[{"id":"PollInterval","type":"counter","delta":1},{"id":"PollCount","type":"counter","delta":4}]`},
+			}
+			for _, u := range updates {
+				resp, err := server.Client().Post(server.URL+u.path, "application/json", strings.NewReader(u.body))
+				require.NoError(t, err)
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				require.Equal(t, http.StatusOK, resp.StatusCode, u.path)
+			}
+
+			events := make(chan string)
+			go func() {
+				defer close(events)
+				reader := bufio.NewReader(result.Body)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if data, ok := strings.CutPrefix(line, "data: "); ok {
+						events <- strings.TrimSpace(data)
+					}
+				}
+			}()
+
+			var got []string
+			for len(got) < 4 {
+				select {
+				case event := <-events:
+					var update map[string]any
+					require.NoError(t, json.Unmarshal([]byte(event), &update))
+					got = append(got, fmt.Sprintf("%s %v %v", update["id"], update["value"], update["delta"]))
+				case <-time.After(time.Second):
+					require.FailNow(t, "no stream events", "got %v", got)
+				}
+			}
+
+			assert.Equal(t, []string{
+				"PollCount 2 2",
+				"PollCount 5 3",
+				"PollInterval 1 1",
+				"PollCount 9 4",
+			}, got)
+		})
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(rulesPath, []byte(`{"rules": [
+		{"name": "HighHeap", "expr": "HeapAlloc > 100"},
+		{"name": "LowHeap", "expr": "HeapAlloc < 1"}
+	]}`), 0600))
+
+	testConfig := config.Config{
+		StoreInterval:     999999,
+		AlertRulesFile:    rulesPath,
+		AlertEvalInterval: 1,
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	require.NoError(t, mStorage.SetGauge(context.Background(), "HeapAlloc", 200))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := metricsRouter(ctx, testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	getAlerts := func(query string) (int, []map[string]any) {
+		req := httptest.NewRequest(http.MethodGet, "/alerts"+query, nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		result := recorder.Result()
+		defer result.Body.Close()
+
+		var response struct {
+			Alerts []map[string]any `json:"alerts"`
+		}
+		json.NewDecoder(result.Body).Decode(&response)
+		return result.StatusCode, response.Alerts
+	}
+
+	require.Eventually(t, func() bool {
+		_, alerts := getAlerts("?state=firing")
+		return len(alerts) == 1
+	}, 3*time.Second, 50*time.Millisecond)
+
+	status, alerts := getAlerts("")
+	assert.Equal(t, http.StatusOK, status)
+	require.Len(t, alerts, 2)
+	assert.Equal(t, "HighHeap", alerts[0]["rule"])
+	assert.Equal(t, "firing", alerts[0]["state"])
+	assert.Equal(t, 200.0, alerts[0]["value"])
+	assert.Equal(t, "inactive", alerts[1]["state"])
+
+	status, _ = getAlerts("?state=unknown")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestQuery(t *testing.T) {
+	testConfig := config.Config{StoreInterval: 999999}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	require.NoError(t, mStorage.SetGauge(context.Background(), "HeapInuse", 50))
+	require.NoError(t, mStorage.SetGauge(context.Background(), "HeapSys", 200))
+	require.NoError(t, mStorage.SetCounter(context.Background(), "PollCount", 10))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := metricsRouter(ctx, testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		want       string
+		wantCode   string
+	}{
+		{name: "test scalar", body: `{"query": "1 + 2 * 3"}`, wantStatus: http.StatusOK, want: `{"resultType":"scalar","result":7}`},
+		{
+			name:       "test vector",
+			body:       `{"query": "HeapInuse / HeapSys * 100"}`,
+			wantStatus: http.StatusOK,
+			want:       `{"resultType":"vector","result":[{"labels":{},"value":25}]}`,
+		},
+		{
+			name:       "test aggregation by type",
+			body:       `{"query": "sum by (type) ({name=~\"^(Heap|Poll)\"})"}`,
+			wantStatus: http.StatusOK,
+			want:       `{"resultType":"vector","result":[{"labels":{"type":"counter"},"value":10},{"labels":{"type":"gauge"},"value":250}]}`,
+		},
+		{
+			name:       "test not finite",
+			body:       `{"query": "HeapSys / 0"}`,
+			wantStatus: http.StatusOK,
+			want:       `{"resultType":"vector","result":[{"labels":{"name":"HeapSys","type":"gauge"},"value":"+Inf"}]}`,
+		},
+		{name: "test empty query", body: `{"query": ""}`, wantStatus: http.StatusBadRequest, wantCode: "schema_violation"},
+		{name: "test syntax error", body: `{"query": "sum(HeapSys"}`, wantStatus: http.StatusBadRequest, wantCode: "invalid_query"},
+		{
+			name:       "test too long query",
+			body:       `{"query": "` + strings.Repeat("-", 1<<20) + `1"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_query",
+		},
+		{
+			name:       "test evaluation error",
+			body:       `{"query": "{type=\"gauge\"} / PollCount"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   "invalid_query",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			result := recorder.Result()
+			defer result.Body.Close()
+
+			body, err := io.ReadAll(result.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, result.StatusCode)
+			if tt.wantCode != "" {
+				var envelope struct {
+					Error struct {
+						Code string `json:"code"`
+					} `json:"error"`
+				}
+				require.NoError(t, json.Unmarshal(body, &envelope))
+				assert.Equal(t, tt.wantCode, envelope.Error.Code)
+				return
+			}
+			assert.JSONEq(t, tt.want, string(body))
+		})
+	}
+}
+
+func TestMetricsPage(t *testing.T) {
+	authenticator, err := auth.New([]auth.Token{
+		{Name: "viewer", Token: "viewer-token", Scopes: []auth.Scope{auth.ScopeRead}},
+		{Name: "heap", Token: "heap-token", Scopes: []auth.Scope{auth.ScopeRead}, Prefixes: []string{"Heap"}},
+	})
+	require.NoError(t, err)
+
+	testConfig := config.Config{StoreInterval: 999999}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	require.NoError(t, mStorage.SetMany(context.Background(), storage.MetricsStorageItems{
+		Gauges:   map[string]float64{"Alloc": 1, "HeapAlloc": 2, "HeapSys": 3, "Sys": 4},
+		Counters: map[string]int64{"HeapAlloc": 5, "PollCount": 6},
+	}))
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, authenticator, nil, nil)
+
+	type page struct {
+		Metrics []struct {
+			ID        string     `json:"id"`
+			MType     string     `json:"type"`
+			Delta     *int64     `json:"delta"`
+			Value     *float64   `json:"value"`
+			UpdatedAt *time.Time `json:"updatedAt"`
+		} `json:"metrics"`
+		Total      *int   `json:"total"`
+		NextCursor string `json:"nextCursor"`
+	}
+	getPage := func(query, token string) (int, page) {
+		req := httptest.NewRequest(http.MethodGet, "/metrics/list"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		result := recorder.Result()
+		defer result.Body.Close()
+
+		var response page
+		json.NewDecoder(result.Body).Decode(&response)
+		return result.StatusCode, response
+	}
+	names := func(p page) []string {
+		var rv []string
+		for _, m := range p.Metrics {
+			rv = append(rv, m.MType+":"+m.ID)
+		}
+		return rv
+	}
+
+	status, first := getPage("?limit=4", "viewer-token")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"gauge:Alloc", "counter:HeapAlloc", "gauge:HeapAlloc", "gauge:HeapSys"}, names(first))
+	require.NotNil(t, first.Total)
+	assert.Equal(t, 6, *first.Total)
+	require.NotNil(t, first.Metrics[1].Delta)
+	assert.Equal(t, int64(5), *first.Metrics[1].Delta)
+	require.NotNil(t, first.Metrics[2].Value)
+	assert.Equal(t, 2.0, *first.Metrics[2].Value)
+	assert.NotNil(t, first.Metrics[0].UpdatedAt)
+	require.NotEmpty(t, first.NextCursor)
+
+	_, second := getPage("?limit=4&cursor="+first.NextCursor, "viewer-token")
+	assert.Equal(t, []string{"counter:PollCount", "gauge:Sys"}, names(second))
+	assert.Empty(t, second.NextCursor)
+
+	_, filtered := getPage("?type=gauge&prefix=Heap", "viewer-token")
+	assert.Equal(t, []string{"gauge:HeapAlloc", "gauge:HeapSys"}, names(filtered))
+	_, filtered = getPage("?regex=^(Alloc|Sys)$", "viewer-token")
+	assert.Equal(t, []string{"gauge:Alloc", "gauge:Sys"}, names(filtered))
+
+	// Pages of limited tokens skip metrics they can't read and don't tell the total
+	status, limited := getPage("?limit=2", "heap-token")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"counter:HeapAlloc", "gauge:HeapAlloc"}, names(limited))
+	assert.Nil(t, limited.Total)
+	_, limited = getPage("?limit=2&cursor="+limited.NextCursor, "heap-token")
+	assert.Equal(t, []string{"gauge:HeapSys"}, names(limited))
+	assert.Empty(t, limited.NextCursor)
+
+	for _, query := range []string{"?type=histogram", "?regex=(", "?limit=0", "?limit=1001", "?cursor=!"} {
+		status, _ := getPage(query, "viewer-token")
+		assert.Equal(t, http.StatusBadRequest, status, query)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	testConfig := config.Config{
+		StoreInterval: 999999,
+		MetadataFile:  filepath.Join(t.TempDir(), "metrics.meta"),
+	}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	do := func(method, path, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		result := recorder.Result()
+		defer result.Body.Close()
+
+		data, err := io.ReadAll(result.Body)
+		require.NoError(t, err)
+		return result.StatusCode, string(data)
+	}
+
+	status, _ := do(http.MethodPost, "/updates", `[
+		{"id":"HeapAlloc","type":"gauge","value":2048,"unit":"bytes","help":"Bytes of allocated heap objects"},
+		{"id":"PollCount","type":"counter","delta":1}
+	]`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = do(http.MethodPost, "/update/counter/HeapAlloc/1", "")
+	require.Equal(t, http.StatusOK, status)
+
+	status, body := do(http.MethodGet, "/metadata?conflicts=true", "")
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"metadata":[{
+		"name":"HeapAlloc","type":"gauge","unit":"bytes","help":"Bytes of allocated heap objects",
+		"conflicts":["counter"],"declared":true
+	}]}`, body)
+
+	_, body = do(http.MethodGet, "/metadata", "")
+	assert.Contains(t, body, `{"name":"PollCount","type":"counter"}`)
+
+	status, body = do(http.MethodGet, "/metrics", "")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `# HELP HeapAlloc Bytes of allocated heap objects (bytes)
+# TYPE HeapAlloc gauge
+HeapAlloc 2048
+# TYPE PollCount counter
+PollCount 1
+`, body)
+
+	_, body = do(http.MethodGet, "/api/metrics?q=heap", "")
+	var list struct {
+		Metrics []struct {
+			ID           string `json:"id"`
+			MType        string `json:"type"`
+			Unit         string `json:"unit"`
+			ExpectedType string `json:"expectedType"`
+		} `json:"metrics"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &list))
+	require.Len(t, list.Metrics, 2)
+	assert.Equal(t, "counter", list.Metrics[0].MType)
+	assert.Equal(t, "gauge", list.Metrics[0].ExpectedType)
+	assert.Equal(t, "bytes", list.Metrics[1].Unit)
+	assert.Empty(t, list.Metrics[1].ExpectedType)
+
+	// Metadata survives restarts, once it's saved in the background
+	assert.Eventually(t, func() bool {
+		restarted := metricsRouter(context.Background(), testConfig, storage.New(), nullSaver, nil, nil, nil, nil, nil)
+		req := httptest.NewRequest(http.MethodGet, "/metadata?conflicts=true", nil)
+		recorder := httptest.NewRecorder()
+		restarted.ServeHTTP(recorder, req)
+		return strings.Contains(recorder.Body.String(), `"HeapAlloc"`)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	status, body = do(http.MethodPost, "/update", `{"id":"Long","type":"gauge","value":1,"unit":"`+strings.Repeat("b", 33)+`"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "schema_violation")
+
+	// Lengths are counted in characters, like the schema does
+	status, _ = do(http.MethodPost, "/update", `{"id":"Wide","type":"gauge","value":1,"unit":"`+strings.Repeat("µ", 32)+`"}`)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestExport(t *testing.T) {
+	testConfig := config.Config{StoreInterval: 999999, HistoryInterval: 3600, HistorySize: 10}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	require.NoError(t, mStorage.SetGauge(context.Background(), "HeapAlloc", 2048.5))
+	require.NoError(t, mStorage.SetCounter(context.Background(), "PollCount", 3))
+	require.NoError(t, mStorage.SetGauge(context.Background(), "Alloc", math.Inf(1)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := metricsRouter(ctx, testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	get := func(path string, gzipped bool) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if gzipped {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		result := recorder.Result()
+		defer result.Body.Close()
+
+		var body io.Reader = result.Body
+		if result.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(result.Body)
+			require.NoError(t, err)
+			body = zr
+		}
+		data, err := io.ReadAll(body)
+		require.NoError(t, err)
+		return result, string(data)
+	}
+
+	t.Run("test csv", func(t *testing.T) {
+		result, body := get("/export?format=csv", false)
+		require.Equal(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, "text/csv; charset=utf-8", result.Header.Get("Content-Type"))
+
+		rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, rows, 4)
+		assert.Equal(t, []string{"id", "type", "unit", "time", "value"}, rows[0])
+		assert.Equal(t, []string{"Alloc", "gauge", "+Inf"}, []string{rows[1][0], rows[1][1], rows[1][4]})
+		assert.Equal(t, []string{"HeapAlloc", "gauge", "2048.5"}, []string{rows[2][0], rows[2][1], rows[2][4]})
+		assert.Equal(t, []string{"PollCount", "counter", "3"}, []string{rows[3][0], rows[3][1], rows[3][4]})
+	})
+
+	t.Run("test ndjson gzipped", func(t *testing.T) {
+		result, body := get("/export?format=ndjson", true)
+		require.Equal(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, "gzip", result.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-ndjson", result.Header.Get("Content-Type"))
+
+		lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+		require.Len(t, lines, 3)
+		assert.Contains(t, lines[0], `"id":"Alloc","type":"gauge"`)
+		assert.Contains(t, lines[0], `"value":"+Inf"`)
+		assert.Contains(t, lines[2], `"id":"PollCount","type":"counter"`)
+		assert.Contains(t, lines[2], `"value":3`)
+	})
+
+	t.Run("test history", func(t *testing.T) {
+		// get fails the test, so it's not called from the Eventually condition running in another goroutine
+		require.Eventually(t, func() bool {
+			req := httptest.NewRequest(http.MethodGet, "/export?history=1h", nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			return strings.Count(recorder.Body.String(), `"id":"HeapAlloc"`) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		_, body := get("/export?history=1h", false)
+		assert.Equal(t, 2, strings.Count(body, `"id":"PollCount"`))
+	})
+
+	t.Run("test bad params", func(t *testing.T) {
+		result, _ := get("/export?format=xml", false)
+		assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+		result, _ = get("/export?history=-1m", false)
+		assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+	})
+}
+
+func TestImport(t *testing.T) {
+	source := storage.New()
+	require.NoError(t, source.SetGauge(context.Background(), "HeapAlloc", 2048))
+	require.NoError(t, source.SetCounter(context.Background(), "PollCount", 10))
+	dumpPath := filepath.Join(t.TempDir(), "dump.json")
+	dumpSaver, err := saver.NewMetricsStorageSaver(source, dumpPath)
+	require.NoError(t, err)
+	require.NoError(t, dumpSaver.Save(context.Background()))
+	require.NoError(t, dumpSaver.Close())
+	dump, err := os.ReadFile(dumpPath)
+	require.NoError(t, err)
+
+	// Imports are not limited by the max body size
+	testConfig := config.Config{StoreInterval: 999999, MaxBodySize: 16}
+	nullSaver := &saver.MetricsStorageSaver{}
+	mStorage := storage.New()
+	require.NoError(t, mStorage.SetCounter(context.Background(), "PollCount", 5))
+	handler := metricsRouter(context.Background(), testConfig, mStorage, nullSaver, nil, nil, nil, nil, nil)
+
+	post := func(path string, body []byte) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		result := recorder.Result()
+		defer result.Body.Close()
+
+		data, err := io.ReadAll(result.Body)
+		require.NoError(t, err)
+		return result.StatusCode, string(data)
+	}
+	counter := func() int64 {
+		value, err := mStorage.GetCounter(context.Background(), "PollCount")
+		require.NoError(t, err)
+		require.NotNil(t, value)
+		return *value
+	}
+
+	status, body := post("/import", dump)
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"imported":2}`, body)
+	assert.EqualValues(t, 15, counter())
+	gauge, err := mStorage.GetGauge(context.Background(), "HeapAlloc")
+	require.NoError(t, err)
+	require.NotNil(t, gauge)
+	assert.Equal(t, 2048.0, *gauge)
+
+	status, _ = post("/import?counters=replace", dump)
+	require.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 10, counter())
+
+	t.Run("test bad line", func(t *testing.T) {
+		status, body := post("/import", []byte(`{"id":"PollCount","type":"counter","delta":1}`+"\n\n"+`{"id":"Bad","type":"gauge"}`+"\n"))
+		require.Equal(t, http.StatusBadRequest, status)
+		var envelope struct {
+			Error struct {
+				Code   string `json:"code"`
+				Errors []struct {
+					Code  string `json:"code"`
+					Index int    `json:"index"`
+				} `json:"errors"`
+			} `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &envelope))
+		assert.Equal(t, "invalid_batch", envelope.Error.Code)
+		require.Len(t, envelope.Error.Errors, 1)
+		assert.Equal(t, "missing_value", envelope.Error.Errors[0].Code)
+		assert.Equal(t, 2, envelope.Error.Errors[0].Index)
+	})
+
+	t.Run("test bad mode", func(t *testing.T) {
+		status, _ := post("/import?counters=sum", dump)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("test too large", func(t *testing.T) {
+		testConfig.MaxImportSize = len(dump) - 1
+		handler = metricsRouter(context.Background(), testConfig, storage.New(), nullSaver, nil, nil, nil, nil, nil)
+		status, body := post("/import", dump)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+		assert.Contains(t, body, "body_too_large")
+	})
+	// Bodies of signed and encrypted imports are read whole before the handler, so they are limited before that
+	t.Run("test too large signed", func(t *testing.T) {
+		keyring, err := signer.NewKeyring("", map[string]string{"": "secret"})
+		require.NoError(t, err)
+		handler := metricsRouter(context.Background(), testConfig, storage.New(), nullSaver, keyring, nil, nil, nil, nil)
+
+		req := httptest.NewRequest(http.MethodPost, "/import", bytes.NewReader(dump))
+		req.Header.Set(signer.HeaderSignature, "deadbeef")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	})
+
+	t.Run("test too large encrypted", func(t *testing.T) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		encryptor, err := envelope.NewEncryptor(key.PublicKey())
+		require.NoError(t, err)
+		decryptor, err := envelope.NewDecryptor(key)
+		require.NoError(t, err)
+		sealed, err := encryptor.Encrypt(dump)
+		require.NoError(t, err)
+		handler := metricsRouter(context.Background(), testConfig, storage.New(), nullSaver, nil, decryptor, nil, nil, nil)
+
+		req := httptest.NewRequest(http.MethodPost, "/import", bytes.NewReader(sealed))
+		req.Header.Set(envelope.Header, encryptor.Scheme())
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	})
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name            string
+		shutdownTimeout int
+		inFlight        bool
+	}{
+		{name: "test in-flight request is drained", shutdownTimeout: 5, inFlight: true},
+		{name: "test storage is saved without shutdown timeout", shutdownTimeout: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			address := listener.Addr().String()
+			require.NoError(t, listener.Close())
+
+			mStorage := storage.New()
+			dumpPath := filepath.Join(t.TempDir(), "metrics.json")
+			fileSaver, err := saver.NewMetricsStorageSaver(mStorage, dumpPath)
+			require.NoError(t, err)
+			defer fileSaver.Close()
+
+			// History recording is a background worker writing to the storage until shutdown
+			testConfig := config.Config{
+				Address:         address,
+				StoreInterval:   999999,
+				ShutdownTimeout: tt.shutdownTimeout,
+				HistoryInterval: 1,
+				HistorySize:     10,
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stopped := make(chan struct{})
+			go func() {
+				Run(ctx, testConfig, mStorage, fileSaver, nil, nil, nil, nil)
+				close(stopped)
+			}()
+
+			var conn net.Conn
+			require.Eventually(t, func() bool {
+				var dialErr error
+				conn, dialErr = net.Dial("tcp", address)
+				return dialErr == nil
+			}, 5*time.Second, 10*time.Millisecond)
+			defer conn.Close()
+
+			body := `[{"id":"a","type":"counter","delta":3}]`
+			head := fmt.Sprintf("POST /updates HTTP/1.1\r\nHost: %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", address, len(body))
+			if tt.inFlight {
+				_, err = io.WriteString(conn, head+body[:10])
+				require.NoError(t, err)
+				time.Sleep(100 * time.Millisecond)
+				cancel()
+				time.Sleep(100 * time.Millisecond)
+				_, err = io.WriteString(conn, body[10:])
+				require.NoError(t, err)
+			} else {
+				_, err = io.WriteString(conn, head+body)
+				require.NoError(t, err)
+			}
+
+			result, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			io.Copy(io.Discard, result.Body)
+			result.Body.Close()
+			assert.Equal(t, http.StatusOK, result.StatusCode)
+
+			cancel()
+			select {
+			case <-stopped:
+			case <-time.After(10 * time.Second):
+				require.Fail(t, "server is not stopped")
+			}
+
+			dump, err := os.ReadFile(dumpPath)
+			require.NoError(t, err)
+			assert.Contains(t, string(dump), `"id":"a"`)
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type Registry struct {
+	m        sync.Mutex
+	counters map[string]*atomic.Int64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]*atomic.Int64),
+	}
+}
+
+// Counter returns the counter registered under name, creating it on first use.
+// Calling it on a nil registry returns a detached counter, so callers don't need nil checks.
+func (r *Registry) Counter(name string) *atomic.Int64 {
+	if r == nil {
+		return new(atomic.Int64)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	counter, ok := r.counters[name]
+	if !ok {
+		counter = new(atomic.Int64)
+		r.counters[name] = counter
+	}
+
+	return counter
+}
+
+func (r *Registry) Snapshot() map[string]int64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	rv := make(map[string]int64, len(r.counters))
+	for name, counter := range r.counters {
+		rv[name] = counter.Load()
+	}
+
+	return rv
+}
@@ -0,0 +1,133 @@
+// Package stream fans out applied metrics updates to live subscribers.
+package stream
+
+import (
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/server/stats"
+)
+
+const (
+	StatDroppedUpdates = "dropped_stream_updates"
+)
+
+// Update is a metrics value after an update was applied.
+type Update struct {
+	ID    string `json:"id"`
+	MType string `json:"type"`
+	// Value is the current value, counters included
+	Value float64 `json:"value"`
+	// Delta is the increment applied to a counter
+	Delta *int64    `json:"delta,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// Filter selects updates a subscriber receives. Zero filter matches everything.
+type Filter struct {
+	Name  *regexp.Regexp
+	MType string
+	// Allow additionally checks names, e.g. against the subscriber's permissions
+	Allow func(name string) bool
+}
+
+func (f Filter) Match(u Update) bool {
+	if f.MType != "" && f.MType != u.MType {
+		return false
+	}
+	if f.Name != nil && !f.Name.MatchString(u.ID) {
+		return false
+	}
+	if f.Allow != nil && !f.Allow(u.ID) {
+		return false
+	}
+
+	return true
+}
+
+type Subscription struct {
+	filter  Filter
+	updates chan []Update
+	dropped atomic.Int64
+}
+
+// Updates delivers matching updates, batched as they were published.
+func (s *Subscription) Updates() <-chan []Update {
+	return s.updates
+}
+
+// Dropped returns the number of updates dropped since the last call, because the subscriber didn't keep up.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+// Hub delivers published updates to subscribers. Publishing never blocks:
+// subscribers having buffer batches not yet received miss further updates.
+type Hub struct {
+	buffer int
+	stats  *stats.Registry
+
+	m    sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func NewHub(buffer int, registry *stats.Registry) *Hub {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	return &Hub{
+		buffer: buffer,
+		stats:  registry,
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+func (h *Hub) Subscribe(filter Filter) *Subscription {
+	s := &Subscription{
+		filter:  filter,
+		updates: make(chan []Update, h.buffer),
+	}
+
+	h.m.Lock()
+	h.subs[s] = struct{}{}
+	h.m.Unlock()
+
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.m.Lock()
+	delete(h.subs, s)
+	h.m.Unlock()
+}
+
+func (h *Hub) Publish(updates []Update) {
+	if len(updates) == 0 {
+		return
+	}
+
+	h.m.RLock()
+	defer h.m.RUnlock()
+
+	for s := range h.subs {
+		var matched []Update
+		for _, u := range updates {
+			if s.filter.Match(u) {
+				matched = append(matched, u)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		select {
+		case s.updates <- matched:
+		default:
+			s.dropped.Add(int64(len(matched)))
+			h.stats.Counter(StatDroppedUpdates).Add(int64(len(matched)))
+		}
+	}
+}
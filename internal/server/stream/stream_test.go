@@ -0,0 +1,57 @@
+package stream
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/SamMeown/metrix/internal/server/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHub(t *testing.T) {
+	registry := stats.NewRegistry()
+	hub := NewHub(1, registry)
+
+	all := hub.Subscribe(Filter{})
+	heap := hub.Subscribe(Filter{
+		Name:  regexp.MustCompile("^Heap"),
+		MType: "gauge",
+		Allow: func(name string) bool { return name != "HeapSys" },
+	})
+
+	delta := int64(1)
+	first := []Update{
+		{ID: "HeapAlloc", MType: "gauge", Value: 1},
+		{ID: "HeapSys", MType: "gauge", Value: 2},
+		{ID: "HeapObjects", MType: "counter", Value: 5, Delta: &delta},
+		{ID: "Alloc", MType: "gauge", Value: 3},
+	}
+	hub.Publish(first)
+
+	require.Len(t, all.Updates(), 1)
+	assert.Equal(t, first, <-all.Updates())
+	require.Len(t, heap.Updates(), 1)
+	assert.Equal(t, []Update{first[0]}, <-heap.Updates())
+
+	t.Run("test nothing is sent to subscribers without matches", func(t *testing.T) {
+		hub.Publish([]Update{{ID: "Alloc", MType: "gauge", Value: 4}})
+		assert.Len(t, heap.Updates(), 0)
+		assert.Len(t, all.Updates(), 1)
+	})
+
+	t.Run("test slow subscribers miss updates", func(t *testing.T) {
+		hub.Publish([]Update{{ID: "Alloc", MType: "gauge", Value: 5}, {ID: "Sys", MType: "gauge", Value: 6}})
+		assert.Equal(t, int64(2), all.Dropped())
+		assert.Equal(t, int64(0), all.Dropped(), "dropped count is reset")
+		assert.Equal(t, int64(2), registry.Snapshot()[StatDroppedUpdates])
+		assert.Equal(t, []Update{{ID: "Alloc", MType: "gauge", Value: 4}}, <-all.Updates())
+	})
+
+	t.Run("test unsubscribed", func(t *testing.T) {
+		hub.Unsubscribe(all)
+		hub.Publish(first)
+		assert.Len(t, all.Updates(), 0)
+		assert.Len(t, heap.Updates(), 1)
+	})
+}
@@ -35,6 +35,21 @@ func (m *MockMetricsStorageGetter) EXPECT() *MockMetricsStorageGetterMockRecorde
 	return m.recorder
 }
 
+// Count mocks base method.
+func (m *MockMetricsStorageGetter) Count(ctx context.Context, query storage.MetricsListQuery) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Count", ctx, query)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Count indicates an expected call of Count.
+func (mr *MockMetricsStorageGetterMockRecorder) Count(ctx, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Count", reflect.TypeOf((*MockMetricsStorageGetter)(nil).Count), ctx, query)
+}
+
 // GetAll mocks base method.
 func (m *MockMetricsStorageGetter) GetAll(ctx context.Context) (storage.MetricsStorageItems, error) {
 	m.ctrl.T.Helper()
@@ -95,6 +110,21 @@ func (mr *MockMetricsStorageGetterMockRecorder) GetMany(ctx, names interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMany", reflect.TypeOf((*MockMetricsStorageGetter)(nil).GetMany), ctx, names)
 }
 
+// List mocks base method.
+func (m *MockMetricsStorageGetter) List(ctx context.Context, query storage.MetricsListQuery) ([]storage.MetricsEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", ctx, query)
+	ret0, _ := ret[0].([]storage.MetricsEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockMetricsStorageGetterMockRecorder) List(ctx, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockMetricsStorageGetter)(nil).List), ctx, query)
+}
+
 // MockMetricsStorageSetter is a mock of MetricsStorageSetter interface.
 type MockMetricsStorageSetter struct {
 	ctrl     *gomock.Controller
@@ -183,6 +213,21 @@ func (m *MockMetricsStorage) EXPECT() *MockMetricsStorageMockRecorder {
 	return m.recorder
 }
 
+// Count mocks base method.
+func (m *MockMetricsStorage) Count(ctx context.Context, query storage.MetricsListQuery) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Count", ctx, query)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Count indicates an expected call of Count.
+func (mr *MockMetricsStorageMockRecorder) Count(ctx, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Count", reflect.TypeOf((*MockMetricsStorage)(nil).Count), ctx, query)
+}
+
 // GetAll mocks base method.
 func (m *MockMetricsStorage) GetAll(ctx context.Context) (storage.MetricsStorageItems, error) {
 	m.ctrl.T.Helper()
@@ -243,6 +288,21 @@ func (mr *MockMetricsStorageMockRecorder) GetMany(ctx, names interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMany", reflect.TypeOf((*MockMetricsStorage)(nil).GetMany), ctx, names)
 }
 
+// List mocks base method.
+func (m *MockMetricsStorage) List(ctx context.Context, query storage.MetricsListQuery) ([]storage.MetricsEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", ctx, query)
+	ret0, _ := ret[0].([]storage.MetricsEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockMetricsStorageMockRecorder) List(ctx, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockMetricsStorage)(nil).List), ctx, query)
+}
+
 // Ping mocks base method.
 func (m *MockMetricsStorage) Ping(ctx context.Context) error {
 	m.ctrl.T.Helper()
@@ -0,0 +1,29 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/SamMeown/metrix/internal/storage"
+	"github.com/SamMeown/metrix/internal/storage/storagetest"
+	"github.com/golang/mock/gomock"
+)
+
+// The mock delegates to the memory storage, which checks that tests can stub it with the storage semantics
+func TestMockStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.MetricsStorage {
+		mem := storage.NewMemStorage()
+		m := NewMockMetricsStorage(gomock.NewController(t))
+		m.EXPECT().GetGauge(gomock.Any(), gomock.Any()).DoAndReturn(mem.GetGauge).AnyTimes()
+		m.EXPECT().GetCounter(gomock.Any(), gomock.Any()).DoAndReturn(mem.GetCounter).AnyTimes()
+		m.EXPECT().GetMany(gomock.Any(), gomock.Any()).DoAndReturn(mem.GetMany).AnyTimes()
+		m.EXPECT().GetAll(gomock.Any()).DoAndReturn(mem.GetAll).AnyTimes()
+		m.EXPECT().List(gomock.Any(), gomock.Any()).DoAndReturn(mem.List).AnyTimes()
+		m.EXPECT().Count(gomock.Any(), gomock.Any()).DoAndReturn(mem.Count).AnyTimes()
+		m.EXPECT().SetGauge(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(mem.SetGauge).AnyTimes()
+		m.EXPECT().SetCounter(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(mem.SetCounter).AnyTimes()
+		m.EXPECT().SetMany(gomock.Any(), gomock.Any()).DoAndReturn(mem.SetMany).AnyTimes()
+		m.EXPECT().Ping(gomock.Any()).DoAndReturn(mem.Ping).AnyTimes()
+
+		return m
+	})
+}
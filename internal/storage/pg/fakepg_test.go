@@ -0,0 +1,331 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// fakepg is an in-process stand-in for Postgres, so that the storage can be tested without a database server.
+// It understands the statements Storage sends and nothing else. Statements and transactions hold a database wide
+// lock, which makes transactions serializable, and rolled back transactions restore the tables they started with.
+func init() {
+	sql.Register("fakepg", &fakeDriver{databases: make(map[string]*fakeDatabase)})
+}
+
+// openFakeDB opens an empty fake database, private to the test.
+func openFakeDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("fakepg", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+type fakeRow struct {
+	value     any
+	updatedAt time.Time
+}
+
+type fakeTables map[string]map[string]fakeRow
+
+func (t fakeTables) clone() fakeTables {
+	rv := make(fakeTables, len(t))
+	for name, rows := range t {
+		rv[name] = maps.Clone(rows)
+	}
+	return rv
+}
+
+type fakeDatabase struct {
+	m      sync.Mutex
+	tables fakeTables
+}
+
+type fakeDriver struct {
+	m         sync.Mutex
+	databases map[string]*fakeDatabase
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	db, ok := d.databases[name]
+	if !ok {
+		db = &fakeDatabase{tables: fakeTables{}}
+		d.databases[name] = db
+	}
+
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db       *fakeDatabase
+	snapshot fakeTables
+	inTx     bool
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakepg: prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error {
+	if c.inTx {
+		return c.Rollback()
+	}
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.db.m.Lock()
+	c.snapshot = c.db.tables.clone()
+	c.inTx = true
+
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.inTx = false
+	c.snapshot = nil
+	c.db.m.Unlock()
+
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.tables = c.snapshot
+	return c.Commit()
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	return nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	_, err := c.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+var (
+	fakeInsertPattern = regexp.MustCompile(`^INSERT INTO (gauges|counters) .* ON CONFLICT\(name\) DO UPDATE SET value = (counters\.value \+ )?\$2, updated_at = \$3;$`)
+	fakeSelectPattern = regexp.MustCompile(`^SELECT value FROM (gauges|counters) WHERE name = \$1;$`)
+	fakeListPattern   = regexp.MustCompile(`^SELECT (.+) FROM \( SELECT name, 'gauge' AS type, .* \) AS metrics ?(?:WHERE (.+?))? ?(ORDER BY name, type)? ?(?:LIMIT (\d+))? ?;$`)
+	fakeAllPattern    = regexp.MustCompile(`^SELECT name, value as gauge, NULL as counter FROM gauges UNION ALL SELECT name, NULL as gauge, value as counter FROM counters;$`)
+
+	fakeTypePattern     = regexp.MustCompile(`^type = \$(\d+)$`)
+	fakePrefixPattern   = regexp.MustCompile(`^name LIKE \$(\d+)$`)
+	fakePositionPattern = regexp.MustCompile(`^\(name, type\) > \(\$(\d+), \$(\d+)\)$`)
+)
+
+var fakeLikeUnescaper = strings.NewReplacer(`\\`, `\`, `\%`, `%`, `\_`, `_`)
+
+func (c *fakeConn) run(query string, args []driver.NamedValue) (*fakeRows, error) {
+	if !c.inTx {
+		c.db.m.Lock()
+		defer c.db.m.Unlock()
+	}
+
+	query = strings.Join(strings.Fields(query), " ")
+	arg := func(ordinal string) any {
+		n, _ := strconv.Atoi(ordinal)
+		return args[n-1].Value
+	}
+
+	if strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS gauges") {
+		c.db.tables.create("gauges")
+		return &fakeRows{}, nil
+	}
+	if strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS counters") {
+		c.db.tables.create("counters")
+		return &fakeRows{}, nil
+	}
+
+	if m := fakeInsertPattern.FindStringSubmatch(query); m != nil {
+		rows, err := c.db.tables.table(m[1])
+		if err != nil {
+			return nil, err
+		}
+		name, value := arg("1").(string), arg("2")
+		if old, ok := rows[name]; ok && m[2] != "" {
+			value = old.value.(int64) + value.(int64)
+		}
+		rows[name] = fakeRow{value: value, updatedAt: arg("3").(time.Time)}
+		return &fakeRows{}, nil
+	}
+
+	if m := fakeSelectPattern.FindStringSubmatch(query); m != nil {
+		rows, err := c.db.tables.table(m[1])
+		if err != nil {
+			return nil, err
+		}
+		result := &fakeRows{columns: []string{"value"}}
+		if row, ok := rows[arg("1").(string)]; ok {
+			result.values = append(result.values, []driver.Value{row.value})
+		}
+		return result, nil
+	}
+
+	entries, err := c.db.tables.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	if fakeAllPattern.MatchString(query) {
+		result := &fakeRows{columns: []string{"name", "gauge", "counter"}}
+		for _, e := range entries {
+			if e.mType == "gauge" {
+				result.values = append(result.values, []driver.Value{e.name, e.value, nil})
+			} else {
+				result.values = append(result.values, []driver.Value{e.name, nil, e.value})
+			}
+		}
+		return result, nil
+	}
+
+	m := fakeListPattern.FindStringSubmatch(query)
+	if m == nil {
+		return nil, fmt.Errorf("fakepg: unsupported statement %q", query)
+	}
+
+	if m[2] != "" {
+		for _, condition := range strings.Split(m[2], " AND ") {
+			var match func(e fakeEntry) bool
+			if cm := fakeTypePattern.FindStringSubmatch(condition); cm != nil {
+				mType := arg(cm[1])
+				match = func(e fakeEntry) bool { return e.mType == mType }
+			} else if cm := fakePrefixPattern.FindStringSubmatch(condition); cm != nil {
+				prefix := fakeLikeUnescaper.Replace(strings.TrimSuffix(arg(cm[1]).(string), "%"))
+				match = func(e fakeEntry) bool { return strings.HasPrefix(e.name, prefix) }
+			} else if cm := fakePositionPattern.FindStringSubmatch(condition); cm != nil {
+				name, mType := arg(cm[1]).(string), arg(cm[2]).(string)
+				match = func(e fakeEntry) bool { return e.name > name || e.name == name && e.mType > mType }
+			} else {
+				return nil, fmt.Errorf("fakepg: unsupported condition %q", condition)
+			}
+			entries = slices.DeleteFunc(entries, func(e fakeEntry) bool { return !match(e) })
+		}
+	}
+	if m[4] != "" {
+		limit, _ := strconv.Atoi(m[4])
+		if len(entries) > limit {
+			entries = entries[:limit]
+		}
+	}
+
+	switch m[1] {
+	case "COUNT(*)":
+		return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{int64(len(entries))}}}, nil
+	case "name":
+		result := &fakeRows{columns: []string{"name"}}
+		for _, e := range entries {
+			result.values = append(result.values, []driver.Value{e.name})
+		}
+		return result, nil
+	case "name, type, gauge, counter, updated_at":
+		result := &fakeRows{columns: []string{"name", "type", "gauge", "counter", "updated_at"}}
+		for _, e := range entries {
+			if e.mType == "gauge" {
+				result.values = append(result.values, []driver.Value{e.name, e.mType, e.value, nil, e.updatedAt})
+			} else {
+				result.values = append(result.values, []driver.Value{e.name, e.mType, nil, e.value, e.updatedAt})
+			}
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("fakepg: unsupported columns %q", m[1])
+	}
+}
+
+func (t fakeTables) create(name string) {
+	if _, ok := t[name]; !ok {
+		t[name] = make(map[string]fakeRow)
+	}
+}
+
+func (t fakeTables) table(name string) (map[string]fakeRow, error) {
+	rows, ok := t[name]
+	if !ok {
+		return nil, fmt.Errorf("fakepg: relation %q does not exist", name)
+	}
+	return rows, nil
+}
+
+type fakeEntry struct {
+	fakeRow
+	name  string
+	mType string
+}
+
+// entries returns rows of both tables ordered by name and type, as the listing union is.
+func (t fakeTables) entries() ([]fakeEntry, error) {
+	var rv []fakeEntry
+	for table, mType := range map[string]string{"gauges": "gauge", "counters": "counter"} {
+		rows, err := t.table(table)
+		if err != nil {
+			return nil, err
+		}
+		for name, row := range rows {
+			rv = append(rv, fakeEntry{fakeRow: row, name: name, mType: mType})
+		}
+	}
+
+	slices.SortFunc(rv, func(a, b fakeEntry) bool {
+		return a.name < b.name || a.name == b.name && a.mType < b.mType
+	})
+	return rv, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
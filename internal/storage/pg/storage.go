@@ -7,7 +7,12 @@ import (
 	"github.com/SamMeown/metrix/internal/storage"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"net"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -185,6 +190,154 @@ func (s Storage) GetAll(ctx context.Context) (storage.MetricsStorageItems, error
 	return rv, nil
 }
 
+// listedMetrics is a union of both tables with common columns, List and Count filter it.
+// The planner pushes the conditions down into the union, so they use primary key indexes of the tables.
+const listedMetrics = `
+	SELECT name, 'gauge' AS type, value AS gauge, NULL::BIGINT AS counter, updated_at FROM gauges
+	UNION ALL
+	SELECT name, 'counter' AS type, NULL::DOUBLE PRECISION AS gauge, value AS counter, updated_at FROM counters
+`
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// listConditions returns the WHERE clause and its args for query. Positions are matched only if withPosition is set.
+// Regex is matched with POSIX regular expressions of Postgres.
+// listConditions builds the WHERE clause of listing queries. Regex is not part of it, since Postgres regular
+// expressions differ from Go ones, names are matched against it after they are read instead.
+func listConditions(query storage.MetricsListQuery, withPosition bool) (string, []any) {
+	var conditions []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if query.MType != "" {
+		conditions = append(conditions, "type = "+arg(query.MType))
+	}
+	if query.Prefix != "" {
+		conditions = append(conditions, "name LIKE "+arg(likeEscaper.Replace(query.Prefix)+"%"))
+	}
+	if withPosition && query.AfterName != "" {
+		conditions = append(conditions, "(name, type) > ("+arg(query.AfterName)+", "+arg(query.AfterType)+")")
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (s Storage) List(ctx context.Context, query storage.MetricsListQuery) ([]storage.MetricsEntry, error) {
+	re, err := nameRegexp(query)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args := listConditions(query, true)
+	limit := ""
+	if query.Limit > 0 && re == nil {
+		limit = "LIMIT " + strconv.Itoa(query.Limit)
+	}
+
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT name, type, gauge, counter, updated_at
+		FROM (`+listedMetrics+`) AS metrics
+		`+where+`
+		ORDER BY name, type
+		`+limit+`;
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rv []storage.MetricsEntry
+	for rows.Next() {
+		var (
+			entry     storage.MetricsEntry
+			gauge     sql.NullFloat64
+			counter   sql.NullInt64
+			updatedAt sql.NullTime
+		)
+		err = rows.Scan(&entry.Name, &entry.MType, &gauge, &counter, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if re != nil && !re.MatchString(entry.Name) {
+			continue
+		}
+
+		entry.Gauge = gauge.Float64
+		entry.Counter = counter.Int64
+		entry.UpdatedAt = updatedAt.Time
+		rv = append(rv, entry)
+		if query.Limit > 0 && len(rv) == query.Limit {
+			break
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+func (s Storage) Count(ctx context.Context, query storage.MetricsListQuery) (int, error) {
+	re, err := nameRegexp(query)
+	if err != nil {
+		return 0, err
+	}
+
+	where, args := listConditions(query, false)
+
+	if re == nil {
+		var count int
+		err := s.conn.QueryRowContext(ctx, `
+			SELECT COUNT(*)
+			FROM (`+listedMetrics+`) AS metrics
+			`+where+`;
+		`, args...).Scan(&count)
+		if err != nil {
+			return 0, err
+		}
+
+		return count, nil
+	}
+
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT name
+		FROM (`+listedMetrics+`) AS metrics
+		`+where+`;
+	`, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return 0, err
+		}
+		if re.MatchString(name) {
+			count++
+		}
+	}
+
+	return count, rows.Err()
+}
+
+func nameRegexp(query storage.MetricsListQuery) (*regexp.Regexp, error) {
+	if query.Regex == "" {
+		return nil, nil
+	}
+	return regexp.Compile(query.Regex)
+}
+
 func (s Storage) setGauge(ctx context.Context, re requestExecutor, name string, value float64) error {
 	_, err := re.ExecContext(
 		ctx,
@@ -232,15 +385,21 @@ func (s Storage) SetMany(ctx context.Context, items storage.MetricsStorageItems)
 	}
 	defer tr.Rollback()
 
-	for name, value := range items.Gauges {
-		err := s.setGauge(ctx, tr, name, value)
+	// Rows are upserted in a stable order so that concurrent batches
+	// touching the same names lock them in the same sequence and don't deadlock
+	gaugeNames := maps.Keys(items.Gauges)
+	slices.Sort(gaugeNames)
+	for _, name := range gaugeNames {
+		err := s.setGauge(ctx, tr, name, items.Gauges[name])
 		if err != nil {
 			return err
 		}
 	}
 
-	for name, value := range items.Counters {
-		err := s.setCounter(ctx, tr, name, value)
+	counterNames := maps.Keys(items.Counters)
+	slices.Sort(counterNames)
+	for _, name := range counterNames {
+		err := s.setCounter(ctx, tr, name, items.Counters[name])
 		if err != nil {
 			return err
 		}
@@ -54,6 +54,24 @@ func (s Storage) GetAll(ctx context.Context) (items storage.MetricsStorageItems,
 	return
 }
 
+func (s Storage) List(ctx context.Context, query storage.MetricsListQuery) (entries []storage.MetricsEntry, err error) {
+	err = s.b.RetryContext(ctx, func() (e error) {
+		entries, e = s.s.List(ctx, query)
+		return
+	})
+
+	return
+}
+
+func (s Storage) Count(ctx context.Context, query storage.MetricsListQuery) (count int, err error) {
+	err = s.b.RetryContext(ctx, func() (e error) {
+		count, e = s.s.Count(ctx, query)
+		return
+	})
+
+	return
+}
+
 func (s Storage) SetGauge(ctx context.Context, name string, value float64) error {
 	return s.b.RetryContext(ctx, func() error {
 		return s.s.SetGauge(ctx, name, value)
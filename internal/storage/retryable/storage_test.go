@@ -0,0 +1,14 @@
+package retryable
+
+import (
+	"testing"
+
+	"github.com/SamMeown/metrix/internal/storage"
+	"github.com/SamMeown/metrix/internal/storage/storagetest"
+)
+
+func TestRetryableStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.MetricsStorage {
+		return NewStorage(storage.NewMemStorage(), func(error) bool { return true })
+	})
+}
@@ -2,7 +2,11 @@ package storage
 
 import (
 	"context"
-	"golang.org/x/exp/maps"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -20,11 +24,35 @@ type MetricsStorageKeys struct {
 	Counters []string
 }
 
+// MetricsListQuery selects metrics to list. All set conditions must match.
+// Listing continues after the metrics with AfterName and AfterType names if AfterName is set.
+type MetricsListQuery struct {
+	MType     string
+	Prefix    string
+	Regex     string
+	AfterName string
+	AfterType string
+	Limit     int
+}
+
+// MetricsEntry is a listed metrics, only the value of its type is set.
+type MetricsEntry struct {
+	Name      string
+	MType     string
+	Gauge     float64
+	Counter   int64
+	UpdatedAt time.Time
+}
+
 type MetricsStorageGetter interface {
 	GetGauge(ctx context.Context, name string) (*float64, error)
 	GetCounter(ctx context.Context, name string) (*int64, error)
 	GetMany(ctx context.Context, names MetricsStorageKeys) (MetricsStorageItems, error)
 	GetAll(ctx context.Context) (MetricsStorageItems, error)
+	// List returns up to query.Limit metrics ordered by name and then type, all of them if Limit is 0
+	List(ctx context.Context, query MetricsListQuery) ([]MetricsEntry, error)
+	// Count returns the number of metrics List would return without a limit and position
+	Count(ctx context.Context, query MetricsListQuery) (int, error)
 }
 
 type MetricsStorageSetter interface {
@@ -47,15 +75,29 @@ func NewMemStorage() *MemStorage {
 	return &MemStorage{
 		gauges:   make(map[string]float64),
 		counters: make(map[string]int64),
+		updated:  make(map[metricsKey]time.Time),
 	}
 }
 
+type metricsKey struct {
+	mType string
+	name  string
+}
+
 type MemStorage struct {
+	m        sync.RWMutex
 	gauges   map[string]float64
 	counters map[string]int64
+	updated  map[metricsKey]time.Time
 }
 
 func (m *MemStorage) GetGauge(ctx context.Context, name string) (*float64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.m.RLock()
+	defer m.m.RUnlock()
 	if val, ok := m.gauges[name]; ok {
 		return &val, nil
 	}
@@ -64,6 +106,12 @@ func (m *MemStorage) GetGauge(ctx context.Context, name string) (*float64, error
 }
 
 func (m *MemStorage) GetCounter(ctx context.Context, name string) (*int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.m.RLock()
+	defer m.m.RUnlock()
 	if val, ok := m.counters[name]; ok {
 		return &val, nil
 	}
@@ -72,29 +120,38 @@ func (m *MemStorage) GetCounter(ctx context.Context, name string) (*int64, error
 }
 
 func (m *MemStorage) GetMany(ctx context.Context, names MetricsStorageKeys) (MetricsStorageItems, error) {
+	if err := ctx.Err(); err != nil {
+		return MetricsStorageItems{}, err
+	}
+
 	rv := MetricsStorageItems{
 		Gauges:   make(map[string]float64, len(names.Gauges)),
 		Counters: make(map[string]int64, len(names.Counters)),
 	}
+
+	m.m.RLock()
+	defer m.m.RUnlock()
 	for _, v := range names.Gauges {
-		gauge, _ := m.GetGauge(ctx, v)
-		if gauge == nil {
-			continue
+		if gauge, ok := m.gauges[v]; ok {
+			rv.Gauges[v] = gauge
 		}
-		rv.Gauges[v] = *gauge
 	}
 	for _, v := range names.Counters {
-		counter, _ := m.GetCounter(ctx, v)
-		if counter == nil {
-			continue
+		if counter, ok := m.counters[v]; ok {
+			rv.Counters[v] = counter
 		}
-		rv.Counters[v] = *counter
 	}
 
 	return rv, nil
 }
 
 func (m *MemStorage) GetAll(ctx context.Context) (MetricsStorageItems, error) {
+	if err := ctx.Err(); err != nil {
+		return MetricsStorageItems{}, err
+	}
+
+	m.m.RLock()
+	defer m.m.RUnlock()
 	rv := MetricsStorageItems{
 		Gauges:   make(map[string]float64, len(m.gauges)),
 		Counters: make(map[string]int64, len(m.counters)),
@@ -109,27 +166,134 @@ func (m *MemStorage) GetAll(ctx context.Context) (MetricsStorageItems, error) {
 	return rv, nil
 }
 
+// matching returns entries selected by query apart from its position and limit, ordered by name and type.
+func (m *MemStorage) matching(query MetricsListQuery) ([]MetricsEntry, error) {
+	var re *regexp.Regexp
+	if query.Regex != "" {
+		var err error
+		re, err = regexp.Compile(query.Regex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rv []MetricsEntry
+	add := func(entry MetricsEntry) {
+		if query.MType != "" && query.MType != entry.MType {
+			return
+		}
+		if !strings.HasPrefix(entry.Name, query.Prefix) || (re != nil && !re.MatchString(entry.Name)) {
+			return
+		}
+		entry.UpdatedAt = m.updated[metricsKey{mType: entry.MType, name: entry.Name}]
+		rv = append(rv, entry)
+	}
+	for name, value := range m.gauges {
+		add(MetricsEntry{Name: name, MType: MetricsTypeGauge, Gauge: value})
+	}
+	for name, value := range m.counters {
+		add(MetricsEntry{Name: name, MType: MetricsTypeCounter, Counter: value})
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Name != rv[j].Name {
+			return rv[i].Name < rv[j].Name
+		}
+		return rv[i].MType < rv[j].MType
+	})
+	return rv, nil
+}
+
+func (m *MemStorage) List(ctx context.Context, query MetricsListQuery) ([]MetricsEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.m.RLock()
+	defer m.m.RUnlock()
+	entries, err := m.matching(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.AfterName != "" {
+		start := sort.Search(len(entries), func(i int) bool {
+			e := entries[i]
+			return e.Name > query.AfterName || (e.Name == query.AfterName && e.MType > query.AfterType)
+		})
+		entries = entries[start:]
+	}
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+	}
+
+	return entries, nil
+}
+
+func (m *MemStorage) Count(ctx context.Context, query MetricsListQuery) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.m.RLock()
+	defer m.m.RUnlock()
+	entries, err := m.matching(query)
+	return len(entries), err
+}
+
 func (m *MemStorage) SetMany(ctx context.Context, items MetricsStorageItems) error {
-	maps.Copy(m.gauges, items.Gauges)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	m.m.Lock()
+	defer m.m.Unlock()
+	for k, v := range items.Gauges {
+		m.gauges[k] = v
+		m.updated[metricsKey{mType: MetricsTypeGauge, name: k}] = now
+	}
 	for k, v := range items.Counters {
-		m.SetCounter(ctx, k, v)
+		m.counters[k] += v
+		m.updated[metricsKey{mType: MetricsTypeCounter, name: k}] = now
 	}
 
 	return nil
 }
 
 func (m *MemStorage) SetGauge(ctx context.Context, name string, value float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
 	m.gauges[name] = value
+	m.updated[metricsKey{mType: MetricsTypeGauge, name: name}] = time.Now()
 	return nil
 }
 
 func (m *MemStorage) SetCounter(ctx context.Context, name string, value int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
 	m.counters[name] += value
+	m.updated[metricsKey{mType: MetricsTypeCounter, name: name}] = time.Now()
 	return nil
 }
 
 func (m *MemStorage) ResetCounters(ctx context.Context) error {
+	m.m.Lock()
+	defer m.m.Unlock()
 	m.counters = make(map[string]int64)
+	for key := range m.updated {
+		if key.mType == MetricsTypeCounter {
+			delete(m.updated, key)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,14 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/SamMeown/metrix/internal/storage"
+	"github.com/SamMeown/metrix/internal/storage/storagetest"
+)
+
+func TestMemStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.MetricsStorage {
+		return storage.NewMemStorage()
+	})
+}
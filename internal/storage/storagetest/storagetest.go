@@ -0,0 +1,304 @@
+// Package storagetest contains a conformance suite for storage.MetricsStorage implementations.
+//
+// Every backend is expected to:
+//   - return nil values (and no error) for metrics that were never set, and skip them in GetMany;
+//   - overwrite gauges and accumulate counters, both in SetGauge/SetCounter and in SetMany;
+//   - list metrics ordered by name and type, filtered and paged as queried;
+//   - stay consistent under concurrent writers;
+//   - fail with an error when called with an already cancelled context.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SamMeown/metrix/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a fresh, empty storage. It is called once per subtest.
+type Factory func(t *testing.T) storage.MetricsStorage
+
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.MetricsStorage)
+	}{
+		{"missing values", testMissingValues},
+		{"gauge overwrite", testGaugeOverwrite},
+		{"counter accumulation", testCounterAccumulation},
+		{"set many", testSetMany},
+		{"get many", testGetMany},
+		{"get all", testGetAll},
+		{"list", testList},
+		{"concurrent writes", testConcurrentWrites},
+		{"context cancellation", testContextCancellation},
+		{"ping", testPing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStorage(t))
+		})
+	}
+}
+
+func testMissingValues(t *testing.T, s storage.MetricsStorage) {
+	ctx := context.Background()
+
+	gauge, err := s.GetGauge(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, gauge)
+
+	counter, err := s.GetCounter(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, counter)
+
+	require.NoError(t, s.SetGauge(ctx, "g", 1))
+	require.NoError(t, s.SetCounter(ctx, "c", 1))
+
+	// Gauges and counters live in separate namespaces
+	counter, err = s.GetCounter(ctx, "g")
+	require.NoError(t, err)
+	assert.Nil(t, counter)
+
+	gauge, err = s.GetGauge(ctx, "c")
+	require.NoError(t, err)
+	assert.Nil(t, gauge)
+}
+
+func testGaugeOverwrite(t *testing.T, s storage.MetricsStorage) {
+	ctx := context.Background()
+
+	require.NoError(t, s.SetGauge(ctx, "g", 1.5))
+	require.NoError(t, s.SetGauge(ctx, "g", -2.25))
+
+	gauge, err := s.GetGauge(ctx, "g")
+	require.NoError(t, err)
+	require.NotNil(t, gauge)
+	assert.Equal(t, -2.25, *gauge)
+}
+
+func testCounterAccumulation(t *testing.T, s storage.MetricsStorage) {
+	ctx := context.Background()
+
+	require.NoError(t, s.SetCounter(ctx, "c", 3))
+	require.NoError(t, s.SetCounter(ctx, "c", 4))
+	require.NoError(t, s.SetCounter(ctx, "c", -2))
+
+	counter, err := s.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	require.NotNil(t, counter)
+	assert.Equal(t, int64(5), *counter)
+}
+
+func testSetMany(t *testing.T, s storage.MetricsStorage) {
+	ctx := context.Background()
+
+	require.NoError(t, s.SetGauge(ctx, "g1", 10))
+	require.NoError(t, s.SetCounter(ctx, "c1", 10))
+
+	err := s.SetMany(ctx, storage.MetricsStorageItems{
+		Gauges:   map[string]float64{"g1": 1, "g2": 2},
+		Counters: map[string]int64{"c1": 1, "c2": 2},
+	})
+	require.NoError(t, err)
+
+	err = s.SetMany(ctx, storage.MetricsStorageItems{
+		Counters: map[string]int64{"c2": 5},
+	})
+	require.NoError(t, err)
+
+	all, err := s.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g1": 1, "g2": 2}, all.Gauges)
+	assert.Equal(t, map[string]int64{"c1": 11, "c2": 7}, all.Counters)
+}
+
+func testGetMany(t *testing.T, s storage.MetricsStorage) {
+	ctx := context.Background()
+
+	require.NoError(t, s.SetGauge(ctx, "g1", 1))
+	require.NoError(t, s.SetCounter(ctx, "c1", 1))
+
+	items, err := s.GetMany(ctx, storage.MetricsStorageKeys{
+		Gauges:   []string{"g1", "missing"},
+		Counters: []string{"c1", "missing"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g1": 1}, items.Gauges)
+	assert.Equal(t, map[string]int64{"c1": 1}, items.Counters)
+
+	items, err = s.GetMany(ctx, storage.MetricsStorageKeys{})
+	require.NoError(t, err)
+	assert.Empty(t, items.Gauges)
+	assert.Empty(t, items.Counters)
+}
+
+func testGetAll(t *testing.T, s storage.MetricsStorage) {
+	ctx := context.Background()
+
+	all, err := s.GetAll(ctx)
+	require.NoError(t, err)
+	assert.NotNil(t, all.Gauges)
+	assert.NotNil(t, all.Counters)
+	assert.Empty(t, all.Gauges)
+	assert.Empty(t, all.Counters)
+
+	require.NoError(t, s.SetGauge(ctx, "g", 1))
+	require.NoError(t, s.SetCounter(ctx, "c", 2))
+
+	all, err = s.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g": 1}, all.Gauges)
+	assert.Equal(t, map[string]int64{"c": 2}, all.Counters)
+}
+
+func testList(t *testing.T, s storage.MetricsStorage) {
+	ctx := context.Background()
+
+	entries, err := s.List(ctx, storage.MetricsListQuery{})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	start := time.Now().Add(-time.Minute)
+	require.NoError(t, s.SetMany(ctx, storage.MetricsStorageItems{
+		Gauges:   map[string]float64{"HeapAlloc": 1, "HeapSys": 2, "Alloc": 3, "Heap_": 4},
+		Counters: map[string]int64{"HeapAlloc": 5, "PollCount": 6},
+	}))
+
+	type item struct {
+		name  string
+		mType string
+	}
+	list := func(query storage.MetricsListQuery) []item {
+		entries, err := s.List(ctx, query)
+		require.NoError(t, err)
+
+		var rv []item
+		for _, e := range entries {
+			rv = append(rv, item{name: e.Name, mType: e.MType})
+		}
+		return rv
+	}
+
+	entries, err = s.List(ctx, storage.MetricsListQuery{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, storage.MetricsEntry{Name: "Alloc", MType: storage.MetricsTypeGauge, Gauge: 3}, withoutTime(entries[0]))
+	assert.Equal(t, storage.MetricsEntry{Name: "HeapAlloc", MType: storage.MetricsTypeCounter, Counter: 5}, withoutTime(entries[1]))
+	assert.True(t, entries[0].UpdatedAt.After(start), "updated at %s", entries[0].UpdatedAt)
+
+	// Order of underscores and letters depends on collation of the database
+	assert.ElementsMatch(t, []item{
+		{"HeapAlloc", storage.MetricsTypeGauge},
+		{"HeapSys", storage.MetricsTypeGauge},
+		{"Heap_", storage.MetricsTypeGauge},
+	}, list(storage.MetricsListQuery{MType: storage.MetricsTypeGauge, Prefix: "Heap"}))
+	assert.Equal(t, []item{{"Heap_", storage.MetricsTypeGauge}}, list(storage.MetricsListQuery{Prefix: "Heap_"}))
+	assert.Equal(t, []item{
+		{"HeapSys", storage.MetricsTypeGauge},
+		{"PollCount", storage.MetricsTypeCounter},
+	}, list(storage.MetricsListQuery{Regex: "(Sys|Count)$"}))
+	// Regular expressions are Go ones whatever the storage is, and the limit applies to matching metrics
+	assert.Equal(t, []item{{"HeapSys", storage.MetricsTypeGauge}}, list(storage.MetricsListQuery{Regex: "(?P<suffix>Sys|Count)$", Limit: 1}))
+	count, err := s.Count(ctx, storage.MetricsListQuery{Regex: "(?P<suffix>Sys|Count)$"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Pages continue after the last listed metrics
+	assert.Equal(t, []item{
+		{"HeapAlloc", storage.MetricsTypeGauge},
+		{"HeapSys", storage.MetricsTypeGauge},
+	}, list(storage.MetricsListQuery{AfterName: "HeapAlloc", AfterType: storage.MetricsTypeCounter, Limit: 2}))
+	assert.Empty(t, list(storage.MetricsListQuery{AfterName: "PollCount", AfterType: storage.MetricsTypeCounter}))
+
+	count, err = s.Count(ctx, storage.MetricsListQuery{Prefix: "Heap", AfterName: "HeapSys", Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+}
+
+func withoutTime(entry storage.MetricsEntry) storage.MetricsEntry {
+	entry.UpdatedAt = time.Time{}
+	return entry
+}
+
+func testConcurrentWrites(t *testing.T, s storage.MetricsStorage) {
+	const (
+		writers    = 8
+		iterations = 25
+	)
+
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*iterations*2)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				if err := s.SetCounter(ctx, "shared", 1); err != nil {
+					errs <- err
+				}
+				err := s.SetMany(ctx, storage.MetricsStorageItems{
+					Gauges:   map[string]float64{fmt.Sprintf("g%d", w): float64(i)},
+					Counters: map[string]int64{"shared": 1, "batch": 2},
+				})
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	all, err := s.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(writers*iterations*2), all.Counters["shared"])
+	assert.Equal(t, int64(writers*iterations*2), all.Counters["batch"])
+	assert.Len(t, all.Gauges, writers)
+	for w := 0; w < writers; w++ {
+		assert.Equal(t, float64(iterations-1), all.Gauges[fmt.Sprintf("g%d", w)])
+	}
+}
+
+func testContextCancellation(t *testing.T, s storage.MetricsStorage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Error(t, s.SetGauge(ctx, "g", 1))
+	assert.Error(t, s.SetCounter(ctx, "c", 1))
+	assert.Error(t, s.SetMany(ctx, storage.MetricsStorageItems{
+		Gauges:   map[string]float64{"g": 1},
+		Counters: map[string]int64{"c": 1},
+	}))
+
+	_, err := s.GetGauge(ctx, "g")
+	assert.Error(t, err)
+	_, err = s.GetCounter(ctx, "c")
+	assert.Error(t, err)
+	_, err = s.GetMany(ctx, storage.MetricsStorageKeys{Gauges: []string{"g"}})
+	assert.Error(t, err)
+	_, err = s.GetAll(ctx)
+	assert.Error(t, err)
+
+	// Nothing should have been written with the cancelled context
+	all, err := s.GetAll(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, all.Gauges)
+	assert.Empty(t, all.Counters)
+}
+
+func testPing(t *testing.T, s storage.MetricsStorage) {
+	assert.NoError(t, s.Ping(context.Background()))
+}
@@ -1,8 +1,10 @@
 package configutils
 
 import (
+	"net"
 	"os"
 	"strconv"
+	"strings"
 )
 
 var LookupEnvString = os.LookupEnv
@@ -21,6 +23,20 @@ func LookupEnvInt(name string) (int, bool) {
 	return int(intValue), true
 }
 
+func LookupEnvFloat(name string) (float64, bool) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return 0, false
+	}
+
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	return floatValue, true
+}
+
 func LookupEnvBool(name string) (bool, bool) {
 	value, ok := os.LookupEnv(name)
 	if !ok {
@@ -34,3 +50,22 @@ func LookupEnvBool(name string) (bool, bool) {
 
 	return boolValue, true
 }
+
+// ParseCIDRList parses comma separated list of CIDRs, e.g. "10.0.0.0/8, 192.168.1.0/24".
+func ParseCIDRList(value string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
+}